@@ -0,0 +1,68 @@
+package envoyds
+
+import (
+	"fmt"
+	"time"
+)
+
+const (
+	CLUSTER_CONNECT_TIMEOUT = time.Millisecond * 250
+	CLUSTER_LB_POLICY       = "round_robin"
+)
+
+// clusterLbPolicies are the load balancing policies a cluster may use.
+var clusterLbPolicies = map[string]bool{
+	"round_robin":   true,
+	"least_request": true,
+	"random":        true,
+	"ring_hash":     true,
+	"maglev":        true,
+}
+
+// clusterConfig holds the settings of the Envoy cluster generated for a
+// service. Circuit breaker thresholds left at 0 are Envoy's defaults.
+type clusterConfig struct {
+	ConnectTimeout     duration `toml:"connect_timeout"`
+	LbPolicy           string   `toml:"lb_policy"`
+	MaxConnections     uint32   `toml:"max_connections"`
+	MaxPendingRequests uint32   `toml:"max_pending_requests"`
+	MaxRequests        uint32   `toml:"max_requests"`
+	MaxRetries         uint32   `toml:"max_retries"`
+}
+
+// inherit returns c with the settings it leaves unset taken from defaults.
+func (c clusterConfig) inherit(defaults clusterConfig) clusterConfig {
+	if c.ConnectTimeout.Duration == 0 {
+		c.ConnectTimeout = defaults.ConnectTimeout
+	}
+	if c.LbPolicy == "" {
+		c.LbPolicy = defaults.LbPolicy
+	}
+	if c.MaxConnections == 0 {
+		c.MaxConnections = defaults.MaxConnections
+	}
+	if c.MaxPendingRequests == 0 {
+		c.MaxPendingRequests = defaults.MaxPendingRequests
+	}
+	if c.MaxRequests == 0 {
+		c.MaxRequests = defaults.MaxRequests
+	}
+	if c.MaxRetries == 0 {
+		c.MaxRetries = defaults.MaxRetries
+	}
+	return c
+}
+
+func (c clusterConfig) hasCircuitBreakers() bool {
+	return c.MaxConnections != 0 || c.MaxPendingRequests != 0 || c.MaxRequests != 0 || c.MaxRetries != 0
+}
+
+func (c clusterConfig) validate() error {
+	if !clusterLbPolicies[c.LbPolicy] {
+		return fmt.Errorf("unknown cluster lb_policy %q", c.LbPolicy)
+	}
+	if c.ConnectTimeout.Duration < time.Millisecond {
+		return fmt.Errorf("cluster connect_timeout %s is shorter than 1ms", c.ConnectTimeout.Duration)
+	}
+	return nil
+}
@@ -3,24 +3,46 @@ package main
 import (
 	"fmt"
 	"log"
+	"net"
 	"net/http"
 	"os"
 	"github.com/ykevinc/envoyds"
 )
 
 func main() {
+	args := os.Args[1:]
+	migrate := len(args) > 0 && args[0] == "migrate"
+	if migrate {
+		args = args[1:]
+	}
 	configPath := "envoyds.conf"
-	if len(os.Args) > 1 {
-		configPath = os.Args[1]
+	if len(args) > 0 {
+		configPath = args[0]
 	}
 	c := envoyds.ReadConfig(configPath)
-	r, err := envoyds.NewRouter(c.Environment, c.RedisHost, c.RedisPort)
+	if migrate {
+		if err := envoyds.MigrateStorage(c); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	ds, err := envoyds.NewEnvoyDS(c)
 	if err != nil {
 		log.Fatal(err)
 	}
+	if c.XDSPort != 0 {
+		l, err := net.Listen("tcp", fmt.Sprintf(":%d", c.XDSPort))
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Printf("Ready to serve xDS on %d\n", c.XDSPort)
+		go func() {
+			log.Fatal(envoyds.NewXDSServer(ds).Serve(l))
+		}()
+	}
 	server := http.Server{
 		Addr:    fmt.Sprintf(":%d", c.Port),
-		Handler: r,
+		Handler: envoyds.NewRouter(ds),
 	}
 	fmt.Printf("Ready to Listen on %d\n", c.Port)
 	if err = server.ListenAndServe(); err != nil {
@@ -1,34 +1,77 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
+	"context"
 	"fmt"
+	"github.com/alicebob/miniredis/v2"
+	cluster "github.com/envoyproxy/go-control-plane/envoy/config/cluster/v3"
+	core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	endpoint "github.com/envoyproxy/go-control-plane/envoy/config/endpoint/v3"
+	clusterservice "github.com/envoyproxy/go-control-plane/envoy/service/cluster/v3"
+	discovery "github.com/envoyproxy/go-control-plane/envoy/service/discovery/v3"
+	endpointservice "github.com/envoyproxy/go-control-plane/envoy/service/endpoint/v3"
 	"github.com/golang/protobuf/jsonpb"
+	"github.com/golang/protobuf/proto"
 	"github.com/ykevinc/envoyds"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/protobuf/types/known/structpb"
+	"io/ioutil"
+	"net"
 	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
 	"strconv"
+	"strings"
 	"testing"
 	"time"
 )
 
 const (
 	TEST_HOST           = "localhost"
-	TEST_REDIS_PORT     = 6379
 	TEST_HTTP_PORT      = 8000
+	TEST_XDS_PORT       = 18000
+	TEST_CONFIG_PATH    = "envoyds_test.conf"
 	TEST_SERVICE_PREFIX = "test_integration_service"
 )
 
-func setUp(t *testing.T) {
-	var err error
-	r, err := envoyds.NewRouter("test", TEST_HOST, TEST_REDIS_PORT)
+// serverSentEvent is an event read from the feed of /v1/events.
+type serverSentEvent struct {
+	eventType string
+	id        string
+	data      string
+}
+
+// xdsClientStream is the client side of the stream of any resource type.
+type xdsClientStream interface {
+	Send(*discovery.DiscoveryRequest) error
+	Recv() (*discovery.DiscoveryResponse, error)
+}
+
+// setUp serves router and xdsServer on the test ports, and returns a function
+// that stops serving them.
+func setUp(t *testing.T, router http.Handler, xdsServer *grpc.Server) func() {
+	server := http.Server{
+		Handler: router,
+	}
+	l, err := net.Listen("tcp", fmt.Sprintf(":%d", TEST_HTTP_PORT))
 	if err != nil {
 		t.Fatal(err)
 	}
-	server := http.Server{
-		Addr:    fmt.Sprintf(":%d", TEST_HTTP_PORT),
-		Handler: r,
+	go server.Serve(l)
+	xdsListener, err := net.Listen("tcp", fmt.Sprintf(":%d", TEST_XDS_PORT))
+	if err != nil {
+		t.Fatal(err)
+	}
+	go xdsServer.Serve(xdsListener)
+	return func() {
+		xdsServer.Stop()
+		server.Close()
+		http.DefaultClient.CloseIdleConnections()
 	}
-	go server.ListenAndServe()
 }
 
 func tearDown(t *testing.T, testService string) {
@@ -104,6 +147,26 @@ func testDelete(t *testing.T, testService string) {
 	}
 }
 
+// testIPv6 checks that the hosts of an ip are told apart from those of
+// another IPv6 address written with it as a prefix.
+func testIPv6(t *testing.T, testService string) {
+	marshaler := jsonpb.Marshaler{EmitDefaults: true, OrigName: true}
+	callToRegister(t, &marshaler, &envoyds.ServicePostRequest{Ip: "::1", Port: 80}, testService, http.StatusOK)
+	callToRegister(t, &marshaler, &envoyds.ServicePostRequest{Ip: "::1:2", Port: 80}, testService, http.StatusOK)
+	defer callToDelete(t, testService, "::1:2", 80, http.StatusOK)
+
+	callToPatch(t, testService, "::1", "application/json", `{"revision": "r2"}`, http.StatusOK)
+	callToDelete(t, testService, "::1", 0, http.StatusOK)
+	getResponse := envoyds.ServiceGetResponse{}
+	callToGet(t, &marshaler, &getResponse, testService)
+	if len(getResponse.Hosts) != 1 {
+		t.Fatalf("got %d hosts, want %d hosts", len(getResponse.Hosts), 1)
+	}
+	if host := getResponse.Hosts[0]; host.IpAddress != "::1:2" || host.Revision != "" {
+		t.Fatalf("got host %s with revision %q, want host %s with revision %q", host.IpAddress, host.Revision, "::1:2", "")
+	}
+}
+
 func testUpdate(t *testing.T, testService string) {
 	oldWeight := int32(78)
 	newWeight := int32(3)
@@ -136,73 +199,1584 @@ func testUpdate(t *testing.T, testService string) {
 	}
 }
 
-func callToRegister(t *testing.T, marshaler *jsonpb.Marshaler, postRequest *envoyds.ServicePostRequest, testService string, expectHttpStatus int) {
-	v, err := marshaler.MarshalToString(postRequest)
+func testRepo(t *testing.T, testService string) {
+	testRepoName := testService + "_repo"
+	otherService := testService + "_other"
+
+	postRequestPort33 := envoyds.ServicePostRequest{}
+	postRequestPort33.Port = 33
+	postRequestPort33.Ip = "123.123.123.128"
+	postRequestPort33.ServiceRepoName = testRepoName
+	postRequestPort36 := envoyds.ServicePostRequest{}
+	postRequestPort36.Port = 36
+	postRequestPort36.Ip = "123.123.123.128"
+	postRequestPort36.ServiceRepoName = testRepoName
+	postRequestOtherRepo := envoyds.ServicePostRequest{}
+	postRequestOtherRepo.Port = 39
+	postRequestOtherRepo.Ip = "123.123.123.128"
+	postRequestOtherRepo.ServiceRepoName = testRepoName + "_other"
+
+	marshaler := jsonpb.Marshaler{EmitDefaults: true, OrigName: true}
+	callToRegister(t, &marshaler, &postRequestPort33, testService, http.StatusOK)
+	defer callToDelete(t, testService, postRequestPort33.GetIp(), int(postRequestPort33.GetPort()), http.StatusOK)
+	callToRegister(t, &marshaler, &postRequestPort36, otherService, http.StatusOK)
+	defer callToDelete(t, otherService, postRequestPort36.GetIp(), int(postRequestPort36.GetPort()), http.StatusOK)
+	callToRegister(t, &marshaler, &postRequestOtherRepo, testService, http.StatusOK)
+	defer callToDelete(t, testService, postRequestOtherRepo.GetIp(), int(postRequestOtherRepo.GetPort()), http.StatusOK)
+
+	getResponse := envoyds.RepoGetResponse{}
+	callToGetRepo(t, &getResponse, testRepoName)
+	if len(getResponse.Hosts) != 2 {
+		t.Fatalf("got %d hosts, want %d hosts", len(getResponse.Hosts), 2)
+	}
+	if len(getResponse.Services) != 2 {
+		t.Fatalf("got %d services, want %d services", len(getResponse.Services), 2)
+	}
+	if getResponse.Services[0].Service != testService || getResponse.Services[1].Service != otherService {
+		t.Fatalf("got services %s and %s, want %s and %s", getResponse.Services[0].Service, getResponse.Services[1].Service, testService, otherService)
+	}
+	if len(getResponse.Services[0].Hosts) != 1 || getResponse.Services[0].Hosts[0].Port != postRequestPort33.Port {
+		t.Fatalf("got hosts %v, want port %d", getResponse.Services[0].Hosts, postRequestPort33.Port)
+	}
+}
+
+func testTTL(t *testing.T, testService string) {
+	postRequestDefault := envoyds.ServicePostRequest{}
+	postRequestDefault.Port = 33
+	postRequestDefault.Ip = "123.123.123.129"
+	postRequestShort := envoyds.ServicePostRequest{}
+	postRequestShort.Port = 36
+	postRequestShort.Ip = "123.123.123.129"
+	postRequestShort.Ttl = 1
+	postRequestLong := envoyds.ServicePostRequest{}
+	postRequestLong.Port = 39
+	postRequestLong.Ip = "123.123.123.129"
+	postRequestLong.Ttl = 86400
+	postRequestNegative := envoyds.ServicePostRequest{}
+	postRequestNegative.Port = 42
+	postRequestNegative.Ip = "123.123.123.129"
+	postRequestNegative.Ttl = -1
+
+	marshaler := jsonpb.Marshaler{EmitDefaults: true, OrigName: true}
+	callToRegister(t, &marshaler, &postRequestNegative, testService, http.StatusBadRequest)
+	wants := map[int32]int32{}
+	for input, want := range map[*envoyds.ServicePostRequest]int32{
+		&postRequestDefault: 600,
+		&postRequestShort:   30,
+		&postRequestLong:    3600,
+	} {
+		callToRegister(t, &marshaler, input, testService, http.StatusOK)
+		defer callToDelete(t, testService, input.GetIp(), int(input.GetPort()), http.StatusOK)
+		wants[input.Port] = want
+	}
+	callToUpdateWeight(t, &marshaler, testService, "123.123.123.129", 0, 5, http.StatusOK)
+
+	getResponse := envoyds.ServiceGetResponse{}
+	callToGet(t, &marshaler, &getResponse, testService)
+	if len(getResponse.Hosts) != len(wants) {
+		t.Fatalf("got %d hosts, want %d hosts", len(getResponse.Hosts), len(wants))
+	}
+	for _, host := range getResponse.Hosts {
+		if host.Ttl != wants[host.Port] {
+			t.Fatalf("got ttl %d on port %d, want ttl %d", host.Ttl, host.Port, wants[host.Port])
+		}
+	}
+}
+
+func testEDS(t *testing.T, testService string) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+	conn, err := grpc.NewClient(fmt.Sprintf("%s:%d", TEST_HOST, TEST_XDS_PORT), grpc.WithTransportCredentials(insecure.NewCredentials()))
 	if err != nil {
 		t.Fatal(err)
 	}
-	reader := bytes.NewBufferString(v)
-	resp, err := http.Post(fmt.Sprintf("http://%s:%d/v1/registration/%s", TEST_HOST, TEST_HTTP_PORT, testService), "application/json; charset=utf-8", reader)
+	defer conn.Close()
+	stream, err := endpointservice.NewEndpointDiscoveryServiceClient(conn).StreamEndpoints(ctx)
 	if err != nil {
 		t.Fatal(err)
 	}
-	defer resp.Body.Close()
-	if resp.StatusCode != expectHttpStatus {
-		t.Fatal(resp.StatusCode)
+
+	req := &discovery.DiscoveryRequest{
+		Node:          &core.Node{Id: "test"},
+		TypeUrl:       envoyds.XDS_ENDPOINT_TYPE_URL,
+		ResourceNames: []string{testService},
+	}
+	assignment := callToStreamEndpoints(t, stream, req)
+	if assignment.ClusterName != testService || len(lbEndpoints(assignment)) != 0 {
+		t.Fatalf("got %v, want no endpoints of %s", assignment, testService)
+	}
+
+	postRequest := envoyds.ServicePostRequest{}
+	postRequest.Port = 33
+	postRequest.Ip = "123.123.123.130"
+	postRequest.Tags = &envoyds.Tags{LoadBalancingWeight: 7}
+	marshaler := jsonpb.Marshaler{EmitDefaults: true, OrigName: true}
+	callToRegister(t, &marshaler, &postRequest, testService, http.StatusOK)
+	assignment = callToStreamEndpoints(t, stream, req)
+	if len(lbEndpoints(assignment)) != 1 {
+		t.Fatalf("got %d endpoints, want %d endpoints", len(lbEndpoints(assignment)), 1)
+	}
+	lbEndpoint := lbEndpoints(assignment)[0]
+	address := lbEndpoint.GetEndpoint().GetAddress().GetSocketAddress()
+	if address.GetAddress() != postRequest.Ip || address.GetPortValue() != uint32(postRequest.Port) || lbEndpoint.GetLoadBalancingWeight().GetValue() != 7 {
+		t.Fatalf("got %v, want %s:%d with weight %d", lbEndpoint, postRequest.Ip, postRequest.Port, 7)
+	}
+
+	callToDelete(t, testService, postRequest.Ip, int(postRequest.Port), http.StatusOK)
+	assignment = callToStreamEndpoints(t, stream, req)
+	if len(lbEndpoints(assignment)) != 0 {
+		t.Fatalf("got %d endpoints, want %d endpoints", len(lbEndpoints(assignment)), 0)
 	}
 }
 
-func callToGet(t *testing.T, marshaler *jsonpb.Marshaler, getResponse *envoyds.ServiceGetResponse, testService string) {
-	resp, err := http.Get(fmt.Sprintf("http://%s:%d/v1/registration/%s", TEST_HOST, TEST_HTTP_PORT, testService))
+func testLocalities(t *testing.T, testService string) {
+	postRequestA1 := envoyds.ServicePostRequest{}
+	postRequestA1.Port = 33
+	postRequestA1.Ip = "123.123.123.133"
+	postRequestA1.Tags = &envoyds.Tags{Region: "r1", Az: "r1a", LoadBalancingWeight: 2}
+	postRequestA2 := envoyds.ServicePostRequest{}
+	postRequestA2.Port = 36
+	postRequestA2.Ip = "123.123.123.133"
+	postRequestA2.Tags = &envoyds.Tags{Region: "r1", Az: "r1a", LoadBalancingWeight: 3}
+	postRequestB := envoyds.ServicePostRequest{}
+	postRequestB.Port = 39
+	postRequestB.Ip = "123.123.123.133"
+	postRequestB.Tags = &envoyds.Tags{Region: "r2", Az: "r2b"}
+
+	marshaler := jsonpb.Marshaler{EmitDefaults: true, OrigName: true}
+	for _, input := range []*envoyds.ServicePostRequest{&postRequestA1, &postRequestA2, &postRequestB} {
+		callToRegister(t, &marshaler, input, testService, http.StatusOK)
+		defer callToDelete(t, testService, input.GetIp(), int(input.GetPort()), http.StatusOK)
+	}
+
+	assignment := callToFetchEndpoints(t, testService, &core.Node{Id: "test"})
+	if len(assignment.Endpoints) != 2 {
+		t.Fatalf("got %d localities, want %d localities", len(assignment.Endpoints), 2)
+	}
+	wants := []struct {
+		region, zone string
+		weight       uint32
+		endpoints    int
+	}{
+		{"r1", "r1a", 5, 2},
+		{"r2", "r2b", 1, 1},
+	}
+	for i, want := range wants {
+		locality := assignment.Endpoints[i]
+		if locality.Locality.GetRegion() != want.region || locality.Locality.GetZone() != want.zone {
+			t.Fatalf("got locality %v, want %s/%s", locality.Locality, want.region, want.zone)
+		}
+		if locality.LoadBalancingWeight.GetValue() != want.weight || len(locality.LbEndpoints) != want.endpoints {
+			t.Fatalf("got weight %d with %d endpoints in %s, want weight %d with %d endpoints", locality.LoadBalancingWeight.GetValue(), len(locality.LbEndpoints), want.zone, want.weight, want.endpoints)
+		}
+	}
+}
+
+func testFailover(t *testing.T, testService string) {
+	regions := []string{"r3", "r1", "r2", ""}
+	marshaler := jsonpb.Marshaler{EmitDefaults: true, OrigName: true}
+	for i, region := range regions {
+		postRequest := envoyds.ServicePostRequest{}
+		postRequest.Port = int32(40 + i)
+		postRequest.Ip = "123.123.123.134"
+		postRequest.Tags = &envoyds.Tags{Region: region, Az: region + "a"}
+		callToRegister(t, &marshaler, &postRequest, testService, http.StatusOK)
+		defer callToDelete(t, testService, postRequest.GetIp(), int(postRequest.GetPort()), http.StatusOK)
+	}
+
+	// r1 fails over to r2, then to every other region
+	getResponse := envoyds.ServiceGetResponse{}
+	callToGetFromRegion(t, &getResponse, testService, "r1")
+	wants := map[string]int32{"r1": 0, "r2": 1, "r3": 2, "": 2}
+	if len(getResponse.Hosts) != len(wants) {
+		t.Fatalf("got %d hosts, want %d hosts", len(getResponse.Hosts), len(wants))
+	}
+	for i, host := range getResponse.Hosts {
+		if want := wants[host.GetTags().GetRegion()]; host.Priority != want {
+			t.Fatalf("got priority %d for %q, want priority %d", host.Priority, host.GetTags().GetRegion(), want)
+		}
+		if i > 0 && host.Priority < getResponse.Hosts[i-1].Priority {
+			t.Fatalf("got priority %d after priority %d, want hosts ordered by priority", host.Priority, getResponse.Hosts[i-1].Priority)
+		}
+	}
+
+	// the header names the caller region too, and can be combined with a
+	// filter on the region of the hosts
+	getResponse = envoyds.ServiceGetResponse{}
+	callToGetFromRegionHeader(t, &getResponse, testService, "r1")
+	if len(getResponse.Hosts) != len(wants) || getResponse.Hosts[0].GetTags().GetRegion() != "r1" || getResponse.Hosts[0].Priority != 0 {
+		t.Fatalf("got %v, want the hosts of r1 first", &getResponse)
+	}
+	getResponse = envoyds.ServiceGetResponse{}
+	callToGetMatching(t, &getResponse, testService, "region=r2&caller_region=r1", http.StatusOK)
+	if len(getResponse.Hosts) != 1 || getResponse.Hosts[0].GetTags().GetRegion() != "r2" || getResponse.Hosts[0].Priority != 0 {
+		t.Fatalf("got %v, want the host of r2 with priority 0", &getResponse)
+	}
+
+	// r3 has no failover order, so every other region comes next
+	assignment := callToFetchEndpoints(t, testService, &core.Node{Id: "test", Locality: &core.Locality{Region: "r3"}})
+	if len(assignment.Endpoints) != len(regions) {
+		t.Fatalf("got %d localities, want %d localities", len(assignment.Endpoints), len(regions))
+	}
+	for _, locality := range assignment.Endpoints {
+		want := uint32(1)
+		if locality.Locality.GetRegion() == "r3" {
+			want = 0
+		}
+		if locality.Priority != want {
+			t.Fatalf("got priority %d for %q, want priority %d", locality.Priority, locality.Locality.GetRegion(), want)
+		}
+	}
+
+	// without a region every host is as preferred
+	assignment = callToFetchEndpoints(t, testService, &core.Node{Id: "test"})
+	for _, locality := range assignment.Endpoints {
+		if locality.Priority != 0 {
+			t.Fatalf("got priority %d for %q, want priority %d", locality.Priority, locality.Locality.GetRegion(), 0)
+		}
+	}
+}
+
+func testFilter(t *testing.T, testService string) {
+	postRequests := []*envoyds.ServicePostRequest{
+		{Ip: "123.123.123.135", Port: 40, Revision: "abc123", Tags: &envoyds.Tags{Region: "r1", Az: "r1a"}},
+		{Ip: "123.123.123.135", Port: 41, Revision: "abc123", Tags: &envoyds.Tags{Region: "r1", Az: "r1b", Canary: true}},
+		{Ip: "123.123.123.135", Port: 42, Revision: "def456", Tags: &envoyds.Tags{Region: "r2", Az: "r2a"}},
+	}
+	marshaler := jsonpb.Marshaler{EmitDefaults: true, OrigName: true}
+	for _, postRequest := range postRequests {
+		callToRegister(t, &marshaler, postRequest, testService, http.StatusOK)
+		defer callToDelete(t, testService, postRequest.GetIp(), int(postRequest.GetPort()), http.StatusOK)
+	}
+
+	wants := []struct {
+		query string
+		ports []int32
+	}{
+		{"region=r1", []int32{40, 41}},
+		{"region=r1&canary=false", []int32{40}},
+		{"az=r1b", []int32{41}},
+		{"revision=abc123&canary=true", []int32{41}},
+		{"revision=def456&region=r1", nil},
+		{"az=r3a", nil},
+	}
+	for _, want := range wants {
+		getResponse := envoyds.ServiceGetResponse{}
+		callToGetMatching(t, &getResponse, testService, want.query, http.StatusOK)
+		ports := make(map[int32]bool)
+		for _, host := range getResponse.Hosts {
+			ports[host.Port] = true
+		}
+		if len(ports) != len(want.ports) {
+			t.Fatalf("got %d hosts for %s, want %d hosts", len(ports), want.query, len(want.ports))
+		}
+		for _, port := range want.ports {
+			if !ports[port] {
+				t.Fatalf("got no host on port %d for %s", port, want.query)
+			}
+		}
+	}
+
+	// a host leaves the indexes of the tags it no longer has
+	postRequests[1].Tags.Canary = false
+	callToRegister(t, &marshaler, postRequests[1], testService, http.StatusOK)
+	getResponse := envoyds.ServiceGetResponse{}
+	callToGetMatching(t, &getResponse, testService, "canary=true", http.StatusOK)
+	if len(getResponse.Hosts) != 0 {
+		t.Fatalf("got %d hosts, want %d hosts", len(getResponse.Hosts), 0)
+	}
+	callToGetMatching(t, &getResponse, testService, "canary=maybe", http.StatusBadRequest)
+}
+
+func testLbSubset(t *testing.T, testService string) {
+	postRequest := envoyds.ServicePostRequest{}
+	postRequest.Port = 33
+	postRequest.Ip = "123.123.123.136"
+	postRequest.Revision = "abc123"
+	postRequest.Tags = &envoyds.Tags{Region: "r1", Az: "r1a", Canary: true}
+	marshaler := jsonpb.Marshaler{EmitDefaults: true, OrigName: true}
+	callToRegister(t, &marshaler, &postRequest, testService, http.StatusOK)
+	defer callToDelete(t, testService, postRequest.Ip, int(postRequest.Port), http.StatusOK)
+
+	// only the mapped fields become keys, under the names they are mapped to
+	checkSubset := func(subset map[string]*structpb.Value) {
+		if len(subset) != 2 || !subset["canary"].GetBoolValue() || subset["version"].GetStringValue() != "abc123" {
+			t.Fatalf("got subset keys %v, want canary true and version abc123", subset)
+		}
+	}
+	getResponse := envoyds.ServiceGetResponse{}
+	callToGet(t, &marshaler, &getResponse, testService)
+	if len(getResponse.Hosts) != 1 {
+		t.Fatalf("got %d hosts, want %d hosts", len(getResponse.Hosts), 1)
+	}
+	checkSubset(getResponse.Hosts[0].GetMetadata().GetFields()["envoy.lb"].GetStructValue().GetFields())
+
+	assignment := callToFetchEndpoints(t, testService, &core.Node{Id: "test"})
+	if len(lbEndpoints(assignment)) != 1 {
+		t.Fatalf("got %d endpoints, want %d endpoints", len(lbEndpoints(assignment)), 1)
+	}
+	checkSubset(lbEndpoints(assignment)[0].GetMetadata().GetFilterMetadata()["envoy.lb"].GetFields())
+}
+
+func testEncodings(t *testing.T, testService string) {
+	postRequest := envoyds.ServicePostRequest{}
+	postRequest.Port = 33
+	postRequest.Ip = "123.123.123.137"
+	postRequest.Revision = "abc123"
+	postRequest.Tags = &envoyds.Tags{Az: "r1a", Canary: true}
+	marshaler := jsonpb.Marshaler{OrigName: true}
+	jsonBody, err := marshaler.MarshalToString(&postRequest)
 	if err != nil {
 		t.Fatal(err)
 	}
-	defer resp.Body.Close()
-	if err := jsonpb.Unmarshal(resp.Body, getResponse); err != nil {
+	protobufBody, err := proto.Marshal(&postRequest)
+	if err != nil {
 		t.Fatal(err)
 	}
+	formBody := url.Values{
+		"ip":       {postRequest.Ip},
+		"port":     {strconv.Itoa(int(postRequest.Port))},
+		"revision": {postRequest.Revision},
+		"tags":     {`{"az":"r1a","canary":true}`},
+	}.Encode()
+	bodies := []struct {
+		contentType string
+		body        string
+	}{
+		{"application/json; charset=utf-8", jsonBody},
+		{"application/x-protobuf", string(protobufBody)},
+		{"application/x-www-form-urlencoded", formBody},
+	}
+	for _, body := range bodies {
+		callToRegisterBody(t, testService, body.contentType, body.body, http.StatusOK)
+		getResponse := envoyds.ServiceGetResponse{}
+		callToGet(t, &marshaler, &getResponse, testService)
+		if len(getResponse.Hosts) != 1 {
+			t.Fatalf("got %d hosts from %s, want %d hosts", len(getResponse.Hosts), body.contentType, 1)
+		}
+		host := getResponse.Hosts[0]
+		if host.Revision != postRequest.Revision || host.GetTags().GetAz() != "r1a" || !host.GetTags().GetCanary() {
+			t.Fatalf("got %v from %s, want %v", host, body.contentType, &postRequest)
+		}
+		callToDelete(t, testService, postRequest.Ip, int(postRequest.Port), http.StatusOK)
+	}
+
+	// tags are optional in every encoding
+	untagged := envoyds.ServicePostRequest{Ip: postRequest.Ip, Port: postRequest.Port}
+	jsonBody, _ = marshaler.MarshalToString(&untagged)
+	protobufBody, _ = proto.Marshal(&untagged)
+	untaggedForm := url.Values{
+		"ip":   {untagged.Ip},
+		"port": {strconv.Itoa(int(untagged.Port))},
+	}.Encode()
+	for _, body := range []struct {
+		contentType string
+		query       string
+		body        string
+	}{
+		{"application/json", "", jsonBody},
+		{"application/x-protobuf", "", string(protobufBody)},
+		{"application/x-www-form-urlencoded", "", untaggedForm},
+		{"", "?" + untaggedForm, ""},
+	} {
+		callToRegisterBody(t, testService+body.query, body.contentType, body.body, http.StatusOK)
+		getResponse := envoyds.ServiceGetResponse{}
+		callToGet(t, &marshaler, &getResponse, testService)
+		if len(getResponse.Hosts) != 1 || getResponse.Hosts[0].IpAddress != untagged.Ip {
+			t.Fatalf("got %v from %q, want host %s", &getResponse, body.contentType, untagged.Ip)
+		}
+		callToDelete(t, testService, untagged.Ip, int(untagged.Port), http.StatusOK)
+	}
+
+	// every encoding is validated the same way
+	postRequest.Ttl = -1
+	jsonBody, _ = marshaler.MarshalToString(&postRequest)
+	protobufBody, _ = proto.Marshal(&postRequest)
+	var messages []string
+	for _, body := range []struct {
+		contentType string
+		body        string
+	}{
+		{"application/json", jsonBody},
+		{"application/x-protobuf", string(protobufBody)},
+		{"application/x-www-form-urlencoded", formBody + "&ttl=-1"},
+	} {
+		messages = append(messages, callToRegisterBody(t, testService, body.contentType, body.body, http.StatusBadRequest))
+	}
+	if messages[0] != messages[1] || messages[1] != messages[2] {
+		t.Fatalf("got errors %q, want the same error", messages)
+	}
+	// a host without an ip and port cannot be deleted, so it is refused
+	messages = messages[:0]
+	for _, body := range []struct {
+		contentType string
+		body        string
+	}{
+		{"application/json", "{}"},
+		{"application/x-protobuf", ""},
+		{"application/x-www-form-urlencoded", ""},
+		{"application/x-www-form-urlencoded", "ip=" + postRequest.Ip},
+	} {
+		messages = append(messages, callToRegisterBody(t, testService, body.contentType, body.body, http.StatusBadRequest))
+	}
+	for _, message := range messages[1:] {
+		if message != messages[0] {
+			t.Fatalf("got errors %q, want the same error", messages)
+		}
+	}
+	callToRegisterBody(t, testService, "application/json", "{", http.StatusBadRequest)
+	callToRegisterBody(t, testService, "text/plain", jsonBody, http.StatusUnsupportedMediaType)
 }
 
-func callToDelete(t *testing.T, testService string, ip string, port int, expectHttpStatus int) {
-	client := &http.Client{}
-	req, err := http.NewRequest(http.MethodDelete, fmt.Sprintf("http://%s:%d/v1/registration/%s/%s/%d", TEST_HOST, TEST_HTTP_PORT, testService, ip, port), nil)
-	if err != nil {
+func testResponseFormats(t *testing.T, testService string) {
+	postRequest := envoyds.ServicePostRequest{}
+	postRequest.Port = 33
+	postRequest.Ip = "123.123.123.138"
+	postRequest.Tags = &envoyds.Tags{Az: "r1a"}
+	marshaler := jsonpb.Marshaler{EmitDefaults: true, OrigName: true}
+	callToRegister(t, &marshaler, &postRequest, testService, http.StatusOK)
+	defer callToDelete(t, testService, postRequest.Ip, int(postRequest.Port), http.StatusOK)
+
+	path := "/v1/registration/" + testService
+	body := callToGetAs(t, path, "application/x-protobuf", "application/x-protobuf", http.StatusOK)
+	getResponse := envoyds.ServiceGetResponse{}
+	if err := proto.Unmarshal([]byte(body), &getResponse); err != nil {
 		t.Fatal(err)
 	}
-	resp, err := client.Do(req)
+	if len(getResponse.Hosts) != 1 || getResponse.Hosts[0].IpAddress != postRequest.Ip {
+		t.Fatalf("got %v, want host %s", &getResponse, postRequest.Ip)
+	}
+	for _, accept := range []string{"text/plain", "text/*;q=0.9, application/x-protobuf;q=0.1"} {
+		body = callToGetAs(t, path, accept, "text/plain; charset=utf-8", http.StatusOK)
+		if !strings.HasPrefix(body, "SERVICE") || !strings.Contains(body, postRequest.Ip) || !strings.Contains(body, "r1a") {
+			t.Fatalf("got %q for %s, want a table of host %s", body, accept, postRequest.Ip)
+		}
+	}
+	body = callToGetAs(t, path+"?format=table", "application/json", "text/plain; charset=utf-8", http.StatusOK)
+	if !strings.Contains(body, postRequest.Ip) {
+		t.Fatalf("got %q, want a table of host %s", body, postRequest.Ip)
+	}
+	callToGetAs(t, path, "application/x-protobuf;q=0.5, application/json", "application/json", http.StatusOK)
+	callToGetAs(t, path, "", "application/json", http.StatusOK)
+	callToGetAs(t, "/v1/clusters/envoy/node1?format=table", "", "text/plain; charset=utf-8", http.StatusOK)
+	callToGetAs(t, path, "application/xml", "", http.StatusNotAcceptable)
+	callToGetAs(t, path+"?format=xml", "", "", http.StatusBadRequest)
+}
+
+func testBulk(t *testing.T, testService string) {
+	otherService := testService + "_bulk"
+	registrationRequest := envoyds.BulkRegistrationRequest{Registrations: []*envoyds.BulkRegistration{
+		{Service: testService, Host: &envoyds.ServicePostRequest{Ip: "123.123.123.140", Port: 33, Revision: "abc123"}},
+		{Service: "bad" + envoyds.REDIS_DELIMITER + "service", Host: &envoyds.ServicePostRequest{Ip: "123.123.123.141", Port: 33}},
+		{Service: otherService, Host: &envoyds.ServicePostRequest{Ip: "123.123.123.142", Port: 34, Tags: &envoyds.Tags{Az: "r1a"}}},
+		{Service: testService, Host: &envoyds.ServicePostRequest{Ip: "123.123.123.143", Port: 33, Ttl: -1}},
+		{Service: testService, Host: &envoyds.ServicePostRequest{Revision: "abc123"}},
+		{Service: testService, Host: &envoyds.ServicePostRequest{Ip: "123.123.123.144"}},
+	}}
+	bulkResponse := envoyds.BulkResponse{}
+	callToBulk(t, "registration", &registrationRequest, &bulkResponse, http.StatusOK)
+	expectBulkStatuses(t, &bulkResponse, http.StatusOK, http.StatusBadRequest, http.StatusOK, http.StatusBadRequest, http.StatusBadRequest, http.StatusBadRequest)
+	// items without a port are refused alike whether registered or deleted
+	deregistrationResponse := envoyds.BulkResponse{}
+	callToBulk(t, "deregistration", &envoyds.BulkDeregistrationRequest{Deregistrations: []*envoyds.BulkDeregistration{
+		{Service: testService, Ip: "123.123.123.144"},
+	}}, &deregistrationResponse, http.StatusOK)
+	if bulkResponse.Results[5].Error != deregistrationResponse.Results[0].Error {
+		t.Fatalf("got errors %q and %q, want the same error", bulkResponse.Results[5].Error, deregistrationResponse.Results[0].Error)
+	}
+
+	marshaler := jsonpb.Marshaler{EmitDefaults: true, OrigName: true}
+	getResponse := envoyds.ServiceGetResponse{}
+	callToGet(t, &marshaler, &getResponse, testService)
+	if len(getResponse.Hosts) != 1 || getResponse.Hosts[0].IpAddress != "123.123.123.140" || getResponse.Hosts[0].Revision != "abc123" {
+		t.Fatalf("got %v, want host %s", &getResponse, "123.123.123.140")
+	}
+	getResponse = envoyds.ServiceGetResponse{}
+	callToGet(t, &marshaler, &getResponse, otherService)
+	if len(getResponse.Hosts) != 1 || getResponse.Hosts[0].GetTags().GetAz() != "r1a" {
+		t.Fatalf("got %v, want host %s", &getResponse, "123.123.123.142")
+	}
+
+	// registering again updates the host
+	registrationRequest.Registrations = registrationRequest.Registrations[:1]
+	registrationRequest.Registrations[0].Host.Revision = "def456"
+	bulkResponse = envoyds.BulkResponse{}
+	callToBulk(t, "registration", &registrationRequest, &bulkResponse, http.StatusOK)
+	expectBulkStatuses(t, &bulkResponse, http.StatusOK)
+	getResponse = envoyds.ServiceGetResponse{}
+	callToGet(t, &marshaler, &getResponse, testService)
+	if len(getResponse.Hosts) != 1 || getResponse.Hosts[0].Revision != "def456" {
+		t.Fatalf("got %v, want revision %s", &getResponse, "def456")
+	}
+
+	deregistrationRequest := envoyds.BulkDeregistrationRequest{Deregistrations: []*envoyds.BulkDeregistration{
+		{Service: testService, Ip: "123.123.123.140", Port: 33},
+		{Service: otherService, Ip: "123.123.123.142"},
+		{Service: otherService, Ip: "123.123.123.142", Port: 34},
+		{Service: testService, Ip: "123.123.123.141", Port: 33},
+	}}
+	bulkResponse = envoyds.BulkResponse{}
+	callToBulk(t, "deregistration", &deregistrationRequest, &bulkResponse, http.StatusOK)
+	expectBulkStatuses(t, &bulkResponse, http.StatusOK, http.StatusBadRequest, http.StatusOK, http.StatusNotFound)
+	tearDown(t, otherService)
+
+	callToBulk(t, "registration", &envoyds.BulkRegistrationRequest{}, nil, http.StatusBadRequest)
+	resp, err := http.Post(fmt.Sprintf("http://%s:%d/v1/bulk/registration", TEST_HOST, TEST_HTTP_PORT), "application/x-www-form-urlencoded", bytes.NewBufferString("service="+testService))
 	if err != nil {
 		t.Fatal(err)
 	}
-	defer resp.Body.Close()
-	if resp.StatusCode != expectHttpStatus {
-		t.Fatal(resp.StatusCode)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnsupportedMediaType {
+		t.Fatalf("got status %d for a form, want %d", resp.StatusCode, http.StatusUnsupportedMediaType)
 	}
 }
 
-func callToUpdateWeight(t *testing.T, marshaler *jsonpb.Marshaler, testService string, ip string, port int, weight int32, expectHttpStatus int) {
-	var postRequest envoyds.ServiceUpdateLoadBalancingRequest
-	postRequest.LoadBalancingWeight = weight
-	v, err := marshaler.MarshalToString(&postRequest)
-	if err != nil {
+func testPatch(t *testing.T, testService string) {
+	postRequest := envoyds.ServicePostRequest{}
+	postRequest.Ip = "123.123.123.150"
+	postRequest.Revision = "abc123"
+	postRequest.Ttl = 120
+	postRequest.Tags = &envoyds.Tags{Az: "r1a", InstanceId: "i-1", LoadBalancingWeight: 5}
+	marshaler := jsonpb.Marshaler{EmitDefaults: true, OrigName: true}
+	for _, port := range []int32{33, 34} {
+		postRequest.Port = port
+		callToRegister(t, &marshaler, &postRequest, testService, http.StatusOK)
+		defer callToDelete(t, testService, postRequest.Ip, int(port), http.StatusOK)
+	}
+
+	callToPatch(t, testService, postRequest.Ip+"/33", "application/json", `{"revision": "def456", "canary": true}`, http.StatusOK)
+	getResponse := envoyds.ServiceGetResponse{}
+	callToGetMatching(t, &getResponse, testService, "revision=def456", http.StatusOK)
+	if len(getResponse.Hosts) != 1 {
+		t.Fatalf("got %d hosts of revision %s, want %d hosts", len(getResponse.Hosts), "def456", 1)
+	}
+	host := getResponse.Hosts[0]
+	if host.Port != 33 || !host.GetTags().GetCanary() || host.GetTags().GetAz() != "r1a" || host.GetTags().GetInstanceId() != "i-1" || host.GetTags().GetLoadBalancingWeight() != 5 || host.Ttl != 120 {
+		t.Fatalf("got %v, want only revision and canary changed", host)
+	}
+
+	// without a port every host on the ip is changed
+	callToPatch(t, testService, postRequest.Ip, "application/x-www-form-urlencoded", "az=r1b&load_balancing_weight=7", http.StatusOK)
+	getResponse = envoyds.ServiceGetResponse{}
+	callToGetMatching(t, &getResponse, testService, "az=r1b", http.StatusOK)
+	if len(getResponse.Hosts) != 2 {
+		t.Fatalf("got %d hosts in az %s, want %d hosts", len(getResponse.Hosts), "r1b", 2)
+	}
+	for _, host := range getResponse.Hosts {
+		if host.GetTags().GetLoadBalancingWeight() != 7 || host.GetTags().GetInstanceId() != "i-1" || host.Ttl != 120 {
+			t.Fatalf("got %v, want only az and weight changed", host)
+		}
+	}
+	getResponse = envoyds.ServiceGetResponse{}
+	callToGetMatching(t, &getResponse, testService, "az=r1a", http.StatusOK)
+	if len(getResponse.Hosts) != 0 {
+		t.Fatalf("got %d hosts in az %s, want %d hosts", len(getResponse.Hosts), "r1a", 0)
+	}
+
+	// an empty string is a value too
+	callToPatch(t, testService, postRequest.Ip+"/34", "application/json", `{"instance_id": ""}`, http.StatusOK)
+	getResponse = envoyds.ServiceGetResponse{}
+	callToGetMatching(t, &getResponse, testService, "revision=abc123", http.StatusOK)
+	if len(getResponse.Hosts) != 1 || getResponse.Hosts[0].GetTags().GetInstanceId() != "" || getResponse.Hosts[0].GetTags().GetAz() != "r1b" {
+		t.Fatalf("got %v, want instance id cleared", &getResponse)
+	}
+
+	callToPatch(t, testService, postRequest.Ip+"/33", "application/json", `{}`, http.StatusBadRequest)
+	callToPatch(t, testService, postRequest.Ip+"/33", "application/json", `{"load_balancing_weight": 0}`, http.StatusBadRequest)
+	callToPatch(t, testService, postRequest.Ip+"/33", "application/x-www-form-urlencoded", "canary=maybe", http.StatusBadRequest)
+	callToPatch(t, testService, postRequest.Ip+"/35", "application/json", `{"canary": true}`, http.StatusNotFound)
+}
+
+// testConcurrentUpdates changes every field of a host at the same time, one
+// request per field, and checks that none of the changes is lost.
+func testConcurrentUpdates(t *testing.T, testService string) {
+	postRequest := envoyds.ServicePostRequest{}
+	postRequest.Ip = "123.123.123.151"
+	postRequest.Port = 33
+	postRequest.Tags = &envoyds.Tags{LoadBalancingWeight: 1}
+	marshaler := jsonpb.Marshaler{EmitDefaults: true, OrigName: true}
+	callToRegister(t, &marshaler, &postRequest, testService, http.StatusOK)
+	defer callToDelete(t, testService, postRequest.Ip, int(postRequest.Port), http.StatusOK)
+
+	path := fmt.Sprintf("%s/%d", postRequest.Ip, postRequest.Port)
+	for round := 1; round <= 5; round++ {
+		bodies := []string{
+			fmt.Sprintf(`{"revision": "r%d"}`, round),
+			fmt.Sprintf(`{"az": "az%d"}`, round),
+			fmt.Sprintf(`{"region": "region%d"}`, round),
+			fmt.Sprintf(`{"instance_id": "i-%d"}`, round),
+			fmt.Sprintf(`{"canary": %t}`, round%2 == 1),
+			fmt.Sprintf(`{"load_balancing_weight": %d}`, round+1),
+		}
+		errs := make(chan error, len(bodies))
+		for _, body := range bodies {
+			go func(body string) {
+				errs <- patchHost(testService, path, body)
+			}(body)
+		}
+		for range bodies {
+			if err := <-errs; err != nil {
+				t.Fatal(err)
+			}
+		}
+		getResponse := envoyds.ServiceGetResponse{}
+		callToGetMatching(t, &getResponse, testService, fmt.Sprintf("revision=r%d", round), http.StatusOK)
+		if len(getResponse.Hosts) != 1 {
+			t.Fatalf("got %d hosts of revision r%d, want %d hosts", len(getResponse.Hosts), round, 1)
+		}
+		tags := getResponse.Hosts[0].GetTags()
+		if tags.GetAz() != fmt.Sprintf("az%d", round) || tags.GetRegion() != fmt.Sprintf("region%d", round) ||
+			tags.GetInstanceId() != fmt.Sprintf("i-%d", round) || tags.GetCanary() != (round%2 == 1) ||
+			tags.GetLoadBalancingWeight() != int32(round+1) {
+			t.Fatalf("got %v after round %d, want every field of the round", getResponse.Hosts[0], round)
+		}
+	}
+}
+
+func testWatch(t *testing.T, testService string) {
+	postRequest := envoyds.ServicePostRequest{}
+	postRequest.Port = 33
+	postRequest.Ip = "123.123.123.160"
+	marshaler := jsonpb.Marshaler{EmitDefaults: true, OrigName: true}
+	callToRegister(t, &marshaler, &postRequest, testService, http.StatusOK)
+	defer callToDelete(t, testService, postRequest.Ip, int(postRequest.Port), http.StatusOK)
+	getResponse := envoyds.ServiceGetResponse{}
+	index := callToWatch(t, &getResponse, testService, "", http.StatusOK)
+	if index == 0 {
+		t.Fatalf("got index %d, want an index", index)
+	}
+
+	// without a change the watch times out with the same index
+	start := time.Now()
+	if got := callToWatch(t, &getResponse, testService, fmt.Sprintf("index=%d&wait=100ms", index), http.StatusOK); got != index {
+		t.Fatalf("got index %d, want %d", got, index)
+	}
+	if elapsed := time.Since(start); elapsed < 100*time.Millisecond {
+		t.Fatalf("watch returned after %s, want it to wait %s", elapsed, 100*time.Millisecond)
+	}
+
+	// a change ends the watch
+	registered := make(chan error, 1)
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		resp, err := http.Post(fmt.Sprintf("http://%s:%d/v1/registration/%s?ip=123.123.123.161&port=33", TEST_HOST, TEST_HTTP_PORT, testService), "", nil)
+		if err == nil {
+			resp.Body.Close()
+		}
+		registered <- err
+	}()
+	start = time.Now()
+	getResponse = envoyds.ServiceGetResponse{}
+	changed := callToWatch(t, &getResponse, testService, fmt.Sprintf("index=%d&wait=10s", index), http.StatusOK)
+	if err := <-registered; err != nil {
 		t.Fatal(err)
 	}
-	reader := bytes.NewBufferString(v)
-	resp, err := http.Post(fmt.Sprintf("http://%s:%d/v1/loadbalancing/%s/%s/%d", TEST_HOST, TEST_HTTP_PORT, testService, ip, port), "application/json; charset=utf-8", reader)
-	if err != nil {
+	defer callToDelete(t, testService, "123.123.123.161", 33, http.StatusOK)
+	if changed <= index || len(getResponse.Hosts) != 2 || time.Since(start) > 5*time.Second {
+		t.Fatalf("got index %d and %d hosts after %s, want an index after %d and %d hosts", changed, len(getResponse.Hosts), time.Since(start), index, 2)
+	}
+
+	// an index that is not current returns at once
+	start = time.Now()
+	if got := callToWatch(t, &getResponse, testService, fmt.Sprintf("index=%d&wait=10s", index), http.StatusOK); got != changed || time.Since(start) > 5*time.Second {
+		t.Fatalf("got index %d after %s, want %d at once", got, time.Since(start), changed)
+	}
+	callToWatch(t, &getResponse, testService, "index=abc", http.StatusBadRequest)
+	callToWatch(t, &getResponse, testService, fmt.Sprintf("index=%d&wait=-1s", changed), http.StatusBadRequest)
+}
+
+func testEvents(t *testing.T, testService string) {
+	otherService := testService + "_events"
+	events, closeEvents := callToStreamEvents(t, "service="+testService, "", http.StatusOK)
+	postRequest := envoyds.ServicePostRequest{}
+	postRequest.Port = 33
+	postRequest.Ip = "123.123.123.170"
+	marshaler := jsonpb.Marshaler{EmitDefaults: true, OrigName: true}
+	callToRegister(t, &marshaler, &postRequest, otherService, http.StatusOK)
+	callToRegister(t, &marshaler, &postRequest, testService, http.StatusOK)
+	callToPatch(t, testService, postRequest.Ip+"/33", "application/json", `{"canary": true}`, http.StatusOK)
+	callToDelete(t, testService, postRequest.Ip, int(postRequest.Port), http.StatusOK)
+	callToDelete(t, otherService, postRequest.Ip, int(postRequest.Port), http.StatusOK)
+	var got []serverSentEvent
+	for _, eventType := range []string{"registered", "updated", "deleted"} {
+		event := expectServerSentEvent(t, events, eventType)
+		e := envoyds.Event{}
+		if err := jsonpb.UnmarshalString(event.data, &e); err != nil {
+			t.Fatal(err)
+		}
+		if e.GetHost().GetService() != testService || e.GetHost().GetIpAddress() != postRequest.Ip {
+			t.Fatalf("got %v, want an event of host %s of %s", &e, postRequest.Ip, testService)
+		}
+		got = append(got, event)
+	}
+	// ids are the service and its index
+	for i := 1; i < len(got); i++ {
+		previous, _ := strconv.ParseUint(strings.TrimPrefix(got[i-1].id, testService+":"), 10, 64)
+		if id, err := strconv.ParseUint(strings.TrimPrefix(got[i].id, testService+":"), 10, 64); err != nil || id != previous+1 {
+			t.Fatalf("got event id %s after %s, want the next index of %s", got[i].id, got[i-1].id, testService)
+		}
+	}
+	closeEvents()
+
+	// resuming replays the events after the last one received
+	events, closeEvents = callToStreamEvents(t, "service="+testService, got[0].id, http.StatusOK)
+	for i, eventType := range []string{"updated", "deleted"} {
+		if event := expectServerSentEvent(t, events, eventType); event.id != got[i+1].id {
+			t.Fatalf("got event %s, want event %s", event.id, got[i+1].id)
+		}
+	}
+	closeEvents()
+
+	// an unknown id is sent a snapshot of the hosts, and the events after it
+	callToRegister(t, &marshaler, &postRequest, testService, http.StatusOK)
+	getResponse := envoyds.ServiceGetResponse{}
+	index := callToWatch(t, &getResponse, testService, "", http.StatusOK)
+	events, closeEvents = callToStreamEvents(t, "service="+testService+"&last_event_id="+testService+":99999999", "", http.StatusOK)
+	defer closeEvents()
+	snapshot := expectServerSentEvent(t, events, "snapshot")
+	if want := fmt.Sprintf("%s:%d", testService, index); snapshot.id != want {
+		t.Fatalf("got snapshot %s, want %s", snapshot.id, want)
+	}
+	getResponse = envoyds.ServiceGetResponse{}
+	if err := jsonpb.UnmarshalString(snapshot.data, &getResponse); err != nil {
 		t.Fatal(err)
 	}
-	defer resp.Body.Close()
-	if resp.StatusCode != expectHttpStatus {
-		t.Fatal(resp.StatusCode)
+	if getResponse.Service != testService || len(getResponse.Hosts) != 1 || getResponse.Hosts[0].IpAddress != postRequest.Ip {
+		t.Fatalf("got snapshot %v, want host %s of %s", &getResponse, postRequest.Ip, testService)
 	}
+	callToDelete(t, testService, postRequest.Ip, int(postRequest.Port), http.StatusOK)
+	if event, want := expectServerSentEvent(t, events, "deleted"), fmt.Sprintf("%s:%d", testService, index+1); event.id != want {
+		t.Fatalf("got event %s, want %s", event.id, want)
+	}
+	callToStreamEvents(t, "", "abc", http.StatusBadRequest)
+	callToStreamEvents(t, "", testService+":abc", http.StatusBadRequest)
 }
 
-func TestServer(t *testing.T) {
+func testETags(t *testing.T, testService string) {
+	postRequest := envoyds.ServicePostRequest{}
+	postRequest.Port = 33
+	postRequest.Ip = "123.123.123.180"
+	postRequest.ServiceRepoName = testService + "_etag_repo"
+	marshaler := jsonpb.Marshaler{EmitDefaults: true, OrigName: true}
+	callToRegister(t, &marshaler, &postRequest, testService, http.StatusOK)
+	defer callToDelete(t, testService, postRequest.Ip, int(postRequest.Port), http.StatusOK)
+
+	path := "/v1/registration/" + testService
+	tag := callToGetConditional(t, path, "", "", http.StatusOK)
+	if !strings.HasPrefix(tag, `W/"`) {
+		t.Fatalf("got ETag %q, want a weak ETag", tag)
+	}
+	if got := callToGetConditional(t, path, "", tag, http.StatusNotModified); got != tag {
+		t.Fatalf("got ETag %q, want %q", got, tag)
+	}
+	callToGetConditional(t, path, "", `"other", `+tag, http.StatusNotModified)
+	if got := callToGetConditional(t, path, "application/x-protobuf", tag, http.StatusOK); got == tag {
+		t.Fatalf("got ETag %q for protobuf, want another ETag than for JSON", got)
+	}
+
+	// checking in changes the ETag, unless check in times are ignored
+	stableTag := callToGetConditional(t, path+"?ignore_check_in=true", "", "", http.StatusOK)
+	time.Sleep(5 * time.Millisecond)
+	callToRegister(t, &marshaler, &postRequest, testService, http.StatusOK)
+	callToGetConditional(t, path, "", tag, http.StatusOK)
+	callToGetConditional(t, path+"?ignore_check_in=true", "", stableTag, http.StatusNotModified)
+	callToPatch(t, testService, postRequest.Ip+"/33", "application/json", `{"canary": true}`, http.StatusOK)
+	callToGetConditional(t, path+"?ignore_check_in=true", "", stableTag, http.StatusOK)
+
+	repoPath := "/v1/registration/repo/" + postRequest.ServiceRepoName
+	repoTag := callToGetConditional(t, repoPath, "", "", http.StatusOK)
+	callToGetConditional(t, repoPath, "", repoTag, http.StatusNotModified)
+
+	// other lookups are not tagged, and answered in full whatever they send
+	for _, path := range []string{"/v1/services", "/v1/clusters/envoy/node"} {
+		if got := callToGetConditional(t, path, "", "*", http.StatusOK); got != "" {
+			t.Fatalf("got ETag %q for %s, want none", got, path)
+		}
+	}
+}
+
+func testCatalog(t *testing.T, testService string) {
+	prefix := testService + "_catalog_"
+	marshaler := jsonpb.Marshaler{EmitDefaults: true, OrigName: true}
+	registrations := []struct {
+		service string
+		request envoyds.ServicePostRequest
+	}{
+		{prefix + "a", envoyds.ServicePostRequest{Ip: "123.123.123.190", Port: 33, Revision: "v2", Tags: &envoyds.Tags{Az: "r1a"}}},
+		{prefix + "a", envoyds.ServicePostRequest{Ip: "123.123.123.191", Port: 33, Revision: "v1", Tags: &envoyds.Tags{Az: "r1a"}}},
+		{prefix + "a", envoyds.ServicePostRequest{Ip: "123.123.123.192", Port: 33, Revision: "v1"}},
+		{prefix + "b", envoyds.ServicePostRequest{Ip: "123.123.123.193", Port: 33}},
+	}
+	for _, registration := range registrations {
+		callToRegister(t, &marshaler, &registration.request, registration.service, http.StatusOK)
+		defer callToDelete(t, registration.service, registration.request.Ip, int(registration.request.Port), http.StatusOK)
+	}
+
+	getResponse := envoyds.ServicesGetResponse{}
+	callToGetCatalog(t, &getResponse, "prefix="+prefix)
+	if len(getResponse.Services) != 2 || getResponse.Services[0].Service != prefix+"a" || getResponse.Services[1].Service != prefix+"b" {
+		t.Fatalf("got %v, want services %s and %s", &getResponse, prefix+"a", prefix+"b")
+	}
+	summary := getResponse.Services[0]
+	if summary.Hosts != 3 || len(summary.Azs) != 2 || summary.Azs[0].Az != "" || summary.Azs[0].Hosts != 1 || summary.Azs[1].Az != "r1a" || summary.Azs[1].Hosts != 2 {
+		t.Fatalf("got %v, want 3 hosts, 2 of them in az %s", summary, "r1a")
+	}
+	if strings.Join(summary.Revisions, ",") != "v1,v2" {
+		t.Fatalf("got revisions %v, want %v", summary.Revisions, []string{"v1", "v2"})
+	}
+	oldest, _ := strconv.ParseInt(summary.OldestCheckIn, 10, 64)
+	newest, _ := strconv.ParseInt(summary.NewestCheckIn, 10, 64)
+	if oldest == 0 || oldest > newest {
+		t.Fatalf("got check ins from %s to %s, want the oldest first", summary.OldestCheckIn, summary.NewestCheckIn)
+	}
+
+	getResponse = envoyds.ServicesGetResponse{}
+	callToGetCatalog(t, &getResponse, "")
+	found := false
+	for _, summary := range getResponse.Services {
+		found = found || summary.Service == prefix+"b"
+	}
+	if !found {
+		t.Fatalf("got %v, want service %s", &getResponse, prefix+"b")
+	}
+	body := callToGetAs(t, "/v1/services?prefix="+prefix, "text/plain", "text/plain; charset=utf-8", http.StatusOK)
+	if !strings.HasPrefix(body, "SERVICE") || !strings.Contains(body, "-=1,r1a=2") {
+		t.Fatalf("got %q, want a table of services", body)
+	}
+}
+
+func testHealth(t *testing.T) {
+	healthResponse := envoyds.HealthResponse{}
+	callToGetHealth(t, &healthResponse, "/healthcheck", http.StatusOK)
+	if healthResponse.Status != "pass" {
+		t.Fatalf("got liveness %v, want %s", &healthResponse, "pass")
+	}
+	healthResponse = envoyds.HealthResponse{}
+	callToGetHealth(t, &healthResponse, "/healthcheck/ready", http.StatusOK)
+	if healthResponse.Status != "pass" || len(healthResponse.Checks) != 2 {
+		t.Fatalf("got readiness %v, want %s with %d checks", &healthResponse, "pass", 2)
+	}
+	for i, name := range []string{"storage.ping", "storage.probe"} {
+		check := healthResponse.Checks[i]
+		if check.Name != name || check.Status != "pass" || check.Error != "" || check.LatencyMs < 0 {
+			t.Fatalf("got check %v, want %s to pass", check, name)
+		}
+	}
+}
+
+func testClusters(t *testing.T, testService string) {
+	postRequest := envoyds.ServicePostRequest{}
+	postRequest.Port = 33
+	postRequest.Ip = "123.123.123.131"
+	marshaler := jsonpb.Marshaler{EmitDefaults: true, OrigName: true}
+	callToRegister(t, &marshaler, &postRequest, testService, http.StatusOK)
+	defer callToDelete(t, testService, postRequest.Ip, int(postRequest.Port), http.StatusOK)
+
+	getResponse := envoyds.ClustersGetResponse{}
+	callToGetClusters(t, &getResponse)
+	var found *envoyds.Cluster
+	for _, c := range getResponse.Clusters {
+		if c.Name == testService {
+			found = c
+		}
+	}
+	if found == nil {
+		t.Fatalf("got clusters %v, want cluster %s", getResponse.Clusters, testService)
+	}
+	if found.Type != "sds" || found.ServiceName != testService || found.ConnectTimeoutMs != 1000 || found.LbType != "round_robin" {
+		t.Fatalf("got %v, want sds cluster of %s", found, testService)
+	}
+	if found.CircuitBreakers.GetDefault().GetMaxConnections() != 100 {
+		t.Fatalf("got circuit breakers %v, want max_connections %d", found.CircuitBreakers, 100)
+	}
+}
+
+func testCDS(t *testing.T, testService string) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+	conn, err := grpc.NewClient(fmt.Sprintf("%s:%d", TEST_HOST, TEST_XDS_PORT), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	stream, err := clusterservice.NewClusterDiscoveryServiceClient(conn).StreamClusters(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := &discovery.DiscoveryRequest{
+		Node:    &core.Node{Id: "test"},
+		TypeUrl: envoyds.XDS_CLUSTER_TYPE_URL,
+	}
+	if clusters := callToStreamClusters(t, stream, req); clusters[testService] != nil {
+		t.Fatalf("got cluster %s before it registered", testService)
+	}
+
+	postRequest := envoyds.ServicePostRequest{}
+	postRequest.Port = 33
+	postRequest.Ip = "123.123.123.132"
+	marshaler := jsonpb.Marshaler{EmitDefaults: true, OrigName: true}
+	callToRegister(t, &marshaler, &postRequest, testService, http.StatusOK)
+	clusters := callToStreamClusters(t, stream, req)
+	c := clusters[testService]
+	if c == nil {
+		t.Fatalf("got clusters %v, want cluster %s", clusters, testService)
+	}
+	if c.GetType() != cluster.Cluster_EDS || c.GetEdsClusterConfig().GetServiceName() != testService || c.GetConnectTimeout().AsDuration() != time.Second {
+		t.Fatalf("got %v, want EDS cluster of %s", c, testService)
+	}
+	var selectors []string
+	for _, selector := range c.GetLbSubsetConfig().GetSubsetSelectors() {
+		selectors = append(selectors, strings.Join(selector.Keys, ","))
+	}
+	if strings.Join(selectors, " ") != "canary version canary,version" {
+		t.Fatalf("got subset selectors %v, want %s", selectors, "canary version canary,version")
+	}
+	if c.GetCommonLbConfig().GetLocalityWeightedLbConfig() == nil || !c.GetLbSubsetConfig().GetLocalityWeightAware() {
+		t.Fatalf("got %v, want locality weighted load balancing", c)
+	}
+
+	callToDelete(t, testService, postRequest.Ip, int(postRequest.Port), http.StatusOK)
+	if clusters = callToStreamClusters(t, stream, req); clusters[testService] != nil {
+		t.Fatalf("got cluster %s after it was deleted", testService)
+	}
+}
+
+func callToRegister(t *testing.T, marshaler *jsonpb.Marshaler, postRequest *envoyds.ServicePostRequest, testService string, expectHttpStatus int) {
+	v, err := marshaler.MarshalToString(postRequest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reader := bytes.NewBufferString(v)
+	resp, err := http.Post(fmt.Sprintf("http://%s:%d/v1/registration/%s", TEST_HOST, TEST_HTTP_PORT, testService), "application/json; charset=utf-8", reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != expectHttpStatus {
+		t.Fatal(resp.StatusCode)
+	}
+}
+
+// callToRegisterBody posts body as contentType and returns the response.
+func callToRegisterBody(t *testing.T, testService string, contentType string, body string, expectHttpStatus int) string {
+	resp, err := http.Post(fmt.Sprintf("http://%s:%d/v1/registration/%s", TEST_HOST, TEST_HTTP_PORT, testService), contentType, bytes.NewBufferString(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	bs, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != expectHttpStatus {
+		t.Fatal(resp.StatusCode, string(bs))
+	}
+	return string(bs)
+}
+
+func callToBulk(t *testing.T, kind string, bulkRequest proto.Message, bulkResponse *envoyds.BulkResponse, expectHttpStatus int) {
+	marshaler := jsonpb.Marshaler{OrigName: true}
+	body, err := marshaler.MarshalToString(bulkRequest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.Post(fmt.Sprintf("http://%s:%d/v1/bulk/%s", TEST_HOST, TEST_HTTP_PORT, kind), "application/json", bytes.NewBufferString(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != expectHttpStatus {
+		t.Fatalf("got status %d, want %d", resp.StatusCode, expectHttpStatus)
+	}
+	if bulkResponse == nil {
+		return
+	}
+	if err := jsonpb.Unmarshal(resp.Body, bulkResponse); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func expectBulkStatuses(t *testing.T, bulkResponse *envoyds.BulkResponse, statuses ...int) {
+	if len(bulkResponse.Results) != len(statuses) {
+		t.Fatalf("got %d results, want %d results", len(bulkResponse.Results), len(statuses))
+	}
+	for i, result := range bulkResponse.Results {
+		if int(result.Status) != statuses[i] || (result.Status == http.StatusOK) != (result.Error == "") {
+			t.Fatalf("got result %v for item %d, want status %d", result, i, statuses[i])
+		}
+	}
+}
+
+// patchHost patches path with a JSON body and returns an error unless it is
+// answered with 200. Unlike the callTo helpers it may run in any goroutine.
+func patchHost(testService string, path string, body string) error {
+	req, err := http.NewRequest(http.MethodPatch, fmt.Sprintf("http://%s:%d/v1/registration/%s/%s", TEST_HOST, TEST_HTTP_PORT, testService, path), bytes.NewBufferString(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		bs, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("patch %s with %s: %d %s", path, body, resp.StatusCode, bs)
+	}
+	return nil
+}
+
+func callToPatch(t *testing.T, testService string, path string, contentType string, body string, expectHttpStatus int) {
+	req, err := http.NewRequest(http.MethodPatch, fmt.Sprintf("http://%s:%d/v1/registration/%s/%s", TEST_HOST, TEST_HTTP_PORT, testService, path), bytes.NewBufferString(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", contentType)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != expectHttpStatus {
+		bs, _ := ioutil.ReadAll(resp.Body)
+		t.Fatal(resp.StatusCode, string(bs))
+	}
+}
+
+func callToWatch(t *testing.T, getResponse *envoyds.ServiceGetResponse, testService string, query string, expectHttpStatus int) uint64 {
+	resp, err := http.Get(fmt.Sprintf("http://%s:%d/v1/registration/%s?%s", TEST_HOST, TEST_HTTP_PORT, testService, query))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != expectHttpStatus {
+		t.Fatalf("got status %d for %s, want %d", resp.StatusCode, query, expectHttpStatus)
+	}
+	if expectHttpStatus != http.StatusOK {
+		return 0
+	}
+	if err := jsonpb.Unmarshal(resp.Body, getResponse); err != nil {
+		t.Fatal(err)
+	}
+	index, err := strconv.ParseUint(resp.Header.Get("X-Envoyds-Index"), 10, 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return index
+}
+
+func callToStreamEvents(t *testing.T, query string, lastEventID string, expectHttpStatus int) (<-chan serverSentEvent, func()) {
+	return callToStreamEventsOn(t, fmt.Sprintf("http://%s:%d", TEST_HOST, TEST_HTTP_PORT), query, lastEventID, expectHttpStatus)
+}
+
+func callToStreamEventsOn(t *testing.T, url string, query string, lastEventID string, expectHttpStatus int) (<-chan serverSentEvent, func()) {
+	req, err := http.NewRequest(http.MethodGet, fmt.Sprintf("%s/v1/events?%s", url, query), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lastEventID != "" {
+		req.Header.Set("Last-Event-ID", lastEventID)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != expectHttpStatus {
+		resp.Body.Close()
+		t.Fatalf("got status %d, want %d", resp.StatusCode, expectHttpStatus)
+	}
+	events := make(chan serverSentEvent, 16)
+	go func() {
+		defer close(events)
+		var event serverSentEvent
+		scanner := bufio.NewScanner(resp.Body)
+		for scanner.Scan() {
+			line := scanner.Text()
+			switch {
+			case line == "":
+				if event.eventType != "" {
+					events <- event
+				}
+				event = serverSentEvent{}
+			case strings.HasPrefix(line, "event: "):
+				event.eventType = strings.TrimPrefix(line, "event: ")
+			case strings.HasPrefix(line, "id: "):
+				event.id = strings.TrimPrefix(line, "id: ")
+			case strings.HasPrefix(line, "data: "):
+				event.data = strings.TrimPrefix(line, "data: ")
+			}
+		}
+	}()
+	return events, func() {
+		resp.Body.Close()
+	}
+}
+
+func expectServerSentEvent(t *testing.T, events <-chan serverSentEvent, eventType string) serverSentEvent {
+	select {
+	case event, ok := <-events:
+		if !ok {
+			t.Fatalf("feed closed, want a %s event", eventType)
+		}
+		if event.eventType != eventType {
+			t.Fatalf("got a %s event, want a %s event", event.eventType, eventType)
+		}
+		return event
+	case <-time.After(5 * time.Second):
+		t.Fatalf("got no event, want a %s event", eventType)
+	}
+	return serverSentEvent{}
+}
+
+func callToGetConditional(t *testing.T, path string, accept string, ifNoneMatch string, expectHttpStatus int) string {
+	req, err := http.NewRequest(http.MethodGet, fmt.Sprintf("http://%s:%d%s", TEST_HOST, TEST_HTTP_PORT, path), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if accept != "" {
+		req.Header.Set("Accept", accept)
+	}
+	if ifNoneMatch != "" {
+		req.Header.Set("If-None-Match", ifNoneMatch)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	bs, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != expectHttpStatus {
+		t.Fatalf("got status %d for %s with If-None-Match %s, want %d", resp.StatusCode, path, ifNoneMatch, expectHttpStatus)
+	}
+	if resp.StatusCode == http.StatusNotModified && len(bs) > 0 {
+		t.Fatalf("got a body with %d, want none", resp.StatusCode)
+	}
+	if vary := resp.Header.Get("Vary"); vary != "Accept, X-Envoyds-Region" {
+		t.Fatalf("got Vary %q for %s, want %q", vary, path, "Accept, X-Envoyds-Region")
+	}
+	return resp.Header.Get("ETag")
+}
+
+func callToGetCatalog(t *testing.T, getResponse *envoyds.ServicesGetResponse, query string) {
+	resp, err := http.Get(fmt.Sprintf("http://%s:%d/v1/services?%s", TEST_HOST, TEST_HTTP_PORT, query))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("got status %d, want %d", resp.StatusCode, http.StatusOK)
+	}
+	if err := jsonpb.Unmarshal(resp.Body, getResponse); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func callToGetHealth(t *testing.T, healthResponse *envoyds.HealthResponse, path string, expectHttpStatus int) {
+	resp, err := http.Get(fmt.Sprintf("http://%s:%d%s", TEST_HOST, TEST_HTTP_PORT, path))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != expectHttpStatus {
+		t.Fatalf("got status %d for %s, want %d", resp.StatusCode, path, expectHttpStatus)
+	}
+	// health is never cached
+	if resp.Header.Get("Cache-Control") != "no-store" || resp.Header.Get("ETag") != "" {
+		t.Fatalf("got Cache-Control %q and ETag %q for %s, want no-store and no ETag", resp.Header.Get("Cache-Control"), resp.Header.Get("ETag"), path)
+	}
+	if err := jsonpb.Unmarshal(resp.Body, healthResponse); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func callToGet(t *testing.T, marshaler *jsonpb.Marshaler, getResponse *envoyds.ServiceGetResponse, testService string) {
+	resp, err := http.Get(fmt.Sprintf("http://%s:%d/v1/registration/%s", TEST_HOST, TEST_HTTP_PORT, testService))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if err := jsonpb.Unmarshal(resp.Body, getResponse); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func callToGetFromRegion(t *testing.T, getResponse *envoyds.ServiceGetResponse, testService string, region string) {
+	resp, err := http.Get(fmt.Sprintf("http://%s:%d/v1/registration/%s?caller_region=%s", TEST_HOST, TEST_HTTP_PORT, testService, region))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if err := jsonpb.Unmarshal(resp.Body, getResponse); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func callToGetFromRegionHeader(t *testing.T, getResponse *envoyds.ServiceGetResponse, testService string, region string) {
+	req, err := http.NewRequest(http.MethodGet, fmt.Sprintf("http://%s:%d/v1/registration/%s", TEST_HOST, TEST_HTTP_PORT, testService), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("X-Envoyds-Region", region)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if err := jsonpb.Unmarshal(resp.Body, getResponse); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func callToGetMatching(t *testing.T, getResponse *envoyds.ServiceGetResponse, testService string, query string, expectHttpStatus int) {
+	resp, err := http.Get(fmt.Sprintf("http://%s:%d/v1/registration/%s?%s", TEST_HOST, TEST_HTTP_PORT, testService, query))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != expectHttpStatus {
+		t.Fatal(resp.StatusCode)
+	}
+	if expectHttpStatus != http.StatusOK {
+		return
+	}
+	if err := jsonpb.Unmarshal(resp.Body, getResponse); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// callToGetAs gets path accepting accept, checks the content type of the
+// response and returns its body.
+func callToGetAs(t *testing.T, path string, accept string, expectContentType string, expectHttpStatus int) string {
+	req, err := http.NewRequest(http.MethodGet, fmt.Sprintf("http://%s:%d%s", TEST_HOST, TEST_HTTP_PORT, path), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if accept != "" {
+		req.Header.Set("Accept", accept)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	bs, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != expectHttpStatus {
+		t.Fatal(resp.StatusCode, string(bs))
+	}
+	if expectHttpStatus == http.StatusOK && resp.Header.Get("Content-Type") != expectContentType {
+		t.Fatalf("got content type %s, want %s", resp.Header.Get("Content-Type"), expectContentType)
+	}
+	return string(bs)
+}
+
+func callToGetRepo(t *testing.T, getResponse *envoyds.RepoGetResponse, testRepoName string) {
+	resp, err := http.Get(fmt.Sprintf("http://%s:%d/v1/registration/repo/%s", TEST_HOST, TEST_HTTP_PORT, testRepoName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if err := jsonpb.Unmarshal(resp.Body, getResponse); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func callToDelete(t *testing.T, testService string, ip string, port int, expectHttpStatus int) {
+	client := &http.Client{}
+	req, err := http.NewRequest(http.MethodDelete, fmt.Sprintf("http://%s:%d/v1/registration/%s/%s/%d", TEST_HOST, TEST_HTTP_PORT, testService, ip, port), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != expectHttpStatus {
+		t.Fatal(resp.StatusCode)
+	}
+}
+
+func callToUpdateWeight(t *testing.T, marshaler *jsonpb.Marshaler, testService string, ip string, port int, weight int32, expectHttpStatus int) {
+	var postRequest envoyds.ServiceUpdateLoadBalancingRequest
+	postRequest.LoadBalancingWeight = weight
+	v, err := marshaler.MarshalToString(&postRequest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reader := bytes.NewBufferString(v)
+	resp, err := http.Post(fmt.Sprintf("http://%s:%d/v1/loadbalancing/%s/%s/%d", TEST_HOST, TEST_HTTP_PORT, testService, ip, port), "application/json; charset=utf-8", reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != expectHttpStatus {
+		t.Fatal(resp.StatusCode)
+	}
+}
+
+// callToStream sends req, or acknowledges the last response if req was
+// already sent, and returns the next response.
+func callToStream(t *testing.T, stream xdsClientStream, req *discovery.DiscoveryRequest) *discovery.DiscoveryResponse {
+	if err := stream.Send(req); err != nil {
+		t.Fatal(err)
+	}
+	res, err := stream.Recv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.VersionInfo = res.VersionInfo
+	req.ResponseNonce = res.Nonce
+	return res
+}
+
+// callToStreamEndpoints returns the only assignment of the next response.
+func callToStreamEndpoints(t *testing.T, stream endpointservice.EndpointDiscoveryService_StreamEndpointsClient, req *discovery.DiscoveryRequest) *endpoint.ClusterLoadAssignment {
+	res := callToStream(t, stream, req)
+	if len(res.Resources) != 1 {
+		t.Fatalf("got %d resources, want %d resources", len(res.Resources), 1)
+	}
+	var assignment endpoint.ClusterLoadAssignment
+	if err := res.Resources[0].UnmarshalTo(&assignment); err != nil {
+		t.Fatal(err)
+	}
+	return &assignment
+}
+
+func callToFetchEndpoints(t *testing.T, testService string, node *core.Node) *endpoint.ClusterLoadAssignment {
+	conn, err := grpc.NewClient(fmt.Sprintf("%s:%d", TEST_HOST, TEST_XDS_PORT), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	res, err := endpointservice.NewEndpointDiscoveryServiceClient(conn).FetchEndpoints(context.Background(), &discovery.DiscoveryRequest{
+		Node:          node,
+		TypeUrl:       envoyds.XDS_ENDPOINT_TYPE_URL,
+		ResourceNames: []string{testService},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Resources) != 1 {
+		t.Fatalf("got %d resources, want %d resources", len(res.Resources), 1)
+	}
+	var assignment endpoint.ClusterLoadAssignment
+	if err = res.Resources[0].UnmarshalTo(&assignment); err != nil {
+		t.Fatal(err)
+	}
+	return &assignment
+}
+
+// lbEndpoints returns the endpoints of every locality of assignment.
+func lbEndpoints(assignment *endpoint.ClusterLoadAssignment) []*endpoint.LbEndpoint {
+	var endpoints []*endpoint.LbEndpoint
+	for _, locality := range assignment.Endpoints {
+		endpoints = append(endpoints, locality.LbEndpoints...)
+	}
+	return endpoints
+}
+
+// callToStreamClusters returns the clusters of the next response by name.
+func callToStreamClusters(t *testing.T, stream clusterservice.ClusterDiscoveryService_StreamClustersClient, req *discovery.DiscoveryRequest) map[string]*cluster.Cluster {
+	res := callToStream(t, stream, req)
+	clusters := make(map[string]*cluster.Cluster, len(res.Resources))
+	for _, resource := range res.Resources {
+		var c cluster.Cluster
+		if err := resource.UnmarshalTo(&c); err != nil {
+			t.Fatal(err)
+		}
+		clusters[c.Name] = &c
+	}
+	return clusters
+}
+
+func callToGetClusters(t *testing.T, getResponse *envoyds.ClustersGetResponse) {
+	resp, err := http.Get(fmt.Sprintf("http://%s:%d/v1/clusters/test_cluster/test_node", TEST_HOST, TEST_HTTP_PORT))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if err := jsonpb.Unmarshal(resp.Body, getResponse); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestServer(t *testing.T) {
+	ds, err := envoyds.NewEnvoyDS(envoyds.ReadConfig(TEST_CONFIG_PATH))
+	if err != nil {
+		t.Fatal(err)
+	}
+	testServer(t, envoyds.NewRouter(ds), envoyds.NewXDSServer(ds))
+}
+
+// TestHostTTLLimits checks that envoyds refuses to start with ttls outside
+// the limits a registration is kept within.
+func TestHostTTLLimits(t *testing.T) {
+	for _, ttls := range [][3]time.Duration{
+		{time.Minute, time.Second, time.Minute},
+		{time.Second, time.Minute, time.Hour},
+		{time.Minute, time.Hour, time.Second},
+		{0, time.Minute, time.Minute},
+	} {
+		c := envoyds.ReadConfig(TEST_CONFIG_PATH)
+		c.MinHostTTL.Duration, c.MaxHostTTL.Duration, c.HostTTL.Duration = ttls[0], ttls[1], ttls[2]
+		if _, err := envoyds.NewEnvoyDS(c); err == nil {
+			t.Fatalf("got no error for min %s, max %s and ttl %s, want an error", ttls[0], ttls[1], ttls[2])
+		}
+	}
+}
+
+// TestServerBolt runs the tests of TestServer against a bolt file of its own.
+func TestServerBolt(t *testing.T) {
+	c := envoyds.ReadConfig(TEST_CONFIG_PATH)
+	c.Storage = "bolt"
+	c.BoltPath = filepath.Join(t.TempDir(), "envoyds_test.db")
+	ds, err := envoyds.NewEnvoyDS(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testServer(t, envoyds.NewRouter(ds), envoyds.NewXDSServer(ds))
+}
+
+// TestServerRedis runs the tests of TestServer against an in-process Redis.
+func TestServerRedis(t *testing.T) {
+	r := miniredis.RunT(t)
+	c := envoyds.ReadConfig(TEST_CONFIG_PATH)
+	c.Storage = "redis"
+	c.RedisHost = r.Host()
+	c.RedisPort, _ = strconv.Atoi(r.Port())
+	ds, err := envoyds.NewEnvoyDS(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testServer(t, envoyds.NewRouter(ds), envoyds.NewXDSServer(ds))
+}
+
+// TestServerRedisV1Compat runs the tests of TestServer against an in-process
+// Redis shared with releases that only know the EYV1 layout.
+func TestServerRedisV1Compat(t *testing.T) {
+	r := miniredis.RunT(t)
+	c := envoyds.ReadConfig(TEST_CONFIG_PATH)
+	c.Storage = "redis"
+	c.RedisHost = r.Host()
+	c.RedisPort, _ = strconv.Atoi(r.Port())
+	c.RedisV1Compat = true
+	ds, err := envoyds.NewEnvoyDS(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testServer(t, envoyds.NewRouter(ds), envoyds.NewXDSServer(ds))
+}
+
+// TestWatchSharedRedis checks that instances sharing a Redis give the same
+// index for a service, so that a watch can move between them.
+func TestWatchSharedRedis(t *testing.T) {
+	r := miniredis.RunT(t)
+	c := envoyds.ReadConfig(TEST_CONFIG_PATH)
+	c.Storage = "redis"
+	c.RedisHost = r.Host()
+	c.RedisPort, _ = strconv.Atoi(r.Port())
+	ds, err := envoyds.NewEnvoyDS(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := envoyds.NewEnvoyDS(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer setUp(t, envoyds.NewRouter(ds), envoyds.NewXDSServer(ds))()
+	otherServer := httptest.NewServer(envoyds.NewRouter(other))
+	defer otherServer.Close()
+	watchOther := func(query string) uint64 {
+		resp, err := http.Get(fmt.Sprintf("%s/v1/registration/%s?%s", otherServer.URL, TEST_SERVICE_PREFIX, query))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		index, err := strconv.ParseUint(resp.Header.Get("X-Envoyds-Index"), 10, 64)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return index
+	}
+
+	postRequest := envoyds.ServicePostRequest{}
+	postRequest.Port = 33
+	postRequest.Ip = "123.123.123.180"
+	marshaler := jsonpb.Marshaler{EmitDefaults: true, OrigName: true}
+	callToRegister(t, &marshaler, &postRequest, TEST_SERVICE_PREFIX, http.StatusOK)
+	getResponse := envoyds.ServiceGetResponse{}
+	index := callToWatch(t, &getResponse, TEST_SERVICE_PREFIX, "", http.StatusOK)
+	if got := watchOther(""); got != index {
+		t.Fatalf("got index %d from the other instance, want %d", got, index)
+	}
+
+	// a change through one instance ends a watch on the other
+	deleted := make(chan error, 1)
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		req, err := http.NewRequest(http.MethodDelete, fmt.Sprintf("http://%s:%d/v1/registration/%s/%s/%d", TEST_HOST, TEST_HTTP_PORT, TEST_SERVICE_PREFIX, postRequest.Ip, postRequest.Port), nil)
+		if err == nil {
+			var resp *http.Response
+			if resp, err = http.DefaultClient.Do(req); err == nil {
+				resp.Body.Close()
+			}
+		}
+		deleted <- err
+	}()
+	start := time.Now()
+	changed := watchOther(fmt.Sprintf("index=%d&wait=10s", index))
+	if err := <-deleted; err != nil {
+		t.Fatal(err)
+	}
+	if changed != index+1 || time.Since(start) > 5*time.Second {
+		t.Fatalf("got index %d after %s, want %d", changed, time.Since(start), index+1)
+	}
+	if got := callToWatch(t, &getResponse, TEST_SERVICE_PREFIX, "", http.StatusOK); got != changed {
+		t.Fatalf("got index %d, want %d", got, changed)
+	}
+
+	// a feed resumes on the other instance from an event id of the first
+	events, closeEvents := callToStreamEventsOn(t, otherServer.URL, "", fmt.Sprintf("%s:%d", TEST_SERVICE_PREFIX, index), http.StatusOK)
+	defer closeEvents()
+	if event, want := expectServerSentEvent(t, events, "deleted"), fmt.Sprintf("%s:%d", TEST_SERVICE_PREFIX, changed); event.id != want {
+		t.Fatalf("got event %s, want %s", event.id, want)
+	}
+}
+
+func testServer(t *testing.T, router http.Handler, xdsServer *grpc.Server) {
 	testService := TEST_SERVICE_PREFIX + strconv.Itoa(int(time.Now().Unix()))
 	t.Log("test serviceName=" + testService)
-	setUp(t)
+	defer setUp(t, router, xdsServer)()
 	defer tearDown(t, testService)
 	testRegister(t, testService)
 	testDelete(t, testService)
+	testIPv6(t, testService)
 	testUpdate(t, testService)
+	testRepo(t, testService)
+	testTTL(t, testService)
+	testEDS(t, testService)
+	testLocalities(t, testService)
+	testFailover(t, testService)
+	testFilter(t, testService)
+	testLbSubset(t, testService)
+	testEncodings(t, testService)
+	testResponseFormats(t, testService)
+	testBulk(t, testService)
+	testPatch(t, testService)
+	testConcurrentUpdates(t, testService)
+	testWatch(t, testService)
+	testEvents(t, testService)
+	testETags(t, testService)
+	testCatalog(t, testService)
+	testHealth(t)
+	testClusters(t, testService)
+	testCDS(t, testService)
 }
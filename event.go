@@ -0,0 +1,98 @@
+package envoyds
+
+import (
+	"github.com/golang/protobuf/proto"
+	"log"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	EVENT_REGISTERED = "registered"
+	EVENT_UPDATED    = "updated"
+	EVENT_DELETED    = "deleted"
+	EVENT_EXPIRED    = "expired"
+	// EVENT_BUFFER_SIZE is how many events a subscriber may fall behind by.
+	EVENT_BUFFER_SIZE = 1024
+	// EXPIRY_SWEEP_PERIOD is how often storages look for expired hosts, and
+	// so how late an expired event may be.
+	EXPIRY_SWEEP_PERIOD = time.Second * 10
+)
+
+// eventHub hands the events of a storage to every subscriber. Publishing
+// never blocks: a subscriber that falls behind by more than its buffer is
+// unsubscribed and its channel closed, so it knows that it missed events.
+type eventHub struct {
+	lock        *sync.Mutex
+	subscribers map[chan *Event]bool
+}
+
+func newEventHub() *eventHub {
+	return &eventHub{lock: &sync.Mutex{}, subscribers: make(map[chan *Event]bool)}
+}
+
+func (h *eventHub) Publish(event *Event) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	for events := range h.subscribers {
+		select {
+		case events <- event:
+		default:
+			delete(h.subscribers, events)
+			close(events)
+		}
+	}
+}
+
+func (h *eventHub) Subscribe() chan *Event {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	events := make(chan *Event, EVENT_BUFFER_SIZE)
+	h.subscribers[events] = true
+	return events
+}
+
+func (h *eventHub) Unsubscribe(events chan *Event) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if h.subscribers[events] {
+		delete(h.subscribers, events)
+		close(events)
+	}
+}
+
+func newEvent(eventType string, host *Host) *Event {
+	return &Event{
+		Type: eventType,
+		Host: host,
+		Time: strconv.FormatInt(time.Now().UnixNano()/int64(time.Millisecond), 10),
+	}
+}
+
+// writeEventType returns the type of the event for writing host over old,
+// which is nil if the host was not registered. Writes that only check the
+// host in again are not events.
+func writeEventType(old, host *Host) string {
+	if old == nil {
+		return EVENT_REGISTERED
+	}
+	old, host = proto.Clone(old).(*Host), proto.Clone(host).(*Host)
+	old.LastCheckIn, host.LastCheckIn = "", ""
+	if proto.Equal(old, host) {
+		return ""
+	}
+	return EVENT_UPDATED
+}
+
+// logEvents writes every event of hub to the log, as an audit trail of the
+// registry.
+func logEvents(hub *eventHub) {
+	for {
+		for event := range hub.Subscribe() {
+			host := event.GetHost()
+			log.Printf("event type=%s service=%s ip=%s port=%d\n", event.Type, host.GetService(), host.GetIpAddress(), host.GetPort())
+		}
+		log.Println("event log fell behind, events were missed")
+	}
+}
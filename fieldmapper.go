@@ -3,7 +3,9 @@ package envoyds
 import (
 	"encoding/json"
 	"net/http"
+	"strconv"
 
+	"github.com/golang/protobuf/ptypes/wrappers"
 	"github.com/mholt/binding"
 )
 
@@ -13,9 +15,13 @@ func (r *ServicePostRequest) FieldMap(req *http.Request) binding.FieldMap {
 		&r.ServiceRepoName: "service_repo_name",
 		&r.Port:            "port",
 		&r.Revision:        "revision",
+		&r.Ttl:             "ttl",
 		&r.Tags: binding.Field{
 			Form: "tags",
 			Binder: func(fieldName string, formVals []string, errs binding.Errors) binding.Errors {
+				if len(formVals) == 0 {
+					return errs
+				}
 				if err := json.Unmarshal([]byte(formVals[0]), &r.Tags); err != nil {
 					errs.Add([]string{fieldName}, err.Error(), err.Error())
 				}
@@ -30,3 +36,57 @@ func (r *ServiceUpdateLoadBalancingRequest) FieldMap(req *http.Request) binding.
 		&r.LoadBalancingWeight: "load_balancing_weight",
 	}
 }
+
+func (r *ServicePatchRequest) FieldMap(req *http.Request) binding.FieldMap {
+	return binding.FieldMap{
+		&r.Revision:   stringValueField("revision", &r.Revision),
+		&r.Az:         stringValueField("az", &r.Az),
+		&r.Region:     stringValueField("region", &r.Region),
+		&r.InstanceId: stringValueField("instance_id", &r.InstanceId),
+		&r.Canary: binding.Field{
+			Form: "canary",
+			Binder: func(fieldName string, formVals []string, errs binding.Errors) binding.Errors {
+				if len(formVals) == 0 {
+					return errs
+				}
+				value, err := strconv.ParseBool(formVals[0])
+				if err != nil {
+					errs.Add([]string{fieldName}, err.Error(), err.Error())
+					return errs
+				}
+				r.Canary = &wrappers.BoolValue{Value: value}
+				return errs
+			},
+		},
+		&r.LoadBalancingWeight: binding.Field{
+			Form: "load_balancing_weight",
+			Binder: func(fieldName string, formVals []string, errs binding.Errors) binding.Errors {
+				if len(formVals) == 0 {
+					return errs
+				}
+				value, err := strconv.ParseInt(formVals[0], 10, 32)
+				if err != nil {
+					errs.Add([]string{fieldName}, err.Error(), err.Error())
+					return errs
+				}
+				r.LoadBalancingWeight = &wrappers.Int32Value{Value: int32(value)}
+				return errs
+			},
+		},
+	}
+}
+
+// stringValueField binds a form field to a StringValue, which stays nil when
+// the field is not sent.
+func stringValueField(name string, value **wrappers.StringValue) binding.Field {
+	return binding.Field{
+		Form: name,
+		Binder: func(fieldName string, formVals []string, errs binding.Errors) binding.Errors {
+			if len(formVals) == 0 {
+				return errs
+			}
+			*value = &wrappers.StringValue{Value: formVals[0]}
+			return errs
+		},
+	}
+}
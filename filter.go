@@ -0,0 +1,106 @@
+package envoyds
+
+import (
+	"fmt"
+	"net/url"
+	"strconv"
+)
+
+const (
+	FILTER_AZ       = "az"
+	FILTER_REGION   = "region"
+	FILTER_CANARY   = "canary"
+	FILTER_REVISION = "revision"
+	FILTER_EQUALS   = "="
+)
+
+// hostFilter selects the hosts of a service by the attributes the storages
+// index. Empty fields match every host.
+type hostFilter struct {
+	az       string
+	region   string
+	canary   string
+	revision string
+}
+
+// parseHostFilter reads a filter from query parameters of the same names as
+// the attributes. canary is either true or false.
+func parseHostFilter(query url.Values) (hostFilter, error) {
+	f := hostFilter{
+		az:       query.Get(FILTER_AZ),
+		region:   query.Get(FILTER_REGION),
+		canary:   query.Get(FILTER_CANARY),
+		revision: query.Get(FILTER_REVISION),
+	}
+	if f.canary != "" {
+		canary, err := strconv.ParseBool(f.canary)
+		if err != nil {
+			return f, fmt.Errorf("canary must be true or false, not %q", f.canary)
+		}
+		f.canary = strconv.FormatBool(canary)
+	}
+	return f, nil
+}
+
+// terms returns the index terms a host must have to match f, those that
+// usually match the fewest hosts first.
+func (f hostFilter) terms() []string {
+	var terms []string
+	if f.revision != "" {
+		terms = append(terms, FILTER_REVISION+FILTER_EQUALS+f.revision)
+	}
+	if f.az != "" {
+		terms = append(terms, FILTER_AZ+FILTER_EQUALS+f.az)
+	}
+	if f.region != "" {
+		terms = append(terms, FILTER_REGION+FILTER_EQUALS+f.region)
+	}
+	if f.canary != "" {
+		terms = append(terms, FILTER_CANARY+FILTER_EQUALS+f.canary)
+	}
+	return terms
+}
+
+// matches checks host itself against f, for readers of indexes that may hold
+// entries older than the host they point at.
+func (f hostFilter) matches(host *Host) bool {
+	hostTerms := make(map[string]bool)
+	for _, term := range indexTerms(host) {
+		hostTerms[term] = true
+	}
+	for _, term := range f.terms() {
+		if !hostTerms[term] {
+			return false
+		}
+	}
+	return true
+}
+
+// indexTerms returns the terms host is indexed under within its service, one
+// per filterable attribute, empty values included.
+func indexTerms(host *Host) []string {
+	return []string{
+		FILTER_AZ + FILTER_EQUALS + host.GetTags().GetAz(),
+		FILTER_REGION + FILTER_EQUALS + host.GetTags().GetRegion(),
+		FILTER_CANARY + FILTER_EQUALS + strconv.FormatBool(host.GetTags().GetCanary()),
+		FILTER_REVISION + FILTER_EQUALS + host.Revision,
+	}
+}
+
+// changedTerms returns the terms of old that host is no longer indexed under.
+func changedTerms(old, host *Host) []string {
+	if old == nil {
+		return nil
+	}
+	current := make(map[string]bool)
+	for _, term := range indexTerms(host) {
+		current[term] = true
+	}
+	var changed []string
+	for _, term := range indexTerms(old) {
+		if !current[term] {
+			changed = append(changed, term)
+		}
+	}
+	return changed
+}
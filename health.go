@@ -0,0 +1,85 @@
+package envoyds
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+const (
+	HEALTH_PASS = "pass"
+	HEALTH_WARN = "warn"
+	HEALTH_FAIL = "fail"
+	// READINESS_FAIL_CLOSED takes an instance out of service when its checks
+	// fail, READINESS_FAIL_OPEN keeps it in and only warns. Failing open suits
+	// storages shared by every instance, whose failure would otherwise take
+	// all of them out at once.
+	READINESS_FAIL_CLOSED = "fail_closed"
+	READINESS_FAIL_OPEN   = "fail_open"
+	READINESS_TIMEOUT     = time.Second
+)
+
+// healthCheck is a named check of a dependency of the instance.
+type healthCheck struct {
+	name  string
+	check func() error
+}
+
+func validateReadinessPolicy(policy string) error {
+	if policy != READINESS_FAIL_CLOSED && policy != READINESS_FAIL_OPEN {
+		return fmt.Errorf("unknown readiness policy %q, use %s or %s", policy, READINESS_FAIL_CLOSED, READINESS_FAIL_OPEN)
+	}
+	return nil
+}
+
+// runHealthChecks runs checks at the same time and returns their results in
+// order. A check that does not return within timeout fails, and is left to
+// finish on its own.
+func runHealthChecks(checks []healthCheck, timeout time.Duration) []*HealthCheck {
+	results := make([]*HealthCheck, len(checks))
+	var wg sync.WaitGroup
+	for i, check := range checks {
+		wg.Add(1)
+		go func(i int, check healthCheck) {
+			defer wg.Done()
+			results[i] = runHealthCheck(check, timeout)
+		}(i, check)
+	}
+	wg.Wait()
+	return results
+}
+
+func runHealthCheck(check healthCheck, timeout time.Duration) *HealthCheck {
+	result := &HealthCheck{Name: check.name, Status: HEALTH_PASS}
+	start := time.Now()
+	done := make(chan error, 1)
+	go func() {
+		done <- check.check()
+	}()
+	var err error
+	select {
+	case err = <-done:
+	case <-time.After(timeout):
+		err = fmt.Errorf("timed out after %s", timeout)
+	}
+	result.LatencyMs = float64(time.Since(start)) / float64(time.Millisecond)
+	if err != nil {
+		result.Status = HEALTH_FAIL
+		result.Error = err.Error()
+	}
+	return result
+}
+
+// healthStatus returns the status of an instance whose checks are results:
+// pass when they all pass, and otherwise fail or warn by policy.
+func healthStatus(results []*HealthCheck, policy string) string {
+	for _, result := range results {
+		if result.Status != HEALTH_PASS {
+			if policy == READINESS_FAIL_OPEN {
+				return HEALTH_WARN
+			}
+			return HEALTH_FAIL
+		}
+	}
+	return HEALTH_PASS
+}
@@ -0,0 +1,84 @@
+package envoyds
+
+import (
+	"fmt"
+	"google.golang.org/protobuf/types/known/structpb"
+	"sort"
+)
+
+const (
+	LB_SUBSET_FILTER = "envoy.lb"
+)
+
+// lbSubsetFields read the host attributes that may become subset keys. Empty
+// strings are left out, so that a host without the attribute is in no subset
+// of its key rather than in that of the empty value.
+var lbSubsetFields = map[string]func(host *Host) *structpb.Value{
+	"az": func(host *Host) *structpb.Value {
+		return stringValue(host.GetTags().GetAz())
+	},
+	"region": func(host *Host) *structpb.Value {
+		return stringValue(host.GetTags().GetRegion())
+	},
+	"instance_id": func(host *Host) *structpb.Value {
+		return stringValue(host.GetTags().GetInstanceId())
+	},
+	"canary": func(host *Host) *structpb.Value {
+		return structpb.NewBoolValue(host.GetTags().GetCanary())
+	},
+	"revision": func(host *Host) *structpb.Value {
+		return stringValue(host.Revision)
+	},
+}
+
+func validateLbSubsetKeys(keys map[string]string) error {
+	fields := make(map[string]string, len(keys))
+	for field, key := range keys {
+		if _, ok := lbSubsetFields[field]; !ok {
+			return fmt.Errorf("unknown lb subset field %q", field)
+		}
+		if key == "" {
+			return fmt.Errorf("lb subset field %q has no key", field)
+		}
+		if other, ok := fields[key]; ok {
+			return fmt.Errorf("lb subset fields %q and %q share key %q", other, field, key)
+		}
+		fields[key] = field
+	}
+	return nil
+}
+
+// lbSubsetMetadata returns the metadata of host under the filter names of
+// Envoy, with a subset key for each of its attributes mapped in keys, or nil
+// when it has none.
+func lbSubsetMetadata(host *Host, keys map[string]string) *structpb.Struct {
+	subset := &structpb.Struct{Fields: make(map[string]*structpb.Value, len(keys))}
+	for field, key := range keys {
+		if value := lbSubsetFields[field](host); value != nil {
+			subset.Fields[key] = value
+		}
+	}
+	if len(subset.Fields) == 0 {
+		return nil
+	}
+	return &structpb.Struct{Fields: map[string]*structpb.Value{
+		LB_SUBSET_FILTER: structpb.NewStructValue(subset),
+	}}
+}
+
+// lbSubsetKeyNames returns the names of the keys in keys, sorted.
+func lbSubsetKeyNames(keys map[string]string) []string {
+	names := make([]string, 0, len(keys))
+	for _, key := range keys {
+		names = append(names, key)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func stringValue(s string) *structpb.Value {
+	if s == "" {
+		return nil
+	}
+	return structpb.NewStringValue(s)
+}
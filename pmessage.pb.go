@@ -11,15 +11,35 @@ It is generated from these files:
 It has these top-level messages:
 	ServiceGetResponse
 	ServicePostRequest
+	BulkRegistrationRequest
+	BulkRegistration
+	BulkDeregistrationRequest
+	BulkDeregistration
+	BulkResponse
+	BulkResult
 	ServiceUpdateLoadBalancingRequest
+	ServicePatchRequest
 	Host
 	Tags
+	RepoGetResponse
+	ServicesGetResponse
+	ServiceSummary
+	AzCount
+	Event
+	HealthResponse
+	HealthCheck
+	ClustersGetResponse
+	Cluster
+	CircuitBreakers
+	CircuitBreakerThresholds
 */
 package envoyds
 
 import proto "github.com/golang/protobuf/proto"
 import fmt "fmt"
 import math "math"
+import google_protobuf "github.com/golang/protobuf/ptypes/struct"
+import google_protobuf1 "github.com/golang/protobuf/ptypes/wrappers"
 
 // Reference imports to suppress errors if they are not otherwise used.
 var _ = proto.Marshal
@@ -70,6 +90,9 @@ type ServicePostRequest struct {
 	Port            int32  `protobuf:"varint,3,opt,name=port" json:"port,omitempty"`
 	Revision        string `protobuf:"bytes,4,opt,name=revision" json:"revision,omitempty"`
 	Tags            *Tags  `protobuf:"bytes,5,opt,name=tags" json:"tags,omitempty"`
+	// Seconds the host stays registered without registering again, within
+	// the bounds set by the server. The server default applies when unset.
+	Ttl int32 `protobuf:"varint,6,opt,name=ttl" json:"ttl,omitempty"`
 }
 
 func (m *ServicePostRequest) Reset()                    { *m = ServicePostRequest{} }
@@ -112,6 +135,148 @@ func (m *ServicePostRequest) GetTags() *Tags {
 	return nil
 }
 
+func (m *ServicePostRequest) GetTtl() int32 {
+	if m != nil {
+		return m.Ttl
+	}
+	return 0
+}
+
+// BulkRegistrationRequest registers hosts of any services at once.
+type BulkRegistrationRequest struct {
+	Registrations []*BulkRegistration `protobuf:"bytes,1,rep,name=registrations" json:"registrations,omitempty"`
+}
+
+func (m *BulkRegistrationRequest) Reset()                    { *m = BulkRegistrationRequest{} }
+func (m *BulkRegistrationRequest) String() string            { return proto.CompactTextString(m) }
+func (*BulkRegistrationRequest) ProtoMessage()               {}
+func (*BulkRegistrationRequest) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{2} }
+
+func (m *BulkRegistrationRequest) GetRegistrations() []*BulkRegistration {
+	if m != nil {
+		return m.Registrations
+	}
+	return nil
+}
+
+type BulkRegistration struct {
+	Service string              `protobuf:"bytes,1,opt,name=service" json:"service,omitempty"`
+	Host    *ServicePostRequest `protobuf:"bytes,2,opt,name=host" json:"host,omitempty"`
+}
+
+func (m *BulkRegistration) Reset()                    { *m = BulkRegistration{} }
+func (m *BulkRegistration) String() string            { return proto.CompactTextString(m) }
+func (*BulkRegistration) ProtoMessage()               {}
+func (*BulkRegistration) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{3} }
+
+func (m *BulkRegistration) GetService() string {
+	if m != nil {
+		return m.Service
+	}
+	return ""
+}
+
+func (m *BulkRegistration) GetHost() *ServicePostRequest {
+	if m != nil {
+		return m.Host
+	}
+	return nil
+}
+
+// BulkDeregistrationRequest deletes hosts of any services at once.
+type BulkDeregistrationRequest struct {
+	Deregistrations []*BulkDeregistration `protobuf:"bytes,1,rep,name=deregistrations" json:"deregistrations,omitempty"`
+}
+
+func (m *BulkDeregistrationRequest) Reset()                    { *m = BulkDeregistrationRequest{} }
+func (m *BulkDeregistrationRequest) String() string            { return proto.CompactTextString(m) }
+func (*BulkDeregistrationRequest) ProtoMessage()               {}
+func (*BulkDeregistrationRequest) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{4} }
+
+func (m *BulkDeregistrationRequest) GetDeregistrations() []*BulkDeregistration {
+	if m != nil {
+		return m.Deregistrations
+	}
+	return nil
+}
+
+type BulkDeregistration struct {
+	Service string `protobuf:"bytes,1,opt,name=service" json:"service,omitempty"`
+	Ip      string `protobuf:"bytes,2,opt,name=ip" json:"ip,omitempty"`
+	Port    int32  `protobuf:"varint,3,opt,name=port" json:"port,omitempty"`
+}
+
+func (m *BulkDeregistration) Reset()                    { *m = BulkDeregistration{} }
+func (m *BulkDeregistration) String() string            { return proto.CompactTextString(m) }
+func (*BulkDeregistration) ProtoMessage()               {}
+func (*BulkDeregistration) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{5} }
+
+func (m *BulkDeregistration) GetService() string {
+	if m != nil {
+		return m.Service
+	}
+	return ""
+}
+
+func (m *BulkDeregistration) GetIp() string {
+	if m != nil {
+		return m.Ip
+	}
+	return ""
+}
+
+func (m *BulkDeregistration) GetPort() int32 {
+	if m != nil {
+		return m.Port
+	}
+	return 0
+}
+
+// BulkResponse holds the result of each item of a bulk request, in the order
+// of the items.
+type BulkResponse struct {
+	Results []*BulkResult `protobuf:"bytes,1,rep,name=results" json:"results,omitempty"`
+}
+
+func (m *BulkResponse) Reset()                    { *m = BulkResponse{} }
+func (m *BulkResponse) String() string            { return proto.CompactTextString(m) }
+func (*BulkResponse) ProtoMessage()               {}
+func (*BulkResponse) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{6} }
+
+func (m *BulkResponse) GetResults() []*BulkResult {
+	if m != nil {
+		return m.Results
+	}
+	return nil
+}
+
+// BulkResult is the HTTP status of an item: 200 when applied, 400 when
+// invalid, 404 when the host to delete is not registered and 500 when the
+// storage failed. The error message is set unless it was applied.
+type BulkResult struct {
+	Status int32  `protobuf:"varint,1,opt,name=status" json:"status,omitempty"`
+	Error  string `protobuf:"bytes,2,opt,name=error" json:"error,omitempty"`
+}
+
+func (m *BulkResult) Reset()                    { *m = BulkResult{} }
+func (m *BulkResult) String() string            { return proto.CompactTextString(m) }
+func (*BulkResult) ProtoMessage()               {}
+func (*BulkResult) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{7} }
+
+func (m *BulkResult) GetStatus() int32 {
+	if m != nil {
+		return m.Status
+	}
+	return 0
+}
+
+func (m *BulkResult) GetError() string {
+	if m != nil {
+		return m.Error
+	}
+	return ""
+}
+
 type ServiceUpdateLoadBalancingRequest struct {
 	LoadBalancingWeight int32 `protobuf:"varint,1,opt,name=load_balancing_weight,json=loadBalancingWeight" json:"load_balancing_weight,omitempty"`
 }
@@ -120,7 +285,7 @@ func (m *ServiceUpdateLoadBalancingRequest) Reset()         { *m = ServiceUpdate
 func (m *ServiceUpdateLoadBalancingRequest) String() string { return proto.CompactTextString(m) }
 func (*ServiceUpdateLoadBalancingRequest) ProtoMessage()    {}
 func (*ServiceUpdateLoadBalancingRequest) Descriptor() ([]byte, []int) {
-	return fileDescriptor0, []int{2}
+	return fileDescriptor0, []int{8}
 }
 
 func (m *ServiceUpdateLoadBalancingRequest) GetLoadBalancingWeight() int32 {
@@ -130,6 +295,64 @@ func (m *ServiceUpdateLoadBalancingRequest) GetLoadBalancingWeight() int32 {
 	return 0
 }
 
+// ServicePatchRequest changes the revision or tags of registered hosts.
+// Fields left unset keep their value.
+type ServicePatchRequest struct {
+	Revision            *google_protobuf1.StringValue `protobuf:"bytes,1,opt,name=revision" json:"revision,omitempty"`
+	Az                  *google_protobuf1.StringValue `protobuf:"bytes,2,opt,name=az" json:"az,omitempty"`
+	Region              *google_protobuf1.StringValue `protobuf:"bytes,3,opt,name=region" json:"region,omitempty"`
+	InstanceId          *google_protobuf1.StringValue `protobuf:"bytes,4,opt,name=instance_id,json=instanceId" json:"instance_id,omitempty"`
+	Canary              *google_protobuf1.BoolValue   `protobuf:"bytes,5,opt,name=canary" json:"canary,omitempty"`
+	LoadBalancingWeight *google_protobuf1.Int32Value  `protobuf:"bytes,6,opt,name=load_balancing_weight,json=loadBalancingWeight" json:"load_balancing_weight,omitempty"`
+}
+
+func (m *ServicePatchRequest) Reset()                    { *m = ServicePatchRequest{} }
+func (m *ServicePatchRequest) String() string            { return proto.CompactTextString(m) }
+func (*ServicePatchRequest) ProtoMessage()               {}
+func (*ServicePatchRequest) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{9} }
+
+func (m *ServicePatchRequest) GetRevision() *google_protobuf1.StringValue {
+	if m != nil {
+		return m.Revision
+	}
+	return nil
+}
+
+func (m *ServicePatchRequest) GetAz() *google_protobuf1.StringValue {
+	if m != nil {
+		return m.Az
+	}
+	return nil
+}
+
+func (m *ServicePatchRequest) GetRegion() *google_protobuf1.StringValue {
+	if m != nil {
+		return m.Region
+	}
+	return nil
+}
+
+func (m *ServicePatchRequest) GetInstanceId() *google_protobuf1.StringValue {
+	if m != nil {
+		return m.InstanceId
+	}
+	return nil
+}
+
+func (m *ServicePatchRequest) GetCanary() *google_protobuf1.BoolValue {
+	if m != nil {
+		return m.Canary
+	}
+	return nil
+}
+
+func (m *ServicePatchRequest) GetLoadBalancingWeight() *google_protobuf1.Int32Value {
+	if m != nil {
+		return m.LoadBalancingWeight
+	}
+	return nil
+}
+
 type Host struct {
 	IpAddress       string `protobuf:"bytes,1,opt,name=ip_address,json=ipAddress" json:"ip_address,omitempty"`
 	LastCheckIn     string `protobuf:"bytes,2,opt,name=last_check_in,json=lastCheckIn" json:"last_check_in,omitempty"`
@@ -138,12 +361,20 @@ type Host struct {
 	Service         string `protobuf:"bytes,5,opt,name=service" json:"service,omitempty"`
 	ServiceRepoName string `protobuf:"bytes,6,opt,name=service_repo_name,json=serviceRepoName" json:"service_repo_name,omitempty"`
 	Tags            *Tags  `protobuf:"bytes,7,opt,name=tags" json:"tags,omitempty"`
+	// Seconds the host stays registered without registering again.
+	Ttl int32 `protobuf:"varint,8,opt,name=ttl" json:"ttl,omitempty"`
+	// Failover priority of the host for the region of the caller, from 0 for
+	// the most preferred. Only set in responses that name a region.
+	Priority int32 `protobuf:"varint,9,opt,name=priority" json:"priority,omitempty"`
+	// Metadata of the host for Envoy, keyed by filter like Envoy's endpoint
+	// metadata: envoy.lb holds the subset load balancing keys of the host.
+	Metadata *google_protobuf.Struct `protobuf:"bytes,10,opt,name=metadata" json:"metadata,omitempty"`
 }
 
 func (m *Host) Reset()                    { *m = Host{} }
 func (m *Host) String() string            { return proto.CompactTextString(m) }
 func (*Host) ProtoMessage()               {}
-func (*Host) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{3} }
+func (*Host) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{10} }
 
 func (m *Host) GetIpAddress() string {
 	if m != nil {
@@ -194,6 +425,27 @@ func (m *Host) GetTags() *Tags {
 	return nil
 }
 
+func (m *Host) GetTtl() int32 {
+	if m != nil {
+		return m.Ttl
+	}
+	return 0
+}
+
+func (m *Host) GetPriority() int32 {
+	if m != nil {
+		return m.Priority
+	}
+	return 0
+}
+
+func (m *Host) GetMetadata() *google_protobuf.Struct {
+	if m != nil {
+		return m.Metadata
+	}
+	return nil
+}
+
 type Tags struct {
 	Az                  string `protobuf:"bytes,1,opt,name=az" json:"az,omitempty"`
 	Region              string `protobuf:"bytes,2,opt,name=region" json:"region,omitempty"`
@@ -205,7 +457,7 @@ type Tags struct {
 func (m *Tags) Reset()                    { *m = Tags{} }
 func (m *Tags) String() string            { return proto.CompactTextString(m) }
 func (*Tags) ProtoMessage()               {}
-func (*Tags) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{4} }
+func (*Tags) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{11} }
 
 func (m *Tags) GetAz() string {
 	if m != nil {
@@ -242,42 +494,504 @@ func (m *Tags) GetLoadBalancingWeight() int32 {
 	return 0
 }
 
+type RepoGetResponse struct {
+	Env             string                `protobuf:"bytes,1,opt,name=env" json:"env,omitempty"`
+	ServiceRepoName string                `protobuf:"bytes,2,opt,name=service_repo_name,json=serviceRepoName" json:"service_repo_name,omitempty"`
+	Hosts           []*Host               `protobuf:"bytes,3,rep,name=hosts" json:"hosts,omitempty"`
+	Services        []*ServiceGetResponse `protobuf:"bytes,4,rep,name=services" json:"services,omitempty"`
+}
+
+func (m *RepoGetResponse) Reset()                    { *m = RepoGetResponse{} }
+func (m *RepoGetResponse) String() string            { return proto.CompactTextString(m) }
+func (*RepoGetResponse) ProtoMessage()               {}
+func (*RepoGetResponse) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{12} }
+
+func (m *RepoGetResponse) GetEnv() string {
+	if m != nil {
+		return m.Env
+	}
+	return ""
+}
+
+func (m *RepoGetResponse) GetServiceRepoName() string {
+	if m != nil {
+		return m.ServiceRepoName
+	}
+	return ""
+}
+
+func (m *RepoGetResponse) GetHosts() []*Host {
+	if m != nil {
+		return m.Hosts
+	}
+	return nil
+}
+
+func (m *RepoGetResponse) GetServices() []*ServiceGetResponse {
+	if m != nil {
+		return m.Services
+	}
+	return nil
+}
+
+// ServicesGetResponse lists the services with registered hosts, in order.
+type ServicesGetResponse struct {
+	Env      string            `protobuf:"bytes,1,opt,name=env" json:"env,omitempty"`
+	Services []*ServiceSummary `protobuf:"bytes,2,rep,name=services" json:"services,omitempty"`
+}
+
+func (m *ServicesGetResponse) Reset()                    { *m = ServicesGetResponse{} }
+func (m *ServicesGetResponse) String() string            { return proto.CompactTextString(m) }
+func (*ServicesGetResponse) ProtoMessage()               {}
+func (*ServicesGetResponse) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{13} }
+
+func (m *ServicesGetResponse) GetEnv() string {
+	if m != nil {
+		return m.Env
+	}
+	return ""
+}
+
+func (m *ServicesGetResponse) GetServices() []*ServiceSummary {
+	if m != nil {
+		return m.Services
+	}
+	return nil
+}
+
+// ServiceSummary describes the hosts registered for a service.
+type ServiceSummary struct {
+	Service string `protobuf:"bytes,1,opt,name=service" json:"service,omitempty"`
+	Hosts   int32  `protobuf:"varint,2,opt,name=hosts" json:"hosts,omitempty"`
+	// Hosts per az, in order of az. Hosts without an az are counted under an
+	// empty one.
+	Azs []*AzCount `protobuf:"bytes,3,rep,name=azs" json:"azs,omitempty"`
+	// Revisions of the hosts, in order.
+	Revisions []string `protobuf:"bytes,4,rep,name=revisions" json:"revisions,omitempty"`
+	// Check in times of the hosts that checked in the longest and the
+	// shortest time ago, like Host.last_check_in.
+	OldestCheckIn string `protobuf:"bytes,5,opt,name=oldest_check_in,json=oldestCheckIn" json:"oldest_check_in,omitempty"`
+	NewestCheckIn string `protobuf:"bytes,6,opt,name=newest_check_in,json=newestCheckIn" json:"newest_check_in,omitempty"`
+}
+
+func (m *ServiceSummary) Reset()                    { *m = ServiceSummary{} }
+func (m *ServiceSummary) String() string            { return proto.CompactTextString(m) }
+func (*ServiceSummary) ProtoMessage()               {}
+func (*ServiceSummary) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{14} }
+
+func (m *ServiceSummary) GetService() string {
+	if m != nil {
+		return m.Service
+	}
+	return ""
+}
+
+func (m *ServiceSummary) GetHosts() int32 {
+	if m != nil {
+		return m.Hosts
+	}
+	return 0
+}
+
+func (m *ServiceSummary) GetAzs() []*AzCount {
+	if m != nil {
+		return m.Azs
+	}
+	return nil
+}
+
+func (m *ServiceSummary) GetRevisions() []string {
+	if m != nil {
+		return m.Revisions
+	}
+	return nil
+}
+
+func (m *ServiceSummary) GetOldestCheckIn() string {
+	if m != nil {
+		return m.OldestCheckIn
+	}
+	return ""
+}
+
+func (m *ServiceSummary) GetNewestCheckIn() string {
+	if m != nil {
+		return m.NewestCheckIn
+	}
+	return ""
+}
+
+type AzCount struct {
+	Az    string `protobuf:"bytes,1,opt,name=az" json:"az,omitempty"`
+	Hosts int32  `protobuf:"varint,2,opt,name=hosts" json:"hosts,omitempty"`
+}
+
+func (m *AzCount) Reset()                    { *m = AzCount{} }
+func (m *AzCount) String() string            { return proto.CompactTextString(m) }
+func (*AzCount) ProtoMessage()               {}
+func (*AzCount) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{15} }
+
+func (m *AzCount) GetAz() string {
+	if m != nil {
+		return m.Az
+	}
+	return ""
+}
+
+func (m *AzCount) GetHosts() int32 {
+	if m != nil {
+		return m.Hosts
+	}
+	return 0
+}
+
+// Event records a change to the registry: a host registered, updated,
+// deleted or expired without deregistering.
+type Event struct {
+	Type string `protobuf:"bytes,1,opt,name=type" json:"type,omitempty"`
+	Host *Host  `protobuf:"bytes,2,opt,name=host" json:"host,omitempty"`
+	// Milliseconds since the epoch, like Host.last_check_in.
+	Time string `protobuf:"bytes,3,opt,name=time" json:"time,omitempty"`
+	// The count of changes to the service of the host in the storage, this
+	// one included, which instances sharing the storage agree on.
+	Index uint64 `protobuf:"varint,4,opt,name=index" json:"index,omitempty"`
+}
+
+func (m *Event) Reset()                    { *m = Event{} }
+func (m *Event) String() string            { return proto.CompactTextString(m) }
+func (*Event) ProtoMessage()               {}
+func (*Event) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{16} }
+
+func (m *Event) GetType() string {
+	if m != nil {
+		return m.Type
+	}
+	return ""
+}
+
+func (m *Event) GetHost() *Host {
+	if m != nil {
+		return m.Host
+	}
+	return nil
+}
+
+func (m *Event) GetTime() string {
+	if m != nil {
+		return m.Time
+	}
+	return ""
+}
+
+func (m *Event) GetIndex() uint64 {
+	if m != nil {
+		return m.Index
+	}
+	return 0
+}
+
+// HealthResponse is the status of an instance, pass, warn or fail, and of
+// each of the checks it is derived from.
+type HealthResponse struct {
+	Status string         `protobuf:"bytes,1,opt,name=status" json:"status,omitempty"`
+	Checks []*HealthCheck `protobuf:"bytes,2,rep,name=checks" json:"checks,omitempty"`
+}
+
+func (m *HealthResponse) Reset()                    { *m = HealthResponse{} }
+func (m *HealthResponse) String() string            { return proto.CompactTextString(m) }
+func (*HealthResponse) ProtoMessage()               {}
+func (*HealthResponse) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{17} }
+
+func (m *HealthResponse) GetStatus() string {
+	if m != nil {
+		return m.Status
+	}
+	return ""
+}
+
+func (m *HealthResponse) GetChecks() []*HealthCheck {
+	if m != nil {
+		return m.Checks
+	}
+	return nil
+}
+
+type HealthCheck struct {
+	Name      string  `protobuf:"bytes,1,opt,name=name" json:"name,omitempty"`
+	Status    string  `protobuf:"bytes,2,opt,name=status" json:"status,omitempty"`
+	LatencyMs float64 `protobuf:"fixed64,3,opt,name=latency_ms,json=latencyMs" json:"latency_ms,omitempty"`
+	Error     string  `protobuf:"bytes,4,opt,name=error" json:"error,omitempty"`
+}
+
+func (m *HealthCheck) Reset()                    { *m = HealthCheck{} }
+func (m *HealthCheck) String() string            { return proto.CompactTextString(m) }
+func (*HealthCheck) ProtoMessage()               {}
+func (*HealthCheck) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{18} }
+
+func (m *HealthCheck) GetName() string {
+	if m != nil {
+		return m.Name
+	}
+	return ""
+}
+
+func (m *HealthCheck) GetStatus() string {
+	if m != nil {
+		return m.Status
+	}
+	return ""
+}
+
+func (m *HealthCheck) GetLatencyMs() float64 {
+	if m != nil {
+		return m.LatencyMs
+	}
+	return 0
+}
+
+func (m *HealthCheck) GetError() string {
+	if m != nil {
+		return m.Error
+	}
+	return ""
+}
+
+type ClustersGetResponse struct {
+	Clusters []*Cluster `protobuf:"bytes,1,rep,name=clusters" json:"clusters,omitempty"`
+}
+
+func (m *ClustersGetResponse) Reset()                    { *m = ClustersGetResponse{} }
+func (m *ClustersGetResponse) String() string            { return proto.CompactTextString(m) }
+func (*ClustersGetResponse) ProtoMessage()               {}
+func (*ClustersGetResponse) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{19} }
+
+func (m *ClustersGetResponse) GetClusters() []*Cluster {
+	if m != nil {
+		return m.Clusters
+	}
+	return nil
+}
+
+// Cluster is an Envoy v1 cluster whose hosts are read from the registration
+// of service_name.
+type Cluster struct {
+	Name             string           `protobuf:"bytes,1,opt,name=name" json:"name,omitempty"`
+	Type             string           `protobuf:"bytes,2,opt,name=type" json:"type,omitempty"`
+	ConnectTimeoutMs int32            `protobuf:"varint,3,opt,name=connect_timeout_ms,json=connectTimeoutMs" json:"connect_timeout_ms,omitempty"`
+	LbType           string           `protobuf:"bytes,4,opt,name=lb_type,json=lbType" json:"lb_type,omitempty"`
+	ServiceName      string           `protobuf:"bytes,5,opt,name=service_name,json=serviceName" json:"service_name,omitempty"`
+	CircuitBreakers  *CircuitBreakers `protobuf:"bytes,6,opt,name=circuit_breakers,json=circuitBreakers" json:"circuit_breakers,omitempty"`
+}
+
+func (m *Cluster) Reset()                    { *m = Cluster{} }
+func (m *Cluster) String() string            { return proto.CompactTextString(m) }
+func (*Cluster) ProtoMessage()               {}
+func (*Cluster) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{20} }
+
+func (m *Cluster) GetName() string {
+	if m != nil {
+		return m.Name
+	}
+	return ""
+}
+
+func (m *Cluster) GetType() string {
+	if m != nil {
+		return m.Type
+	}
+	return ""
+}
+
+func (m *Cluster) GetConnectTimeoutMs() int32 {
+	if m != nil {
+		return m.ConnectTimeoutMs
+	}
+	return 0
+}
+
+func (m *Cluster) GetLbType() string {
+	if m != nil {
+		return m.LbType
+	}
+	return ""
+}
+
+func (m *Cluster) GetServiceName() string {
+	if m != nil {
+		return m.ServiceName
+	}
+	return ""
+}
+
+func (m *Cluster) GetCircuitBreakers() *CircuitBreakers {
+	if m != nil {
+		return m.CircuitBreakers
+	}
+	return nil
+}
+
+type CircuitBreakers struct {
+	Default *CircuitBreakerThresholds `protobuf:"bytes,1,opt,name=default" json:"default,omitempty"`
+}
+
+func (m *CircuitBreakers) Reset()                    { *m = CircuitBreakers{} }
+func (m *CircuitBreakers) String() string            { return proto.CompactTextString(m) }
+func (*CircuitBreakers) ProtoMessage()               {}
+func (*CircuitBreakers) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{21} }
+
+func (m *CircuitBreakers) GetDefault() *CircuitBreakerThresholds {
+	if m != nil {
+		return m.Default
+	}
+	return nil
+}
+
+// CircuitBreakerThresholds left at 0 are Envoy's defaults.
+type CircuitBreakerThresholds struct {
+	MaxConnections     uint32 `protobuf:"varint,1,opt,name=max_connections,json=maxConnections" json:"max_connections,omitempty"`
+	MaxPendingRequests uint32 `protobuf:"varint,2,opt,name=max_pending_requests,json=maxPendingRequests" json:"max_pending_requests,omitempty"`
+	MaxRequests        uint32 `protobuf:"varint,3,opt,name=max_requests,json=maxRequests" json:"max_requests,omitempty"`
+	MaxRetries         uint32 `protobuf:"varint,4,opt,name=max_retries,json=maxRetries" json:"max_retries,omitempty"`
+}
+
+func (m *CircuitBreakerThresholds) Reset()                    { *m = CircuitBreakerThresholds{} }
+func (m *CircuitBreakerThresholds) String() string            { return proto.CompactTextString(m) }
+func (*CircuitBreakerThresholds) ProtoMessage()               {}
+func (*CircuitBreakerThresholds) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{22} }
+
+func (m *CircuitBreakerThresholds) GetMaxConnections() uint32 {
+	if m != nil {
+		return m.MaxConnections
+	}
+	return 0
+}
+
+func (m *CircuitBreakerThresholds) GetMaxPendingRequests() uint32 {
+	if m != nil {
+		return m.MaxPendingRequests
+	}
+	return 0
+}
+
+func (m *CircuitBreakerThresholds) GetMaxRequests() uint32 {
+	if m != nil {
+		return m.MaxRequests
+	}
+	return 0
+}
+
+func (m *CircuitBreakerThresholds) GetMaxRetries() uint32 {
+	if m != nil {
+		return m.MaxRetries
+	}
+	return 0
+}
+
 func init() {
 	proto.RegisterType((*ServiceGetResponse)(nil), "envoyds.ServiceGetResponse")
 	proto.RegisterType((*ServicePostRequest)(nil), "envoyds.ServicePostRequest")
+	proto.RegisterType((*BulkRegistrationRequest)(nil), "envoyds.BulkRegistrationRequest")
+	proto.RegisterType((*BulkRegistration)(nil), "envoyds.BulkRegistration")
+	proto.RegisterType((*BulkDeregistrationRequest)(nil), "envoyds.BulkDeregistrationRequest")
+	proto.RegisterType((*BulkDeregistration)(nil), "envoyds.BulkDeregistration")
+	proto.RegisterType((*BulkResponse)(nil), "envoyds.BulkResponse")
+	proto.RegisterType((*BulkResult)(nil), "envoyds.BulkResult")
 	proto.RegisterType((*ServiceUpdateLoadBalancingRequest)(nil), "envoyds.ServiceUpdateLoadBalancingRequest")
+	proto.RegisterType((*ServicePatchRequest)(nil), "envoyds.ServicePatchRequest")
 	proto.RegisterType((*Host)(nil), "envoyds.Host")
 	proto.RegisterType((*Tags)(nil), "envoyds.Tags")
+	proto.RegisterType((*RepoGetResponse)(nil), "envoyds.RepoGetResponse")
+	proto.RegisterType((*ServicesGetResponse)(nil), "envoyds.ServicesGetResponse")
+	proto.RegisterType((*ServiceSummary)(nil), "envoyds.ServiceSummary")
+	proto.RegisterType((*AzCount)(nil), "envoyds.AzCount")
+	proto.RegisterType((*Event)(nil), "envoyds.Event")
+	proto.RegisterType((*HealthResponse)(nil), "envoyds.HealthResponse")
+	proto.RegisterType((*HealthCheck)(nil), "envoyds.HealthCheck")
+	proto.RegisterType((*ClustersGetResponse)(nil), "envoyds.ClustersGetResponse")
+	proto.RegisterType((*Cluster)(nil), "envoyds.Cluster")
+	proto.RegisterType((*CircuitBreakers)(nil), "envoyds.CircuitBreakers")
+	proto.RegisterType((*CircuitBreakerThresholds)(nil), "envoyds.CircuitBreakerThresholds")
 }
 
 func init() { proto.RegisterFile("pmessage.proto", fileDescriptor0) }
 
 var fileDescriptor0 = []byte{
-	// 407 bytes of a gzipped FileDescriptorProto
-	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0x94, 0x52, 0xc1, 0x6e, 0x13, 0x31,
-	0x10, 0xd5, 0x26, 0xbb, 0x49, 0x3b, 0x51, 0x0b, 0x18, 0x81, 0x56, 0x48, 0x88, 0x74, 0xb9, 0x54,
-	0x1c, 0x72, 0x28, 0x5f, 0x00, 0x1c, 0xa0, 0x12, 0x42, 0x68, 0x01, 0xf5, 0x68, 0x4d, 0xd7, 0xa3,
-	0x8d, 0x45, 0x62, 0x1b, 0x8f, 0x09, 0x6a, 0x7f, 0x85, 0x23, 0x7f, 0xc6, 0x97, 0x20, 0x7b, 0xbd,
-	0x55, 0x2b, 0x35, 0x07, 0x6e, 0x7e, 0xf3, 0xf4, 0xec, 0x79, 0xef, 0x19, 0x8e, 0xdd, 0x96, 0x98,
-	0xb1, 0xa7, 0x95, 0xf3, 0x36, 0x58, 0x31, 0x27, 0xb3, 0xb3, 0x57, 0x8a, 0x1b, 0x02, 0xf1, 0x85,
-	0xfc, 0x4e, 0x77, 0xf4, 0x9e, 0x42, 0x4b, 0xec, 0xac, 0x61, 0x12, 0x0f, 0x61, 0x4a, 0x66, 0x57,
-	0x17, 0xcb, 0xe2, 0xf4, 0xb0, 0x8d, 0x47, 0xf1, 0x12, 0xaa, 0xb5, 0xe5, 0xc0, 0xf5, 0x64, 0x39,
-	0x3d, 0x5d, 0x9c, 0x1d, 0xad, 0xf2, 0x05, 0xab, 0x0f, 0x96, 0x43, 0x3b, 0x70, 0xa2, 0x86, 0x39,
-	0x0f, 0x97, 0xd5, 0xd3, 0x24, 0x1d, 0x61, 0xf3, 0xa7, 0xb8, 0x79, 0xe7, 0x73, 0x14, 0xd0, 0x8f,
-	0x9f, 0xc4, 0x41, 0x1c, 0xc3, 0x44, 0xbb, 0xfc, 0xcc, 0x44, 0x3b, 0xf1, 0x0a, 0x1e, 0x65, 0x85,
-	0xf4, 0xe4, 0xac, 0x34, 0xb8, 0xa5, 0x7a, 0x92, 0xe8, 0x07, 0x99, 0x68, 0xc9, 0xd9, 0x4f, 0xb8,
-	0x25, 0x21, 0xa0, 0x74, 0xd6, 0x87, 0xf4, 0x52, 0xd5, 0xa6, 0xb3, 0x78, 0x06, 0x07, 0x9e, 0x76,
-	0x9a, 0xb5, 0x35, 0x75, 0x99, 0x64, 0x37, 0x58, 0x9c, 0x40, 0x19, 0xb0, 0xe7, 0xba, 0x5a, 0x16,
-	0x77, 0x0c, 0x7c, 0xc5, 0x9e, 0xdb, 0x44, 0x35, 0x17, 0x70, 0x92, 0x97, 0xfc, 0xe6, 0x14, 0x06,
-	0xfa, 0x68, 0x51, 0xbd, 0xc5, 0x0d, 0x9a, 0x4e, 0x9b, 0x7e, 0xdc, 0xf9, 0x0c, 0x9e, 0x6c, 0x2c,
-	0x2a, 0x79, 0x39, 0x12, 0xf2, 0x17, 0xe9, 0x7e, 0x1d, 0x92, 0x8d, 0xaa, 0x7d, 0xbc, 0xb9, 0x2d,
-	0xba, 0x48, 0x54, 0xf3, 0xb7, 0x80, 0x32, 0x06, 0x25, 0x9e, 0x03, 0x68, 0x27, 0x51, 0x29, 0x4f,
-	0xcc, 0xd9, 0xf8, 0xa1, 0x76, 0x6f, 0x86, 0x81, 0x68, 0xe0, 0x68, 0x83, 0x1c, 0x64, 0xb7, 0xa6,
-	0xee, 0xbb, 0xd4, 0x26, 0x7b, 0x5f, 0xc4, 0xe1, 0xbb, 0x38, 0x3b, 0x37, 0xff, 0xed, 0xfb, 0x56,
-	0x29, 0xd5, 0x9d, 0x52, 0xee, 0x4f, 0x7b, 0x76, 0x7f, 0xda, 0x63, 0x7a, 0xf3, 0xfd, 0xe9, 0xfd,
-	0x2e, 0xa0, 0x8c, 0x30, 0xb6, 0x8a, 0xd7, 0x63, 0xab, 0x78, 0x2d, 0x9e, 0xc2, 0xcc, 0x53, 0x1f,
-	0x77, 0x1b, 0xec, 0x64, 0x24, 0x5e, 0xc0, 0x42, 0x1b, 0x0e, 0x68, 0x3a, 0x92, 0x5a, 0xe5, 0x2f,
-	0x03, 0xe3, 0xe8, 0x5c, 0x45, 0x61, 0x87, 0x06, 0xfd, 0x55, 0x32, 0x75, 0xd0, 0x66, 0xb4, 0xbf,
-	0x82, 0x6a, 0x6f, 0x05, 0x97, 0xb3, 0xf4, 0xf1, 0x5f, 0xff, 0x0b, 0x00, 0x00, 0xff, 0xff, 0x34,
-	0xb4, 0x03, 0xf7, 0x0a, 0x03, 0x00, 0x00,
+	// 1227 bytes of a gzipped FileDescriptorProto
+	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0x94, 0x56, 0xdb, 0x6e, 0xdc, 0xc4,
+	0x1b, 0x97, 0xf7, 0x98, 0xfd, 0xb6, 0x9b, 0xcd, 0x7f, 0x92, 0x7f, 0xe3, 0xa6, 0x2d, 0x6d, 0x8d,
+	0x54, 0x2a, 0x14, 0x12, 0x94, 0x20, 0x81, 0x40, 0x15, 0x6a, 0x42, 0x45, 0x2b, 0xd1, 0x52, 0x4d,
+	0x43, 0x2b, 0x21, 0x90, 0x35, 0x6b, 0x4f, 0x77, 0xad, 0xda, 0x33, 0x66, 0x66, 0x9c, 0x26, 0x79,
+	0x15, 0x9e, 0x81, 0x4b, 0x2e, 0x78, 0x00, 0x5e, 0x80, 0x27, 0xe0, 0x2d, 0xb8, 0x45, 0x73, 0xb0,
+	0x63, 0xef, 0x6e, 0x42, 0x7a, 0xe7, 0xf9, 0xbe, 0xdf, 0x77, 0x3e, 0x19, 0x56, 0xf3, 0x8c, 0x4a,
+	0x49, 0xa6, 0x74, 0x27, 0x17, 0x5c, 0x71, 0xd4, 0xa7, 0xec, 0x98, 0x9f, 0xc6, 0x72, 0xeb, 0xd6,
+	0x94, 0xf3, 0x69, 0x4a, 0x77, 0x0d, 0x79, 0x52, 0xbc, 0xd9, 0x95, 0x4a, 0x14, 0x91, 0xb2, 0xb0,
+	0xad, 0x0f, 0xe6, 0xb9, 0xef, 0x04, 0xc9, 0x73, 0x2a, 0xa4, 0xe5, 0x07, 0x14, 0xd0, 0x4b, 0x2a,
+	0x8e, 0x93, 0x88, 0x7e, 0x4b, 0x15, 0xa6, 0x32, 0xe7, 0x4c, 0x52, 0xb4, 0x06, 0x6d, 0xca, 0x8e,
+	0x7d, 0xef, 0xae, 0xf7, 0x60, 0x80, 0xf5, 0x27, 0xfa, 0x10, 0xba, 0x33, 0x2e, 0x95, 0xf4, 0x5b,
+	0x77, 0xdb, 0x0f, 0x86, 0x7b, 0xa3, 0x1d, 0x67, 0x7e, 0xe7, 0x09, 0x97, 0x0a, 0x5b, 0x1e, 0xf2,
+	0xa1, 0x2f, 0xad, 0x32, 0xbf, 0x6d, 0x44, 0xcb, 0x67, 0xf0, 0xbb, 0x57, 0xd9, 0x79, 0xa1, 0x05,
+	0xe8, 0x2f, 0x05, 0x95, 0x0a, 0xad, 0x42, 0x2b, 0xc9, 0x9d, 0x99, 0x56, 0x92, 0xa3, 0x8f, 0xe1,
+	0x7f, 0x4e, 0x22, 0x14, 0x34, 0xe7, 0x21, 0x23, 0x19, 0xf5, 0x5b, 0x86, 0x3d, 0x76, 0x0c, 0x4c,
+	0x73, 0xfe, 0x9c, 0x64, 0x14, 0x21, 0xe8, 0xe4, 0x5c, 0x28, 0x63, 0xa9, 0x8b, 0xcd, 0x37, 0xda,
+	0x82, 0x15, 0x41, 0x8f, 0x13, 0x99, 0x70, 0xe6, 0x77, 0x8c, 0x58, 0xf5, 0x46, 0xf7, 0xa0, 0xa3,
+	0xc8, 0x54, 0xfa, 0xdd, 0xbb, 0x5e, 0x23, 0x80, 0x23, 0x32, 0x95, 0xd8, 0xb0, 0x74, 0xd8, 0x4a,
+	0xa5, 0x7e, 0xcf, 0x68, 0xd4, 0x9f, 0xc1, 0x8f, 0xb0, 0x79, 0x50, 0xa4, 0x6f, 0x31, 0x9d, 0x26,
+	0x52, 0x09, 0xa2, 0x12, 0xce, 0x4a, 0xdf, 0xbf, 0x86, 0x91, 0xa8, 0x91, 0xa5, 0xef, 0x99, 0xcc,
+	0xdc, 0xa8, 0x14, 0x2f, 0x08, 0x36, 0xf1, 0xc1, 0xcf, 0xb0, 0x36, 0x0f, 0xa9, 0x67, 0xd0, 0x6b,
+	0x64, 0x10, 0xed, 0x42, 0x47, 0x27, 0xd9, 0x64, 0x63, 0xb8, 0x77, 0xb3, 0xb2, 0xb2, 0x98, 0x55,
+	0x6c, 0x80, 0xc1, 0x04, 0x6e, 0x68, 0xf5, 0xdf, 0x50, 0xb1, 0xc4, 0xf9, 0xc7, 0x30, 0x8e, 0xe9,
+	0x32, 0xf7, 0x6f, 0x36, 0xdc, 0x9f, 0x13, 0x9e, 0x97, 0x09, 0x30, 0xa0, 0x45, 0xd8, 0x25, 0x41,
+	0xd8, 0x7a, 0xb7, 0xaa, 0x7a, 0x2f, 0xa9, 0x61, 0xf0, 0x10, 0xae, 0xd9, 0xb4, 0xb8, 0x5e, 0xfc,
+	0x04, 0xfa, 0x82, 0xca, 0x22, 0x55, 0xa5, 0x8b, 0xeb, 0x73, 0x19, 0xd6, 0x3c, 0x5c, 0x62, 0x82,
+	0x2f, 0x01, 0xce, 0xc9, 0xe8, 0x3a, 0xf4, 0xa4, 0x22, 0xaa, 0x90, 0xc6, 0x93, 0x2e, 0x76, 0x2f,
+	0xb4, 0x01, 0x5d, 0x2a, 0x04, 0x17, 0xce, 0x17, 0xfb, 0x08, 0x5e, 0xc3, 0x3d, 0x97, 0xce, 0x1f,
+	0xf2, 0x98, 0x28, 0xfa, 0x1d, 0x27, 0xf1, 0x01, 0x49, 0x09, 0x8b, 0x12, 0x36, 0x2d, 0x53, 0xb7,
+	0x07, 0xff, 0x4f, 0x39, 0x89, 0xc3, 0x49, 0xc9, 0x08, 0xdf, 0xd1, 0x64, 0x3a, 0x53, 0xce, 0xc2,
+	0x7a, 0x5a, 0x17, 0x7a, 0x6d, 0x58, 0xc1, 0x3f, 0x2d, 0x58, 0x2f, 0x0b, 0x45, 0x54, 0x34, 0x2b,
+	0x75, 0x7d, 0x51, 0xeb, 0x57, 0xcf, 0x14, 0xf6, 0xd6, 0x8e, 0x1d, 0xd8, 0x9d, 0x72, 0x60, 0x77,
+	0x5e, 0x2a, 0x91, 0xb0, 0xe9, 0x2b, 0x92, 0x16, 0xb4, 0xd6, 0xcd, 0xdb, 0xd0, 0x22, 0x67, 0x7e,
+	0xeb, 0x0a, 0x32, 0x2d, 0x72, 0x86, 0x3e, 0x83, 0x9e, 0xae, 0x10, 0x67, 0x7e, 0xfb, 0x0a, 0x12,
+	0x0e, 0x8b, 0x1e, 0xc2, 0x30, 0x61, 0x52, 0x11, 0x16, 0xd1, 0x30, 0x89, 0xfd, 0xce, 0x15, 0x44,
+	0xa1, 0x14, 0x78, 0x1a, 0xa3, 0x3d, 0xe8, 0x45, 0x84, 0x11, 0x71, 0xea, 0x46, 0x6e, 0x6b, 0x41,
+	0xf2, 0x80, 0xf3, 0xd4, 0x99, 0xb4, 0x48, 0xf4, 0xfd, 0x45, 0xc9, 0xed, 0xb9, 0xb6, 0x9f, 0x57,
+	0xf1, 0x94, 0xa9, 0xfd, 0x3d, 0xab, 0x63, 0x69, 0xe6, 0xff, 0x6c, 0x41, 0x47, 0xaf, 0x28, 0x74,
+	0x1b, 0x20, 0xc9, 0x43, 0x12, 0xc7, 0x82, 0x4a, 0xe9, 0xfa, 0x72, 0x90, 0xe4, 0x8f, 0x2c, 0x01,
+	0x05, 0x30, 0x4a, 0x89, 0x54, 0x61, 0x34, 0xa3, 0xd1, 0xdb, 0x30, 0x61, 0xae, 0x31, 0x86, 0x9a,
+	0x78, 0xa8, 0x69, 0x4f, 0xd9, 0x7b, 0x6f, 0x9c, 0xda, 0x1c, 0x74, 0x9b, 0x73, 0xb0, 0x74, 0xcf,
+	0xf5, 0x96, 0xef, 0xb9, 0x72, 0x6f, 0xf5, 0xff, 0x73, 0x6f, 0xad, 0x54, 0x7b, 0x4b, 0xbb, 0x95,
+	0x8b, 0x84, 0x8b, 0x44, 0x9d, 0xfa, 0x03, 0x43, 0xae, 0xde, 0x68, 0x1f, 0x56, 0x32, 0xaa, 0x48,
+	0x4c, 0x14, 0xf1, 0xc1, 0x28, 0xdd, 0x5c, 0x56, 0xd3, 0x22, 0x52, 0xb8, 0x02, 0x06, 0xbf, 0x7a,
+	0xd0, 0xd1, 0x16, 0xf5, 0x08, 0x93, 0xb3, 0x72, 0x65, 0x93, 0x33, 0x3d, 0x61, 0xae, 0xb5, 0x6c,
+	0xc6, 0xdc, 0x0b, 0xdd, 0x69, 0x36, 0x8f, 0xbd, 0x07, 0xf5, 0xf6, 0xb8, 0x5e, 0xb5, 0x87, 0xce,
+	0xdb, 0x4a, 0xd5, 0x02, 0x17, 0xce, 0x57, 0xf7, 0xe2, 0xf9, 0xfa, 0xcd, 0x83, 0xb1, 0x4e, 0xd8,
+	0xe5, 0x37, 0xec, 0x7d, 0xae, 0x4b, 0x75, 0xef, 0xda, 0x97, 0xdc, 0xbb, 0xcf, 0x61, 0xc5, 0xc9,
+	0x49, 0xbf, 0x33, 0xb7, 0x3e, 0x17, 0xaf, 0x2a, 0xae, 0xc0, 0xc1, 0x4f, 0xd5, 0x3a, 0x90, 0x97,
+	0xbb, 0xbc, 0x5f, 0xb3, 0x60, 0x2f, 0xef, 0xe6, 0xbc, 0x85, 0x97, 0x45, 0x96, 0x11, 0x71, 0x5a,
+	0xd3, 0xfe, 0x97, 0x07, 0xab, 0x4d, 0xe6, 0x25, 0x2b, 0x79, 0xe3, 0xfc, 0xb0, 0xeb, 0xf4, 0xba,
+	0xc8, 0x02, 0x68, 0x93, 0xb3, 0x32, 0xf8, 0xb5, 0xca, 0xe4, 0xa3, 0xb3, 0x43, 0x5e, 0x30, 0x85,
+	0x35, 0x13, 0xdd, 0x82, 0x41, 0xd9, 0xea, 0x36, 0xfc, 0x01, 0x3e, 0x27, 0xa0, 0xfb, 0x30, 0xe6,
+	0x69, 0x4c, 0xeb, 0x23, 0x65, 0x87, 0x60, 0x64, 0xc9, 0xe5, 0x50, 0xdd, 0x87, 0x31, 0xa3, 0xef,
+	0x1a, 0x38, 0x3b, 0x08, 0x23, 0x4b, 0x76, 0xb8, 0x60, 0x17, 0xfa, 0xce, 0xfa, 0x42, 0x0b, 0x2e,
+	0x0d, 0x21, 0x98, 0x41, 0xf7, 0xf1, 0x31, 0x65, 0x4a, 0x8f, 0xad, 0x3a, 0xcd, 0xcb, 0xc0, 0xcd,
+	0xb7, 0x1e, 0xaa, 0xda, 0x35, 0x9d, 0xab, 0xae, 0x61, 0x19, 0xb1, 0x24, 0x2b, 0xff, 0x64, 0xcc,
+	0xb7, 0xb6, 0x94, 0xb0, 0x98, 0x9e, 0x98, 0x96, 0xed, 0x60, 0xfb, 0x08, 0x5e, 0xc1, 0xea, 0x13,
+	0x4a, 0x52, 0x35, 0xab, 0x0a, 0xd9, 0x3c, 0x3b, 0x83, 0xea, 0xec, 0x6c, 0x43, 0xcf, 0x44, 0x59,
+	0x16, 0x73, 0xe3, 0xdc, 0xb0, 0x51, 0x60, 0x82, 0xc5, 0x0e, 0x13, 0x30, 0x18, 0xd6, 0xc8, 0xda,
+	0x21, 0xd3, 0xb1, 0x2e, 0x0e, 0xfd, 0x5d, 0x33, 0xd4, 0x6a, 0x18, 0xba, 0x0d, 0x90, 0x12, 0x45,
+	0x59, 0x74, 0x1a, 0x66, 0xd2, 0x84, 0xe0, 0xe1, 0x81, 0xa3, 0x3c, 0xab, 0x9d, 0xbf, 0x4e, 0xfd,
+	0xfc, 0x1d, 0xc2, 0xfa, 0x61, 0x5a, 0x48, 0x45, 0x45, 0xa3, 0x2b, 0xb7, 0x61, 0x25, 0x72, 0x64,
+	0xdf, 0x9b, 0x6b, 0x08, 0x87, 0xc7, 0x15, 0x22, 0xf8, 0xdb, 0x83, 0xbe, 0xa3, 0x2e, 0xf5, 0xb8,
+	0xac, 0x46, 0xab, 0x56, 0x8d, 0x6d, 0x40, 0x11, 0x67, 0x8c, 0x46, 0x2a, 0xd4, 0x69, 0xe6, 0x85,
+	0x2a, 0xbd, 0xee, 0xe2, 0x35, 0xc7, 0x39, 0xb2, 0x8c, 0x67, 0x12, 0x6d, 0x42, 0x3f, 0x9d, 0x84,
+	0x46, 0x89, 0x75, 0xbf, 0x97, 0x4e, 0x8e, 0x6c, 0x51, 0xaf, 0x95, 0xf3, 0x6d, 0xcc, 0xda, 0x7e,
+	0x1b, 0x3a, 0x9a, 0x19, 0xeb, 0x43, 0x58, 0x8b, 0x12, 0x11, 0x15, 0x89, 0x0a, 0x27, 0x82, 0x92,
+	0xb7, 0x3a, 0x26, 0x7b, 0x5a, 0xfc, 0xf3, 0x98, 0x2c, 0xe0, 0xc0, 0xf1, 0xf1, 0x38, 0x6a, 0x12,
+	0x82, 0xe7, 0x30, 0x9e, 0xc3, 0xa0, 0xaf, 0xa0, 0x1f, 0xd3, 0x37, 0xa4, 0x48, 0x95, 0xbb, 0xe3,
+	0xf7, 0x2e, 0x50, 0x77, 0x34, 0x13, 0x54, 0xce, 0x78, 0x1a, 0x4b, 0x5c, 0x4a, 0x04, 0x7f, 0x78,
+	0xe0, 0x5f, 0x84, 0x42, 0x1f, 0xc1, 0x38, 0x23, 0x27, 0xa1, 0xcb, 0x82, 0xfb, 0x53, 0xf3, 0x1e,
+	0x8c, 0xf0, 0x6a, 0x46, 0x4e, 0x0e, 0xcf, 0xa9, 0xe8, 0x53, 0xd8, 0xd0, 0xc0, 0x9c, 0xb2, 0x58,
+	0x2f, 0x4d, 0x61, 0x7f, 0x31, 0x6c, 0x63, 0x8c, 0x30, 0xca, 0xc8, 0xc9, 0x0b, 0xcb, 0x72, 0x3f,
+	0x1f, 0x52, 0xe7, 0x4b, 0x4b, 0x54, 0xc8, 0xb6, 0x41, 0x0e, 0x33, 0x72, 0x52, 0x41, 0xee, 0xc0,
+	0xd0, 0x42, 0x94, 0x48, 0xcc, 0x92, 0xd3, 0x08, 0x30, 0x08, 0x43, 0x99, 0xf4, 0xcc, 0xc9, 0xd8,
+	0xff, 0x77, 0x00, 0x42, 0x54, 0x9a, 0xad, 0x9f, 0x0c, 0x00, 0x00,
 }
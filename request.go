@@ -0,0 +1,187 @@
+package envoyds
+
+import (
+	"errors"
+	"fmt"
+	"github.com/golang/protobuf/jsonpb"
+	"github.com/golang/protobuf/proto"
+	"github.com/mholt/binding"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"strings"
+)
+
+const (
+	CONTENT_TYPE_JSON      = "application/json"
+	CONTENT_TYPE_PROTOBUF  = "application/x-protobuf"
+	CONTENT_TYPE_FORM      = "application/x-www-form-urlencoded"
+	CONTENT_TYPE_MULTIPART = "multipart/form-data"
+	MAX_REQUEST_BYTES      = 1 << 20
+	MAX_BULK_ITEMS         = 1000
+)
+
+// requestMessage is a request body that checks itself once decoded. It can
+// be sent as JSON or protobuf, and as a form too when it maps its fields.
+type requestMessage interface {
+	proto.Message
+	validate() error
+}
+
+// requestError is a request that cannot be served as sent, along with the
+// status to answer it with.
+type requestError struct {
+	status  int
+	message string
+}
+
+// bindRequest decodes the body of r into req by its content type: JSON with
+// jsonpb, binary protobuf, or form fields and query parameters, which are
+// also read when there is no body at all. Whatever the encoding, the request
+// is then validated the same way.
+func bindRequest(w http.ResponseWriter, r *http.Request, req requestMessage) *requestError {
+	mediaType := ""
+	if contentType := r.Header.Get("Content-Type"); contentType != "" {
+		var err error
+		if mediaType, _, err = mime.ParseMediaType(contentType); err != nil {
+			return &requestError{http.StatusUnsupportedMediaType, err.Error()}
+		}
+	}
+	body := http.MaxBytesReader(w, r.Body, MAX_REQUEST_BYTES)
+	switch mediaType {
+	case CONTENT_TYPE_JSON:
+		if err := jsonpb.Unmarshal(body, req); err != nil {
+			return &requestError{http.StatusBadRequest, "cannot decode JSON body: " + err.Error()}
+		}
+	case CONTENT_TYPE_PROTOBUF:
+		bs, err := ioutil.ReadAll(body)
+		if err == nil {
+			err = proto.Unmarshal(bs, req)
+		}
+		if err != nil {
+			return &requestError{http.StatusBadRequest, "cannot decode protobuf body: " + err.Error()}
+		}
+	case "", CONTENT_TYPE_FORM, CONTENT_TYPE_MULTIPART:
+		mapper, ok := req.(binding.FieldMapper)
+		if !ok {
+			return &requestError{http.StatusUnsupportedMediaType, fmt.Sprintf("send %s or %s", CONTENT_TYPE_JSON, CONTENT_TYPE_PROTOBUF)}
+		}
+		r.Body = body
+		if errs := binding.Bind(r, mapper); len(errs) > 0 {
+			return &requestError{http.StatusBadRequest, "cannot decode form: " + errs.Error()}
+		}
+	default:
+		return &requestError{http.StatusUnsupportedMediaType, fmt.Sprintf("unsupported content type %s, send one of %s", mediaType, strings.Join([]string{CONTENT_TYPE_JSON, CONTENT_TYPE_PROTOBUF, CONTENT_TYPE_FORM}, ", "))}
+	}
+	if err := req.validate(); err != nil {
+		return &requestError{http.StatusBadRequest, err.Error()}
+	}
+	return nil
+}
+
+func (r *ServicePostRequest) validate() error {
+	if r.Ip == "" || r.Port <= 0 {
+		return errors.New("ip and port are required")
+	}
+	if strings.Contains(r.ServiceRepoName, REDIS_DELIMITER) {
+		return errors.New("service repo name cannot contains " + REDIS_DELIMITER)
+	}
+	if r.Ttl < 0 {
+		return errors.New("ttl cannot be negative")
+	}
+	return nil
+}
+
+func (r *ServiceUpdateLoadBalancingRequest) validate() error {
+	if r.GetLoadBalancingWeight() < 1 || r.GetLoadBalancingWeight() > 100 {
+		return errors.New("Host weight must be an integer between 1 and 100")
+	}
+	return nil
+}
+
+func (r *ServicePatchRequest) validate() error {
+	if r.Revision == nil && r.Az == nil && r.Region == nil && r.InstanceId == nil && r.Canary == nil && r.LoadBalancingWeight == nil {
+		return errors.New("set at least one of revision, az, region, instance_id, canary or load_balancing_weight")
+	}
+	if r.LoadBalancingWeight != nil && (r.LoadBalancingWeight.Value < 1 || r.LoadBalancingWeight.Value > 100) {
+		return errors.New("Host weight must be an integer between 1 and 100")
+	}
+	return nil
+}
+
+// apply sets the fields of r that are set on host.
+func (r *ServicePatchRequest) apply(host *Host) {
+	if r.Revision != nil {
+		host.Revision = r.Revision.Value
+	}
+	if host.Tags == nil {
+		host.Tags = &Tags{}
+	}
+	if r.Az != nil {
+		host.Tags.Az = r.Az.Value
+	}
+	if r.Region != nil {
+		host.Tags.Region = r.Region.Value
+	}
+	if r.InstanceId != nil {
+		host.Tags.InstanceId = r.InstanceId.Value
+	}
+	if r.Canary != nil {
+		host.Tags.Canary = r.Canary.Value
+	}
+	if r.LoadBalancingWeight != nil {
+		host.Tags.LoadBalancingWeight = r.LoadBalancingWeight.Value
+	}
+}
+
+func (r *BulkRegistrationRequest) validate() error {
+	return validateBulkSize(len(r.Registrations))
+}
+
+func (r *BulkDeregistrationRequest) validate() error {
+	return validateBulkSize(len(r.Deregistrations))
+}
+
+// validate checks an item of a bulk registration like a single registration.
+// Items are checked one by one, so that an invalid item fails alone.
+func (r *BulkRegistration) validate() error {
+	if err := validateServiceName(r.Service); err != nil {
+		return err
+	}
+	if r.Host == nil {
+		return errors.New("host is required")
+	}
+	return r.Host.validate()
+}
+
+// validate checks an item of a bulk deregistration. Unlike a single
+// deregistration it names one host, so the port is required.
+func (r *BulkDeregistration) validate() error {
+	if err := validateServiceName(r.Service); err != nil {
+		return err
+	}
+	if r.Ip == "" || r.Port <= 0 {
+		return errors.New("ip and port are required")
+	}
+	return nil
+}
+
+func validateBulkSize(n int) error {
+	if n == 0 {
+		return errors.New("bulk request has no items")
+	}
+	if n > MAX_BULK_ITEMS {
+		return fmt.Errorf("bulk request has %d items, at most %d are allowed", n, MAX_BULK_ITEMS)
+	}
+	return nil
+}
+
+func validateServiceName(service string) error {
+	if service == "" {
+		return errors.New("service is required")
+	}
+	if strings.Contains(service, REDIS_DELIMITER) {
+		return errors.New("service name cannot contains " + REDIS_DELIMITER)
+	}
+	return nil
+}
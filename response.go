@@ -0,0 +1,269 @@
+package envoyds
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"github.com/golang/protobuf/jsonpb"
+	"github.com/golang/protobuf/proto"
+	"io"
+	"mime"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+const (
+	CONTENT_TYPE_TEXT = "text/plain"
+	QUERY_FORMAT      = "format"
+	FORMAT_JSON       = "json"
+	FORMAT_PROTOBUF   = "protobuf"
+	FORMAT_TABLE      = "table"
+	// QUERY_IGNORE_CHECK_IN leaves the check in times of hosts out of the
+	// ETag, so that it only changes when the hosts do.
+	QUERY_IGNORE_CHECK_IN = "ignore_check_in"
+	// RESPONSE_VARY lists the request headers responses depend on: the
+	// caller region orders hosts and sets their priority.
+	RESPONSE_VARY = "Accept, " + HEADER_REGION
+)
+
+// responseFormats maps the media types a client may accept to the format
+// they are answered in. Wildcards pick the first format of their type.
+var responseFormats = map[string]string{
+	CONTENT_TYPE_JSON:     FORMAT_JSON,
+	CONTENT_TYPE_PROTOBUF: FORMAT_PROTOBUF,
+	CONTENT_TYPE_TEXT:     FORMAT_TABLE,
+	"application/*":       FORMAT_JSON,
+	"text/*":              FORMAT_TABLE,
+	"*/*":                 FORMAT_JSON,
+}
+
+var formatContentTypes = map[string]string{
+	FORMAT_JSON:     CONTENT_TYPE_JSON,
+	FORMAT_PROTOBUF: CONTENT_TYPE_PROTOBUF,
+	FORMAT_TABLE:    CONTENT_TYPE_TEXT + "; charset=utf-8",
+}
+
+// writeResponse answers r with res in the format it asks for: the format
+// query parameter if set, or else the most preferred media type of its
+// Accept header that is supported. JSON is written with m, and is the
+// default.
+func writeResponse(w http.ResponseWriter, r *http.Request, m *jsonpb.Marshaler, res proto.Message) {
+	writeResponseStatus(w, r, m, http.StatusOK, res)
+}
+
+// writeTaggedResponse answers like writeResponse with an ETag of the hosts of
+// res, and with a 304 without the body when r already has it. Only the
+// lookups of hosts, which clients poll, are tagged.
+func writeTaggedResponse(w http.ResponseWriter, r *http.Request, m *jsonpb.Marshaler, res proto.Message) {
+	format, reqErr := responseFormat(r)
+	if reqErr != nil {
+		http.Error(w, reqErr.message, reqErr.status)
+		return
+	}
+	tag, err := etag(res, format, r.URL.Query().Get(QUERY_IGNORE_CHECK_IN) == "true")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("ETag", tag)
+	if etagMatches(r.Header.Get("If-None-Match"), tag) {
+		w.Header().Add("Vary", RESPONSE_VARY)
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	writeResponse(w, r, m, res)
+}
+
+// writeResponseStatus answers like writeResponse with status.
+func writeResponseStatus(w http.ResponseWriter, r *http.Request, m *jsonpb.Marshaler, status int, res proto.Message) {
+	format, err := responseFormat(r)
+	if err != nil {
+		http.Error(w, err.message, err.status)
+		return
+	}
+	w.Header().Add("Vary", RESPONSE_VARY)
+	var buf bytes.Buffer
+	var encodeErr error
+	switch format {
+	case FORMAT_JSON:
+		encodeErr = m.Marshal(&buf, res)
+	case FORMAT_PROTOBUF:
+		var bs []byte
+		if bs, encodeErr = proto.Marshal(res); encodeErr == nil {
+			buf.Write(bs)
+		}
+	case FORMAT_TABLE:
+		encodeErr = writeTable(&buf, res)
+	}
+	if encodeErr != nil {
+		http.Error(w, encodeErr.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", formatContentTypes[format])
+	w.WriteHeader(status)
+	w.Write(buf.Bytes())
+}
+
+// etag returns a weak ETag of res in format. It is computed from the hosts
+// rather than the bytes written, whose order may vary, so the same hosts get
+// the same ETag from every instance. Check in times are left out when
+// ignoreCheckIn is set.
+func etag(res proto.Message, format string, ignoreCheckIn bool) (string, error) {
+	res = proto.Clone(res)
+	switch res := res.(type) {
+	case *ServiceGetResponse:
+		canonicalHosts(res.Hosts, ignoreCheckIn)
+	case *RepoGetResponse:
+		canonicalHosts(res.Hosts, ignoreCheckIn)
+		for _, service := range res.Services {
+			canonicalHosts(service.Hosts, ignoreCheckIn)
+		}
+		sort.Slice(res.Services, func(i, j int) bool {
+			return res.Services[i].Service < res.Services[j].Service
+		})
+	}
+	var b proto.Buffer
+	b.SetDeterministic(true)
+	if err := b.Marshal(res); err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(append(b.Bytes(), format...))
+	return fmt.Sprintf(`W/"%x"`, sum[:16]), nil
+}
+
+// canonicalHosts sorts hosts, and clears their check in times if
+// ignoreCheckIn is set.
+func canonicalHosts(hosts []*Host, ignoreCheckIn bool) {
+	if ignoreCheckIn {
+		for _, host := range hosts {
+			host.LastCheckIn = ""
+		}
+	}
+	sort.Slice(hosts, func(i, j int) bool {
+		if hosts[i].Service != hosts[j].Service {
+			return hosts[i].Service < hosts[j].Service
+		}
+		if hosts[i].IpAddress != hosts[j].IpAddress {
+			return hosts[i].IpAddress < hosts[j].IpAddress
+		}
+		return hosts[i].Port < hosts[j].Port
+	})
+}
+
+// etagMatches tells whether an If-None-Match header lists tag, comparing
+// weakly as GET requests do.
+func etagMatches(ifNoneMatch string, tag string) bool {
+	if ifNoneMatch == "" {
+		return false
+	}
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == strings.TrimPrefix(tag, "W/") {
+			return true
+		}
+	}
+	return false
+}
+
+func responseFormat(r *http.Request) (string, *requestError) {
+	if format := r.URL.Query().Get(QUERY_FORMAT); format != "" {
+		if _, ok := formatContentTypes[format]; !ok {
+			return "", &requestError{http.StatusBadRequest, fmt.Sprintf("unknown format %q, use one of %s, %s or %s", format, FORMAT_JSON, FORMAT_PROTOBUF, FORMAT_TABLE)}
+		}
+		return format, nil
+	}
+	accept := r.Header.Get("Accept")
+	if accept == "" {
+		return FORMAT_JSON, nil
+	}
+	format, best := "", 0.0
+	for _, mediaRange := range strings.Split(accept, ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(mediaRange))
+		if err != nil {
+			continue
+		}
+		q := 1.0
+		if value, ok := params["q"]; ok {
+			if q, err = strconv.ParseFloat(value, 64); err != nil {
+				continue
+			}
+		}
+		if f, ok := responseFormats[mediaType]; ok && q > best {
+			format, best = f, q
+		}
+	}
+	if format == "" {
+		return "", &requestError{http.StatusNotAcceptable, fmt.Sprintf("cannot answer with any of %s, accept one of %s, %s or %s", accept, CONTENT_TYPE_JSON, CONTENT_TYPE_PROTOBUF, CONTENT_TYPE_TEXT)}
+	}
+	return format, nil
+}
+
+// writeTable writes res as a table for people to read, with a row per host,
+// service or cluster. Other responses are written in the protobuf text format.
+func writeTable(w io.Writer, res proto.Message) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	switch res := res.(type) {
+	case *ServiceGetResponse:
+		writeHostTable(tw, res.Hosts)
+	case *RepoGetResponse:
+		writeHostTable(tw, res.Hosts)
+	case *ServicesGetResponse:
+		fmt.Fprintln(tw, "SERVICE\tHOSTS\tAZS\tREVISIONS\tOLDEST_CHECK_IN\tNEWEST_CHECK_IN")
+		for _, summary := range res.Services {
+			azs := make([]string, len(summary.Azs))
+			for i, az := range summary.Azs {
+				azs[i] = fmt.Sprintf("%s=%d", tableValue(az.Az), az.Hosts)
+			}
+			fmt.Fprintf(tw, "%s\t%d\t%s\t%s\t%s\t%s\n", summary.Service, summary.Hosts, strings.Join(azs, ","),
+				tableValue(strings.Join(summary.Revisions, ",")), checkInTime(summary.OldestCheckIn), checkInTime(summary.NewestCheckIn))
+		}
+	case *ClustersGetResponse:
+		fmt.Fprintln(tw, "NAME\tTYPE\tLB_TYPE\tCONNECT_TIMEOUT_MS\tMAX_CONNECTIONS\tMAX_PENDING_REQUESTS\tMAX_REQUESTS\tMAX_RETRIES")
+		for _, c := range res.Clusters {
+			thresholds := c.GetCircuitBreakers().GetDefault()
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%d\t%d\t%d\t%d\t%d\n", c.Name, c.Type, c.LbType, c.ConnectTimeoutMs, thresholds.GetMaxConnections(), thresholds.GetMaxPendingRequests(), thresholds.GetMaxRequests(), thresholds.GetMaxRetries())
+		}
+	default:
+		return proto.MarshalText(w, res)
+	}
+	return tw.Flush()
+}
+
+func writeHostTable(w io.Writer, hosts []*Host) {
+	hosts = append([]*Host(nil), hosts...)
+	sort.SliceStable(hosts, func(i, j int) bool {
+		if hosts[i].Service != hosts[j].Service {
+			return hosts[i].Service < hosts[j].Service
+		}
+		return hosts[i].Priority < hosts[j].Priority
+	})
+	fmt.Fprintln(w, "SERVICE\tIP\tPORT\tREVISION\tREPO\tREGION\tAZ\tCANARY\tWEIGHT\tPRIORITY\tTTL\tLAST_CHECK_IN")
+	for _, host := range hosts {
+		fmt.Fprintf(w, "%s\t%s\t%d\t%s\t%s\t%s\t%s\t%t\t%d\t%d\t%s\t%s\n",
+			host.Service, host.IpAddress, host.Port, tableValue(host.Revision), tableValue(host.ServiceRepoName),
+			tableValue(host.GetTags().GetRegion()), tableValue(host.GetTags().GetAz()), host.GetTags().GetCanary(),
+			hostWeight(host), host.Priority, time.Duration(host.Ttl)*time.Second, checkInTime(host.LastCheckIn))
+	}
+}
+
+// tableValue shows empty strings as a dash, so that columns stay aligned for
+// tools splitting on whitespace.
+func tableValue(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+// checkInTime formats a check in time in milliseconds since the epoch.
+func checkInTime(lastCheckIn string) string {
+	ms, err := strconv.ParseInt(lastCheckIn, 10, 64)
+	if err != nil {
+		return tableValue(lastCheckIn)
+	}
+	return time.Unix(0, ms*int64(time.Millisecond)).UTC().Format(time.RFC3339)
+}
@@ -2,12 +2,14 @@ package envoyds
 
 import (
 	"context"
+	"fmt"
 	"github.com/BurntSushi/toml"
 	"github.com/golang/protobuf/jsonpb"
-	"github.com/mholt/binding"
+	"io"
 	"log"
 	"net/http"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
@@ -22,7 +24,24 @@ const (
 	PATH_VARIABLE_SERVICE = "service"
 	PATH_VARIABLE_IP      = "ip_address"
 	PATH_VARIABLE_PORT    = "port"
+	PATH_VARIABLE_CLUSTER = "service_cluster"
+	PATH_VARIABLE_NODE    = "service_node"
+	QUERY_CALLER_REGION   = "caller_region"
+	HEADER_REGION         = "X-Envoyds-Region"
+	HEADER_LAST_EVENT_ID  = "Last-Event-ID"
+	QUERY_LAST_EVENT_ID   = "last_event_id"
+	QUERY_SERVICE         = "service"
+	QUERY_PREFIX          = "prefix"
+	CONTENT_TYPE_EVENTS   = "text/event-stream"
+	// EVENT_SNAPSHOT gives a feed the hosts of a service, when the events
+	// since its last event id are not known.
+	EVENT_SNAPSHOT = "snapshot"
+	// FEED_KEEPALIVE_PERIOD is how often an idle feed is sent a comment, so
+	// that proxies do not close it.
+	FEED_KEEPALIVE_PERIOD = time.Second * 15
 	HOST_TTL              = time.Minute * 10
+	MIN_HOST_TTL          = time.Second * 30
+	MAX_HOST_TTL          = time.Hour
 )
 
 type handler func(w http.ResponseWriter, r *http.Request)
@@ -32,6 +51,20 @@ type regexpRouter struct {
 	context *context.Context
 }
 
+// requestContext is the context of a request, so that handlers stop when the
+// client goes away, with the values of the router.
+type requestContext struct {
+	context.Context
+	values context.Context
+}
+
+func (c requestContext) Value(key interface{}) interface{} {
+	if value := c.values.Value(key); value != nil {
+		return value
+	}
+	return c.Context.Value(key)
+}
+
 type route struct {
 	pattern *regexp.Regexp
 	method  string
@@ -39,10 +72,50 @@ type route struct {
 }
 
 type config struct {
-	Environment string `toml:"envoyds.enviroment"`
+	Environment string `toml:"envoyds.environment"`
 	Port        int    `toml:"envoyds.port"`
+	XDSPort     int    `toml:"envoyds.xds.port"`
+	Storage     string `toml:"envoyds.storage"`
+	RedisMode   string `toml:"envoyds.redis.mode"`
 	RedisHost   string `toml:"envoyds.redis.host"`
 	RedisPort   int    `toml:"envoyds.redis.port"`
+	// RedisAddrs lists the sentinels in sentinel mode and the seed nodes in cluster mode.
+	RedisAddrs         []string `toml:"envoyds.redis.addrs"`
+	RedisMasterName    string   `toml:"envoyds.redis.sentinel.master"`
+	RedisUsername      string   `toml:"envoyds.redis.username"`
+	RedisPassword      string   `toml:"envoyds.redis.password"`
+	RedisDB            int      `toml:"envoyds.redis.db"`
+	RedisTLS           bool     `toml:"envoyds.redis.tls.enabled"`
+	RedisTLSCA         string   `toml:"envoyds.redis.tls.ca"`
+	RedisTLSCert       string   `toml:"envoyds.redis.tls.cert"`
+	RedisTLSKey        string   `toml:"envoyds.redis.tls.key"`
+	RedisTLSServerName string   `toml:"envoyds.redis.tls.server_name"`
+	RedisV1Compat      bool     `toml:"envoyds.redis.v1_compat"`
+	BoltPath           string   `toml:"envoyds.bolt.path"`
+
+	HostTTL     duration            `toml:"envoyds.host_ttl"`
+	MinHostTTL  duration            `toml:"envoyds.host_ttl.min"`
+	MaxHostTTL  duration            `toml:"envoyds.host_ttl.max"`
+	ServiceTTLs map[string]duration `toml:"envoyds.host_ttl.services"`
+
+	Cluster         clusterConfig            `toml:"envoyds.cluster"`
+	ServiceClusters map[string]clusterConfig `toml:"envoyds.cluster.services"`
+	Failover        map[string][]string      `toml:"envoyds.failover"`
+	LbSubsetKeys    map[string]string        `toml:"envoyds.lb_subset_keys"`
+
+	ReadinessPolicy  string   `toml:"envoyds.readiness.policy"`
+	ReadinessTimeout duration `toml:"envoyds.readiness.timeout"`
+}
+
+// duration reads a time.Duration from a string such as "90s" in the config.
+type duration struct {
+	time.Duration
+}
+
+func (d *duration) UnmarshalText(text []byte) error {
+	var err error
+	d.Duration, err = time.ParseDuration(string(text))
+	return err
 }
 
 func ReadConfig(configPath string) *config {
@@ -50,35 +123,69 @@ func ReadConfig(configPath string) *config {
 	if _, err := toml.DecodeFile(configPath, &c); err != nil {
 		log.Fatal(err)
 	}
+	if c.Storage == "" {
+		c.Storage = STORAGE_REDIS
+	}
+	if c.RedisMode == "" {
+		c.RedisMode = REDIS_MODE_STANDALONE
+	}
+	if c.BoltPath == "" {
+		c.BoltPath = "envoyds.db"
+	}
+	if c.HostTTL.Duration == 0 {
+		c.HostTTL.Duration = HOST_TTL
+	}
+	if c.MinHostTTL.Duration == 0 {
+		c.MinHostTTL.Duration = MIN_HOST_TTL
+	}
+	if c.MaxHostTTL.Duration == 0 {
+		c.MaxHostTTL.Duration = MAX_HOST_TTL
+	}
+	if c.ReadinessPolicy == "" {
+		c.ReadinessPolicy = READINESS_FAIL_CLOSED
+	}
+	if c.ReadinessTimeout.Duration == 0 {
+		c.ReadinessTimeout.Duration = READINESS_TIMEOUT
+	}
+	if c.Cluster.ConnectTimeout.Duration == 0 {
+		c.Cluster.ConnectTimeout.Duration = CLUSTER_CONNECT_TIMEOUT
+	}
+	if c.Cluster.LbPolicy == "" {
+		c.Cluster.LbPolicy = CLUSTER_LB_POLICY
+	}
 	return &c
 }
 
-func NewRouter(env, redisHost string, redisPort int) (*regexpRouter, error) {
-	ds, err := NewEnvoyDS(env, redisHost, redisPort)
-	if err != nil {
-		return nil, err
-	}
-	c := context.Background()
-	c = context.WithValue(c, CONTEXT_SERVICE, ds)
-	c = context.WithValue(c, CONTEXT_MARSHALER, &jsonpb.Marshaler{EmitDefaults: true, OrigName: true})
-	r := regexpRouter{context: &c}
+func NewRouter(ds *service) *regexpRouter {
+	ctx := context.Background()
+	ctx = context.WithValue(ctx, CONTEXT_SERVICE, ds)
+	ctx = context.WithValue(ctx, CONTEXT_MARSHALER, &jsonpb.Marshaler{EmitDefaults: true, OrigName: true})
+	r := regexpRouter{context: &ctx}
 	r.HandleFunc(`^/v1/registration/(?P<`+PATH_VARIABLE_SERVICE+`>[^/]+)$`, http.MethodGet, getServices)
 	r.HandleFunc(`^/v1/registration/repo/(?P<`+PATH_VARIABLE_SERVICE+`>[^/]+)$`, http.MethodGet, getServicesByRepo)
 	r.HandleFunc(`^/v1/registration/(?P<`+PATH_VARIABLE_SERVICE+`>[^/]+)$`, http.MethodPost, registerService)
 	r.HandleFunc(`^/v1/registration/(?P<`+PATH_VARIABLE_SERVICE+`>[^/]+)/(?P<`+PATH_VARIABLE_IP+`>[^/]+)$`, http.MethodDelete, deleteService)
 	r.HandleFunc(`^/v1/registration/(?P<`+PATH_VARIABLE_SERVICE+`>[^/]+)/(?P<`+PATH_VARIABLE_IP+`>[^/]+)/(?P<`+PATH_VARIABLE_PORT+`>[^/]+)$`, http.MethodDelete, deleteService)
+	r.HandleFunc(`^/v1/registration/(?P<`+PATH_VARIABLE_SERVICE+`>[^/]+)/(?P<`+PATH_VARIABLE_IP+`>[^/]+)$`, http.MethodPatch, patchService)
+	r.HandleFunc(`^/v1/registration/(?P<`+PATH_VARIABLE_SERVICE+`>[^/]+)/(?P<`+PATH_VARIABLE_IP+`>[^/]+)/(?P<`+PATH_VARIABLE_PORT+`>[^/]+)$`, http.MethodPatch, patchService)
+	r.HandleFunc(`^/healthcheck$`, http.MethodGet, getLiveness)
+	r.HandleFunc(`^/healthcheck/ready$`, http.MethodGet, getReadiness)
+	r.HandleFunc(`^/v1/services$`, http.MethodGet, getServiceCatalog)
+	r.HandleFunc(`^/v1/events$`, http.MethodGet, streamEvents)
+	r.HandleFunc(`^/v1/bulk/registration$`, http.MethodPost, bulkRegister)
+	r.HandleFunc(`^/v1/bulk/deregistration$`, http.MethodPost, bulkDeregister)
 	r.HandleFunc(`^/v1/loadbalancing/(?P<`+PATH_VARIABLE_SERVICE+`>[^/]+)/(?P<`+PATH_VARIABLE_IP+`>[^/]+)$`, http.MethodPost, updateServiceWeight)
 	r.HandleFunc(`^/v1/loadbalancing/(?P<`+PATH_VARIABLE_SERVICE+`>[^/]+)/(?P<`+PATH_VARIABLE_IP+`>[^/]+)/(?P<`+PATH_VARIABLE_PORT+`>[^/]+)$`, http.MethodPost, updateServiceWeight)
-	return &r, nil
+	r.HandleFunc(`^/v1/clusters/(?P<`+PATH_VARIABLE_CLUSTER+`>[^/]+)/(?P<`+PATH_VARIABLE_NODE+`>[^/]+)$`, http.MethodGet, getClusters)
+	return &r
 }
 
 func registerService(w http.ResponseWriter, r *http.Request) {
 	var (
 		req ServicePostRequest
 	)
-	errs := binding.Bind(r, &req)
-	if len(errs) > 0 {
-		http.Error(w, errs.Error(), http.StatusBadRequest)
+	if err := bindRequest(w, r, &req); err != nil {
+		http.Error(w, err.message, err.status)
 		return
 	}
 	serviceName := r.Context().Value(CONTEXT_PARAMS).(map[string]string)[PATH_VARIABLE_SERVICE]
@@ -126,17 +233,133 @@ func deleteService(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-func updateServiceWeight(w http.ResponseWriter, r *http.Request) {
+// patchService changes the fields set in the request on the host registered
+// on ip and port, or on every host on ip when the port is left out.
+func patchService(w http.ResponseWriter, r *http.Request) {
 	var (
-		req ServiceUpdateLoadBalancingRequest
+		req ServicePatchRequest
+	)
+	if err := bindRequest(w, r, &req); err != nil {
+		http.Error(w, err.message, err.status)
+		return
+	}
+	params := r.Context().Value(CONTEXT_PARAMS).(map[string]string)
+	serviceName := params[PATH_VARIABLE_SERVICE]
+	if strings.Contains(serviceName, REDIS_DELIMITER) {
+		http.Error(w, "service name cannot contains "+REDIS_DELIMITER, http.StatusBadRequest)
+		return
+	}
+	ip := params[PATH_VARIABLE_IP]
+	portString := params[PATH_VARIABLE_PORT]
+	if portString == "" {
+		portString = "0"
+	}
+	ds := r.Context().Value(CONTEXT_SERVICE).(*service)
+	port, err := strconv.Atoi(portString)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	log.Printf("patchService service=%s ip=%s port=%d\n", serviceName, ip, port)
+	_, err = ds.UpdateServices(serviceName, ip, port, req.apply)
+	if err == errNoHostsToUpdate {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
+
+// bulkRegister registers every valid host of the request at once. It
+// answers 200 unless the request itself is invalid, with the result of each
+// host in order.
+func bulkRegister(w http.ResponseWriter, r *http.Request) {
+	var (
+		req BulkRegistrationRequest
+	)
+	if err := bindRequest(w, r, &req); err != nil {
+		http.Error(w, err.message, err.status)
+		return
+	}
+	ds := r.Context().Value(CONTEXT_SERVICE).(*service)
+	m := r.Context().Value(CONTEXT_MARSHALER).(*jsonpb.Marshaler)
+	res := BulkResponse{Results: make([]*BulkResult, len(req.Registrations))}
+	var (
+		hosts   []*Host
+		indexes []int
+	)
+	for i, item := range req.Registrations {
+		if err := item.validate(); err != nil {
+			res.Results[i] = &BulkResult{Status: http.StatusBadRequest, Error: err.Error()}
+			continue
+		}
+		host := makeHost(item.Host)
+		host.Service = item.Service
+		hosts = append(hosts, host)
+		indexes = append(indexes, i)
+	}
+	log.Printf("bulkRegister hosts=%d valid=%d\n", len(req.Registrations), len(hosts))
+	if len(hosts) > 0 {
+		for j, err := range ds.RegisterServices(hosts) {
+			res.Results[indexes[j]] = bulkResult(err)
+		}
+	}
+	writeResponse(w, r, m, &res)
+}
+
+// bulkDeregister deletes every valid host of the request at once, and
+// answers like bulkRegister.
+func bulkDeregister(w http.ResponseWriter, r *http.Request) {
+	var (
+		req BulkDeregistrationRequest
 	)
-	errs := binding.Bind(r, &req)
-	if len(errs) > 0 {
-		http.Error(w, errs.Error(), http.StatusBadRequest)
+	if err := bindRequest(w, r, &req); err != nil {
+		http.Error(w, err.message, err.status)
 		return
 	}
-	if req.GetLoadBalancingWeight() < 1 || req.GetLoadBalancingWeight() > 100 {
-		http.Error(w, "Host weight must be an integer between 1 and 100", http.StatusBadRequest)
+	ds := r.Context().Value(CONTEXT_SERVICE).(*service)
+	m := r.Context().Value(CONTEXT_MARSHALER).(*jsonpb.Marshaler)
+	res := BulkResponse{Results: make([]*BulkResult, len(req.Deregistrations))}
+	var (
+		refs    []hostRef
+		indexes []int
+	)
+	for i, item := range req.Deregistrations {
+		if err := item.validate(); err != nil {
+			res.Results[i] = &BulkResult{Status: http.StatusBadRequest, Error: err.Error()}
+			continue
+		}
+		refs = append(refs, hostRef{service: item.Service, ip: item.Ip, port: int(item.Port)})
+		indexes = append(indexes, i)
+	}
+	log.Printf("bulkDeregister hosts=%d valid=%d\n", len(req.Deregistrations), len(refs))
+	if len(refs) > 0 {
+		for j, err := range ds.DeleteServices(refs) {
+			res.Results[indexes[j]] = bulkResult(err)
+		}
+	}
+	writeResponse(w, r, m, &res)
+}
+
+func bulkResult(err error) *BulkResult {
+	switch err {
+	case nil:
+		return &BulkResult{Status: http.StatusOK}
+	case ErrHostNotFound:
+		return &BulkResult{Status: http.StatusNotFound, Error: err.Error()}
+	default:
+		return &BulkResult{Status: http.StatusInternalServerError, Error: err.Error()}
+	}
+}
+
+func updateServiceWeight(w http.ResponseWriter, r *http.Request) {
+	var (
+		req ServiceUpdateLoadBalancingRequest
+	)
+	if err := bindRequest(w, r, &req); err != nil {
+		http.Error(w, err.message, err.status)
 		return
 	}
 	params := r.Context().Value(CONTEXT_PARAMS).(map[string]string)
@@ -179,10 +402,33 @@ func getServices(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "service name cannot contains "+REDIS_DELIMITER, http.StatusBadRequest)
 		return
 	}
+	filter, err := parseHostFilter(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	index, wait, err := parseWatch(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 	ds := r.Context().Value(CONTEXT_SERVICE).(*service)
 	m := r.Context().Value(CONTEXT_MARSHALER).(*jsonpb.Marshaler)
+	if wait > 0 {
+		ctx, cancel := context.WithTimeout(r.Context(), wait)
+		index, err = ds.WaitForService(ctx, serviceName, index)
+		cancel()
+	} else {
+		index, err = ds.ServiceIndex(serviceName)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	// read after the index, so that the hosts are at least as new as it
+	w.Header().Set(HEADER_INDEX, strconv.FormatUint(index, 10))
 	res.Env = ds.env
-	res.Hosts, err = ds.GetServicesByName(serviceName)
+	res.Hosts, err = ds.GetServicesMatching(serviceName, filter)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
@@ -190,49 +436,266 @@ func getServices(w http.ResponseWriter, r *http.Request) {
 	if len(res.Hosts) > 0 {
 		res.Service = res.Hosts[0].Service
 	}
-	log.Printf("getServices service=%s hosts=%d\n", serviceName, len(res.Hosts))
-	if err = m.Marshal(w, &res); err != nil {
+	region := r.URL.Query().Get(QUERY_CALLER_REGION)
+	if region == "" {
+		region = r.Header.Get(HEADER_REGION)
+	}
+	if region != "" {
+		ds.AssignPriorities(region, res.Hosts)
+		sort.SliceStable(res.Hosts, func(i, j int) bool {
+			return res.Hosts[i].Priority < res.Hosts[j].Priority
+		})
+	}
+	log.Printf("getServices service=%s region=%s hosts=%d\n", serviceName, region, len(res.Hosts))
+	writeTaggedResponse(w, r, m, &res)
+}
+
+// streamEvents streams the changes to the services named by the service
+// query parameters, or to every service, as Server-Sent Events: the type of
+// each event, its service and index as id and the Event as JSON. Ids are the
+// same on every instance sharing the storage. A client resuming from the id
+// of the last event it got is sent what it missed, or a snapshot of each
+// service when that is not known.
+func streamEvents(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming is not supported", http.StatusInternalServerError)
+		return
+	}
+	services := make(map[string]bool)
+	for _, service := range r.URL.Query()[QUERY_SERVICE] {
+		services[service] = true
+	}
+	ds := r.Context().Value(CONTEXT_SERVICE).(*service)
+	m := r.Context().Value(CONTEXT_MARSHALER).(*jsonpb.Marshaler)
+	lastEventID := r.Header.Get(HEADER_LAST_EVENT_ID)
+	if lastEventID == "" {
+		lastEventID = r.URL.Query().Get(QUERY_LAST_EVENT_ID)
+	}
+	// seen is the number of the last event sent, which this instance counts
+	// on its own; 0 asks for snapshots, as it is never kept
+	seen := ds.CurrentIndex()
+	if lastEventID != "" {
+		service, index, err := parseEventID(lastEventID)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if seen, ok = ds.EventSeen(service, index); !ok {
+			seen = 0
+		}
+	}
+	log.Printf("streamEvents services=%d last_event_id=%s\n", len(services), lastEventID)
+	w.Header().Set("Content-Type", CONTENT_TYPE_EVENTS)
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+	keepalive := time.NewTicker(FEED_KEEPALIVE_PERIOD)
+	defer keepalive.Stop()
+	// snapshots holds the index each service was sent a snapshot at, which
+	// includes the events up to it
+	snapshots := make(map[string]uint64)
+	for {
+		events, current, next, ok := ds.EventsAfter(seen)
+		if !ok {
+			var err error
+			if snapshots, err = writeSnapshots(w, m, ds, services); err != nil {
+				log.Println(err)
+				return
+			}
+		}
+		for _, e := range events {
+			service := e.event.GetHost().GetService()
+			if (len(services) > 0 && !services[service]) || e.event.Index <= snapshots[service] {
+				continue
+			}
+			data, err := m.MarshalToString(e.event)
+			if err != nil {
+				log.Println(err)
+				continue
+			}
+			writeServerSentEvent(w, e.event.Type, service, e.event.Index, data)
+		}
+		seen = current
+		flusher.Flush()
+		select {
+		case <-r.Context().Done():
+			return
+		case <-next:
+		case <-keepalive.C:
+			fmt.Fprint(w, ": keepalive\n\n")
+		}
+	}
+}
+
+// writeSnapshots sends a snapshot of each of services, or of every service
+// with hosts when it is empty, with the hosts as a ServiceGetResponse, and
+// returns the index of each.
+func writeSnapshots(w io.Writer, m *jsonpb.Marshaler, ds *service, services map[string]bool) (map[string]uint64, error) {
+	var names []string
+	for service := range services {
+		names = append(names, service)
+	}
+	if len(services) == 0 {
+		var err error
+		if names, err = ds.ServiceNames(); err != nil {
+			return nil, err
+		}
+	}
+	sort.Strings(names)
+	snapshots := make(map[string]uint64, len(names))
+	for _, service := range names {
+		index, hosts, err := ds.ServiceSnapshot(service)
+		if err != nil {
+			return nil, err
+		}
+		data, err := m.MarshalToString(&ServiceGetResponse{Env: ds.env, Hosts: hosts, Service: service})
+		if err != nil {
+			return nil, err
+		}
+		writeServerSentEvent(w, EVENT_SNAPSHOT, service, index, data)
+		snapshots[service] = index
+	}
+	return snapshots, nil
+}
+
+// parseEventID reads the service and index of an event id.
+func parseEventID(id string) (string, uint64, error) {
+	i := strings.LastIndex(id, REDIS_DELIMITER)
+	if i <= 0 {
+		return "", 0, fmt.Errorf("invalid last event id %q", id)
+	}
+	index, err := strconv.ParseUint(id[i+1:], 10, 64)
+	if err != nil {
+		return "", 0, fmt.Errorf("invalid last event id %q", id)
+	}
+	return id[:i], index, nil
+}
+
+func writeServerSentEvent(w io.Writer, eventType string, service string, index uint64, data string) {
+	fmt.Fprintf(w, "event: %s\nid: %s%s%d\ndata: %s\n\n", eventType, service, REDIS_DELIMITER, index, data)
+}
+
+// getLiveness answers as long as the instance serves requests, whatever the
+// state of its storage. Health is never cached, so that checks reach the
+// instance.
+func getLiveness(w http.ResponseWriter, r *http.Request) {
+	m := r.Context().Value(CONTEXT_MARSHALER).(*jsonpb.Marshaler)
+	w.Header().Set("Cache-Control", "no-store")
+	writeResponse(w, r, m, &HealthResponse{Status: HEALTH_PASS})
+}
+
+// getReadiness checks the storage, and answers 503 when the instance should
+// be taken out of service.
+func getReadiness(w http.ResponseWriter, r *http.Request) {
+	ds := r.Context().Value(CONTEXT_SERVICE).(*service)
+	m := r.Context().Value(CONTEXT_MARSHALER).(*jsonpb.Marshaler)
+	res := ds.CheckReadiness()
+	status := http.StatusOK
+	if res.Status == HEALTH_FAIL {
+		status = http.StatusServiceUnavailable
+		log.Printf("getReadiness status=%s\n", res.Status)
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	writeResponseStatus(w, r, m, status, res)
+}
+
+// getServiceCatalog lists the services with registered hosts, or those whose
+// name starts with the prefix query parameter, with a summary of their hosts.
+func getServiceCatalog(w http.ResponseWriter, r *http.Request) {
+	var (
+		res ServicesGetResponse
+		err error
+	)
+	prefix := r.URL.Query().Get(QUERY_PREFIX)
+	ds := r.Context().Value(CONTEXT_SERVICE).(*service)
+	m := r.Context().Value(CONTEXT_MARSHALER).(*jsonpb.Marshaler)
+	res.Env = ds.env
+	res.Services, err = ds.GetServiceSummaries(prefix)
+	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	log.Printf("getServiceCatalog prefix=%s services=%d\n", prefix, len(res.Services))
+	writeResponse(w, r, m, &res)
 }
 
 func getServicesByRepo(w http.ResponseWriter, r *http.Request) {
 	var (
-		res ServiceGetResponse
+		res RepoGetResponse
 		err error
 	)
 	params := r.Context().Value(CONTEXT_PARAMS).(map[string]string)
 	repoName := params[PATH_VARIABLE_SERVICE]
 	if strings.Contains(repoName, REDIS_DELIMITER) {
-		http.Error(w, "service name cannot contains "+REDIS_DELIMITER, http.StatusBadRequest)
+		http.Error(w, "service repo name cannot contains "+REDIS_DELIMITER, http.StatusBadRequest)
 		return
 	}
 	ds := r.Context().Value(CONTEXT_SERVICE).(*service)
 	m := r.Context().Value(CONTEXT_MARSHALER).(*jsonpb.Marshaler)
 	res.Env = ds.env
-	res.Hosts, err = ds.GetServicesByRepoName(repoName)
+	res.ServiceRepoName = repoName
+	res.Services, err = ds.GetServicesByRepoName(repoName)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	if len(res.Hosts) > 0 {
-		res.Service = res.Hosts[0].Service
+	for _, service := range res.Services {
+		res.Hosts = append(res.Hosts, service.Hosts...)
 	}
-	log.Printf("getServicesByRepo repoName=%s service=%s host=%d\n", repoName, res.Service, len(res.Hosts))
-	if err = m.Marshal(w, &res); err != nil {
+	log.Printf("getServicesByRepo repoName=%s services=%d hosts=%d\n", repoName, len(res.Services), len(res.Hosts))
+	writeTaggedResponse(w, r, m, &res)
+}
+
+// getClusters serves the Envoy v1 cluster discovery service: an sds cluster
+// for every service with registered hosts, whatever cluster and node ask.
+func getClusters(w http.ResponseWriter, r *http.Request) {
+	params := r.Context().Value(CONTEXT_PARAMS).(map[string]string)
+	ds := r.Context().Value(CONTEXT_SERVICE).(*service)
+	services, err := ds.GetServiceNames()
+	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	res := ClustersGetResponse{Clusters: make([]*Cluster, 0, len(services))}
+	for _, service := range services {
+		res.Clusters = append(res.Clusters, makeCluster(service, ds.ClusterConfig(service)))
+	}
+	log.Printf("getClusters cluster=%s node=%s clusters=%d\n", params[PATH_VARIABLE_CLUSTER], params[PATH_VARIABLE_NODE], len(res.Clusters))
+	// unset thresholds must be left out rather than sent as 0
+	writeResponse(w, r, &jsonpb.Marshaler{OrigName: true}, &res)
+}
+
+func makeCluster(service string, c clusterConfig) *Cluster {
+	cluster := &Cluster{
+		Name:             service,
+		Type:             "sds",
+		ConnectTimeoutMs: int32(c.ConnectTimeout.Duration / time.Millisecond),
+		LbType:           c.LbPolicy,
+		ServiceName:      service,
+	}
+	if c.hasCircuitBreakers() {
+		cluster.CircuitBreakers = &CircuitBreakers{
+			Default: &CircuitBreakerThresholds{
+				MaxConnections:     c.MaxConnections,
+				MaxPendingRequests: c.MaxPendingRequests,
+				MaxRequests:        c.MaxRequests,
+				MaxRetries:         c.MaxRetries,
+			},
+		}
+	}
+	return cluster
 }
 
 func makeHost(req *ServicePostRequest) *Host {
 	return &Host{
-		IpAddress:   req.Ip,
-		LastCheckIn: strconv.Itoa(int(time.Now().UnixNano() / int64(time.Millisecond))),
-		Port:        req.Port,
-		Revision:    req.Revision,
-		Tags:        req.Tags,
+		IpAddress:       req.Ip,
+		LastCheckIn:     strconv.Itoa(int(time.Now().UnixNano() / int64(time.Millisecond))),
+		Port:            req.Port,
+		Revision:        req.Revision,
+		ServiceRepoName: req.ServiceRepoName,
+		Tags:            req.Tags,
+		Ttl:             req.Ttl,
 	}
 }
 
@@ -250,7 +713,7 @@ func (h *regexpRouter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 					paramsMap[name] = match[i]
 				}
 			}
-			c := context.WithValue(*h.context, CONTEXT_PARAMS, paramsMap)
+			c := context.WithValue(requestContext{r.Context(), *h.context}, CONTEXT_PARAMS, paramsMap)
 			route.handler(w, r.WithContext(c))
 			return
 		}
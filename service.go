@@ -1,242 +1,431 @@
 package envoyds
 
 import (
+	"context"
 	"errors"
 	"fmt"
-	"github.com/go-redis/redis"
-	"github.com/golang/protobuf/proto"
+	"sort"
 	"strconv"
 	"strings"
-)
-
-const (
-	REDIS_V1_PREFIX    = "EYV1"
-	REDIS_SERVICE_NAME = "SERVICENAME"
-	REDIS_REPO_NAME    = "REPONAME"
-	REDIS_FIELD        = "META"
-	REDIS_DELIMITER    = ":"
-	REDIS_BATCH_SIZE   = 10
+	"time"
 )
 
 type service struct {
-	env   string
-	redis *redis.Client
+	env         string
+	store       Storage
+	hostTTL     time.Duration
+	minHostTTL  time.Duration
+	maxHostTTL  time.Duration
+	serviceTTLs map[string]time.Duration
+	cluster     clusterConfig
+	clusters    map[string]clusterConfig
+	failover    map[string][]string
+	subsetKeys  map[string]string
+	indexes     *serviceIndexes
+
+	readinessPolicy  string
+	readinessTimeout time.Duration
 }
 
-func NewEnvoyDS(env string, redisHost string, redisPort int) (*service, error) {
+func NewEnvoyDS(c *config) (*service, error) {
 	ds := &service{}
-	ds.env = env
-	ds.redis = redis.NewClient(&redis.Options{
-		Addr:     fmt.Sprintf("%s:%d", redisHost, redisPort),
-		Password: "",
-	})
-	if err := ds.redis.Ping().Err(); err != nil {
+	if err := c.Cluster.validate(); err != nil {
+		return nil, err
+	}
+	ds.cluster = c.Cluster
+	ds.clusters = make(map[string]clusterConfig, len(c.ServiceClusters))
+	for name, cluster := range c.ServiceClusters {
+		cluster = cluster.inherit(c.Cluster)
+		if err := cluster.validate(); err != nil {
+			return nil, fmt.Errorf("service %s: %v", name, err)
+		}
+		ds.clusters[name] = cluster
+	}
+	if err := validateLbSubsetKeys(c.LbSubsetKeys); err != nil {
 		return nil, err
 	}
+	ds.subsetKeys = c.LbSubsetKeys
+	if err := validateReadinessPolicy(c.ReadinessPolicy); err != nil {
+		return nil, err
+	}
+	ds.readinessPolicy = c.ReadinessPolicy
+	ds.readinessTimeout = c.ReadinessTimeout.Duration
+	if err := validateHostTTLs(c); err != nil {
+		return nil, err
+	}
+	store, err := NewStorage(c)
+	if err != nil {
+		return nil, err
+	}
+	ds.env = c.Environment
+	ds.failover = c.Failover
+	ds.store = store
+	go logEvents(store.Events())
+	ds.indexes = newServiceIndexes(store)
+	go ds.indexes.follow(store.Events())
+	ds.hostTTL = c.HostTTL.Duration
+	ds.minHostTTL = c.MinHostTTL.Duration
+	ds.maxHostTTL = c.MaxHostTTL.Duration
+	ds.serviceTTLs = make(map[string]time.Duration, len(c.ServiceTTLs))
+	for name, ttl := range c.ServiceTTLs {
+		ds.serviceTTLs[name] = ttl.Duration
+	}
 	return ds, nil
 }
 
+// RegisterService stores host for the ttl it asked for, or the ttl of its
+// service otherwise. The ttl used is recorded on the host so that later
+// updates keep it.
 func (ds *service) RegisterService(host *Host) error {
-	serviceKey := ds.getServiceKey(host.Service, host.IpAddress, int(host.Port))
-	repoKey := ds.getRepoKey(host.ServiceRepoName, host.IpAddress, int(host.Port))
-	return ds.write(serviceKey, repoKey, host)
+	ttl := ds.ttl(host)
+	host.Ttl = int32(ttl / time.Second)
+	return ds.store.Put(host, ttl)
 }
 
-func (ds *service) GetServicesByName(service string) ([]*Host, error) {
-	var (
-		hosts  = make([]*Host, 0, REDIS_BATCH_SIZE)
-	)
-	prefix := ds.getServicePrefix(service)
-	if _, err := ds.scanAndHandle(prefix,
-		func(serviceKey string) error {
-			var host Host
-			if err := ds.read(serviceKey, &host);err != nil {
-				return err
-			}
-			hosts = append(hosts, &host)
-			return nil
-		}); err != nil {
-		return hosts, err
-	}
-	return hosts, nil
-}
-
-func (ds *service) GetServicesByRepoName(repoName string) ([]*Host, error) {
-	var (
-		hosts  = make([]*Host, 0, REDIS_BATCH_SIZE)
-	)
-	prefix := ds.getRepoPrefix(repoName)
-	if _, err := ds.scanAndHandle(prefix,
-		func(serviceKey string) error {
-			var host Host
-			if err := ds.read(serviceKey, &host);err != nil {
-				return err
-			}
-			hosts = append(hosts, &host)
-			return nil
-		}); err != nil {
-		return hosts, err
+// RegisterServices stores hosts like RegisterService, in as few round-trips
+// to the storage as it allows, and returns the error of each.
+func (ds *service) RegisterServices(hosts []*Host) []error {
+	ttls := make([]time.Duration, len(hosts))
+	for i, host := range hosts {
+		ttls[i] = ds.ttl(host)
+		host.Ttl = int32(ttls[i] / time.Second)
 	}
-	return hosts, nil
+	return ds.store.PutAll(hosts, ttls)
 }
 
-func (ds *service) DeleteService(service, ip string, port int) (int, error) {
-	if port == 0 {
-		prefix := ds.getServiceIpPrefix(service, ip)
-		c := 0
-		if c, err := ds.scanAndHandle(prefix, ds.deleteServiceByServiceKey); err != nil {
-			return c, err
-		}
-		if c == 0 {
-			return 0, errors.New("cannot find services to delete")
-		}
-		return c, nil
-	} else {
-		serviceKey := ds.getServiceKey(service, ip, port)
-		if err := ds.deleteServiceByServiceKey(serviceKey); err != nil {
-			return 0, err
-		}
-		return 1, nil
+// GetServiceNames returns the names of the services with registered hosts,
+// in order.
+func (ds *service) GetServiceNames() ([]string, error) {
+	services, err := ds.store.Services()
+	if err != nil {
+		return nil, err
 	}
+	sort.Strings(services)
+	return services, nil
 }
 
-func (ds *service) UpdateServiceWeight(service, ip string, port int, weight int32) (int, error) {
-	if port == 0 {
-		prefix := ds.getServiceIpPrefix(service, ip)
-		c := 0
-		if c, err := ds.scanAndHandle(prefix,
-			func(serviceKey string) error {
-				return ds.updateServiceWeightByKey(serviceKey, weight)
-			}); err != nil {
-			return c, err
+// GetServiceSummaries describes each service with registered hosts whose
+// name starts with prefix, in order.
+func (ds *service) GetServiceSummaries(prefix string) ([]*ServiceSummary, error) {
+	services, err := ds.GetServiceNames()
+	if err != nil {
+		return nil, err
+	}
+	var summaries []*ServiceSummary
+	for _, service := range services {
+		if !strings.HasPrefix(service, prefix) {
+			continue
 		}
-		if c == 0 {
-			return 0, errors.New("cannot find services to update")
+		hosts, err := ds.store.List(service, "")
+		if err != nil {
+			return nil, err
 		}
-		return c, nil
-	} else {
-		serviceKey := ds.getServiceKey(service, ip, port)
-		if err := ds.updateServiceWeightByKey(serviceKey, weight);err != nil {
-			return 0, err
+		if len(hosts) > 0 {
+			summaries = append(summaries, summarizeService(service, hosts))
 		}
-		return 1, nil
 	}
+	return summaries, nil
 }
 
-func (ds *service) updateServiceWeightByKey(serviceKey string, weight int32) error {
-	var host Host
-	if err := ds.read(serviceKey, &host); err != nil {
-		return errors.New("cannot find service to update")
+// ClusterConfig returns the settings of the Envoy cluster of service.
+func (ds *service) ClusterConfig(service string) clusterConfig {
+	if cluster, ok := ds.clusters[service]; ok {
+		return cluster
 	}
-	host.Tags.LoadBalancingWeight = weight
-	repoKey := ds.getRepoKey(host.GetServiceRepoName(), host.GetIpAddress(), int(host.GetPort()))
-	return ds.write(serviceKey, repoKey, &host)
+	return ds.cluster
+}
+
+// LbSubsetKeys returns the names of the subset keys set on hosts, in order.
+func (ds *service) LbSubsetKeys() []string {
+	return lbSubsetKeyNames(ds.subsetKeys)
+}
+
+// CheckReadiness pings the storage and probes it with a write, and returns
+// the result of each and the status of the instance by its readiness policy.
+func (ds *service) CheckReadiness() *HealthResponse {
+	checks := runHealthChecks([]healthCheck{
+		{"storage.ping", ds.store.Ping},
+		{"storage.probe", ds.store.Probe},
+	}, ds.readinessTimeout)
+	return &HealthResponse{Status: healthStatus(checks, ds.readinessPolicy), Checks: checks}
+}
+
+// ServiceIndex returns the count of changes to service kept by the storage.
+func (ds *service) ServiceIndex(service string) (uint64, error) {
+	return ds.store.Index(service)
+}
+
+// WaitForService blocks until service changes after index, or ctx is done,
+// and returns its index then. It returns at once if index is not current.
+func (ds *service) WaitForService(ctx context.Context, service string, index uint64) (uint64, error) {
+	return ds.indexes.Wait(ctx, service, index)
+}
+
+// EventsAfter returns the events seen by this instance after the number
+// index, the number they reach and a channel closed on the next event, or
+// false when it no longer has all of them.
+func (ds *service) EventsAfter(index uint64) ([]indexedEvent, uint64, <-chan struct{}, bool) {
+	return ds.indexes.EventsAfter(index)
 }
 
-func (ds *service) deleteServiceByServiceKey(serviceKey string) error {
-	var host Host
-	if err := ds.read(serviceKey, &host); err != nil {
-		return err
+// EventSeen returns the number this instance saw the event index of service
+// at, or false when it does not have it.
+func (ds *service) EventSeen(service string, index uint64) (uint64, bool) {
+	return ds.indexes.Seen(service, index)
+}
+
+// CurrentIndex returns the number of the last event seen by this instance.
+func (ds *service) CurrentIndex() uint64 {
+	return ds.indexes.Current()
+}
+
+// ServiceNames returns the names of the services with registered hosts.
+func (ds *service) ServiceNames() ([]string, error) {
+	return ds.store.Services()
+}
+
+// ServiceSnapshot returns the hosts of service along with its index, read
+// before them so that the hosts include every change it counts.
+func (ds *service) ServiceSnapshot(service string) (uint64, []*Host, error) {
+	index, err := ds.store.Index(service)
+	if err != nil {
+		return 0, nil, err
 	}
-	c, err := ds.redis.Del(serviceKey).Result()
+	hosts, err := ds.GetServicesByName(service)
+	return index, hosts, err
+}
+
+func (ds *service) GetServicesByName(service string) ([]*Host, error) {
+	hosts, err := ds.store.List(service, "")
+	return ds.withMetadata(hosts), err
+}
+
+// GetServicesMatching returns the hosts of service that match filter.
+func (ds *service) GetServicesMatching(service string, filter hostFilter) ([]*Host, error) {
+	hosts, err := ds.store.ListMatching(service, filter)
+	return ds.withMetadata(hosts), err
+}
+
+// GetServicesByRepoName returns the hosts registered with repoName, grouped
+// by service and ordered by service name.
+func (ds *service) GetServicesByRepoName(repoName string) ([]*ServiceGetResponse, error) {
+	hosts, err := ds.store.ListByRepo(repoName)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	if c == 0 {
-		return errors.New("cannot find service when deleting")
-	} else if c == 1 {
-		repoKey := strings.Join([]string{REDIS_V1_PREFIX, ds.env, REDIS_REPO_NAME, host.ServiceRepoName, host.IpAddress, strconv.Itoa(int(host.Port))}, REDIS_DELIMITER)
-		if err = ds.redis.Del(repoKey).Err(); err != nil {
-			return err
+	ds.withMetadata(hosts)
+	byService := make(map[string]*ServiceGetResponse)
+	services := make([]*ServiceGetResponse, 0, len(hosts))
+	for _, host := range hosts {
+		res, ok := byService[host.Service]
+		if !ok {
+			res = &ServiceGetResponse{Env: ds.env, Service: host.Service}
+			byService[host.Service] = res
+			services = append(services, res)
 		}
+		res.Hosts = append(res.Hosts, host)
 	}
-	return nil
+	sort.Slice(services, func(i, j int) bool {
+		return services[i].Service < services[j].Service
+	})
+	return services, nil
 }
 
-func (ds *service) scanAndHandle(prefix string, handle func(serviceKey string) error) (int, error) {
-	var (
-		cursor uint64
-		err    error
-		serviceKeys []string
-		unique = make(map[string]bool, REDIS_BATCH_SIZE)
-	)
-	for {
-		serviceKeys, cursor, err = ds.redis.Scan(cursor, prefix, REDIS_BATCH_SIZE).Result()
-		if err != nil {
-			return len(unique), err
-		}
-		for _, serviceKey := range serviceKeys {
-			var host Host
-			if err := ds.read(serviceKey, &host); err != nil {
-				return len(unique), err
-			}
-			if !unique[serviceKey] {
-				errLocal := handle(serviceKey)
-				if errLocal != nil {
-					err = errLocal
-				}
-				unique[serviceKey] = true
-			}
-		}
-
-		if cursor == 0 {
-			break
+func (ds *service) DeleteService(service, ip string, port int) (int, error) {
+	hosts, err := ds.findHosts(service, ip, port)
+	if err != nil {
+		return 0, err
+	}
+	if len(hosts) == 0 {
+		return 0, errors.New("cannot find services to delete")
+	}
+	c := 0
+	for _, host := range hosts {
+		if err := ds.store.Delete(service, host.IpAddress, int(host.Port)); err != nil {
+			return c, err
 		}
+		c++
 	}
-	return len(unique), err
+	return c, nil
+}
+
+// DeleteServices deletes the host named by each of refs at once, and returns
+// the error of each, ErrHostNotFound for those not registered.
+func (ds *service) DeleteServices(refs []hostRef) []error {
+	return ds.store.DeleteAll(refs)
 }
 
-func (ds *service) getServiceKey(serviceName, ip string, port int) string {
-	return strings.Join([]string{REDIS_V1_PREFIX, ds.env, REDIS_SERVICE_NAME, serviceName, ip, strconv.Itoa(port)}, REDIS_DELIMITER)
+func (ds *service) UpdateServiceWeight(service, ip string, port int, weight int32) (int, error) {
+	return ds.UpdateServices(service, ip, port, func(host *Host) {
+		if host.Tags == nil {
+			host.Tags = &Tags{}
+		}
+		host.Tags.LoadBalancingWeight = weight
+	})
 }
 
-func  (ds *service) getServicePrefix(serviceName string) string {
-	return strings.Join([]string{REDIS_V1_PREFIX, ds.env, REDIS_SERVICE_NAME, serviceName, "*"}, REDIS_DELIMITER)
+// errNoHostsToUpdate is returned by UpdateServices when no host matches.
+var errNoHostsToUpdate = errors.New("cannot find services to update")
+
+// UpdateServices applies update to the host registered on ip and port, or
+// to every host on ip when port is 0, and returns how many were updated.
+// Hosts keep their expiry: only registering again extends it.
+func (ds *service) UpdateServices(service, ip string, port int, update func(host *Host)) (int, error) {
+	hosts, err := ds.findHosts(service, ip, port)
+	if err != nil {
+		return 0, err
+	}
+	if len(hosts) == 0 {
+		return 0, errNoHostsToUpdate
+	}
+	c := 0
+	for _, host := range hosts {
+		err := ds.store.Update(service, host.IpAddress, int(host.Port), func(host *Host) error {
+			update(host)
+			return nil
+		})
+		if err == ErrHostNotFound {
+			// expired or deleted since it was found
+			continue
+		}
+		if err != nil {
+			return c, err
+		}
+		c++
+	}
+	if c == 0 {
+		return 0, errNoHostsToUpdate
+	}
+	return c, nil
 }
 
-func  (ds *service) getServiceIpPrefix(serviceName, ip string) string {
-	return strings.Join([]string{REDIS_V1_PREFIX, ds.env, REDIS_SERVICE_NAME, serviceName, ip, "*"}, REDIS_DELIMITER)
+// AssignPriorities sets the failover priority of hosts for callers in
+// region: hosts in region come first, then those in the regions of its
+// failover order, in that order, then all others. Priorities are numbered
+// from 0 without gaps, so the most preferred hosts left always have priority
+// 0. Nothing is set when region is empty.
+func (ds *service) AssignPriorities(region string, hosts []*Host) {
+	if region == "" {
+		return
+	}
+	order := ds.failover[region]
+	ranks := make([]int, len(hosts))
+	used := make(map[int]bool)
+	for i, host := range hosts {
+		ranks[i] = len(order) + 1
+		if host.GetTags().GetRegion() == region {
+			ranks[i] = 0
+		}
+		for j, failover := range order {
+			if host.GetTags().GetRegion() == failover {
+				ranks[i] = j + 1
+				break
+			}
+		}
+		used[ranks[i]] = true
+	}
+	priorities := make(map[int]int32, len(used))
+	for rank := 0; rank <= len(order)+1; rank++ {
+		if used[rank] {
+			priorities[rank] = int32(len(priorities))
+		}
+	}
+	for i, host := range hosts {
+		host.Priority = priorities[ranks[i]]
+	}
 }
 
-func (ds *service) getRepoKey(repoName, ip string, port int) string {
-	return strings.Join([]string{REDIS_V1_PREFIX, ds.env, REDIS_REPO_NAME, repoName, ip, strconv.Itoa(port)}, REDIS_DELIMITER)
+// withMetadata sets the metadata Envoy reads from each of hosts, which is
+// derived from the host rather than stored with it.
+func (ds *service) withMetadata(hosts []*Host) []*Host {
+	for _, host := range hosts {
+		host.Metadata = lbSubsetMetadata(host, ds.subsetKeys)
+	}
+	return hosts
 }
 
-func  (ds *service) getRepoPrefix(repoName string) string {
-	return strings.Join([]string{REDIS_V1_PREFIX, ds.env, REDIS_SERVICE_NAME, repoName, "*"}, REDIS_DELIMITER)
+func summarizeService(service string, hosts []*Host) *ServiceSummary {
+	summary := &ServiceSummary{Service: service, Hosts: int32(len(hosts))}
+	azs := make(map[string]int32)
+	revisions := make(map[string]bool)
+	var oldest, newest int64
+	for _, host := range hosts {
+		azs[host.GetTags().GetAz()]++
+		if host.Revision != "" && !revisions[host.Revision] {
+			revisions[host.Revision] = true
+			summary.Revisions = append(summary.Revisions, host.Revision)
+		}
+		checkIn, err := strconv.ParseInt(host.LastCheckIn, 10, 64)
+		if err != nil {
+			continue
+		}
+		if summary.OldestCheckIn == "" || checkIn < oldest {
+			oldest, summary.OldestCheckIn = checkIn, host.LastCheckIn
+		}
+		if summary.NewestCheckIn == "" || checkIn > newest {
+			newest, summary.NewestCheckIn = checkIn, host.LastCheckIn
+		}
+	}
+	for az, count := range azs {
+		summary.Azs = append(summary.Azs, &AzCount{Az: az, Hosts: count})
+	}
+	sort.Slice(summary.Azs, func(i, j int) bool {
+		return summary.Azs[i].Az < summary.Azs[j].Az
+	})
+	sort.Strings(summary.Revisions)
+	return summary
 }
 
-func (ds *service) write(serviceKey, repoKey string, host *Host) error {
-	bs, err := proto.Marshal(host)
-	if err != nil {
-		return err
+// findHosts returns the host registered on ip and port, or every host on ip
+// when port is 0.
+func (ds *service) findHosts(service, ip string, port int) ([]*Host, error) {
+	if port == 0 {
+		return ds.store.List(service, ip)
 	}
-	pipe := ds.redis.Pipeline()
-	if err = pipe.HSet(serviceKey, REDIS_FIELD, bs).Err(); err != nil {
-		return err
+	host, err := ds.store.Get(service, ip, port)
+	if err == ErrHostNotFound {
+		return nil, nil
 	}
-	if err = pipe.Expire(serviceKey, HOST_TTL).Err(); err != nil {
-		return err
+	if err != nil {
+		return nil, err
 	}
-	if err = pipe.HSet(repoKey, REDIS_FIELD, []byte(serviceKey)).Err(); err != nil {
-		return err
+	return []*Host{host}, nil
+}
+
+// validateHostTTLs checks that the configured ttls are within the limits a
+// registration may ask for, so that every host is kept for a ttl between
+// them whichever set it.
+func validateHostTTLs(c *config) error {
+	min, max := c.MinHostTTL.Duration, c.MaxHostTTL.Duration
+	if min <= 0 || min > max {
+		return fmt.Errorf("envoyds.host_ttl.min %s must be positive and at most envoyds.host_ttl.max %s", min, max)
 	}
-	if err = pipe.Expire(repoKey, HOST_TTL).Err(); err != nil {
-		return err
+	if ttl := c.HostTTL.Duration; ttl < min || ttl > max {
+		return fmt.Errorf("envoyds.host_ttl %s must be between %s and %s", ttl, min, max)
 	}
-	if _, err = pipe.Exec(); err != nil {
-		return err
+	for name, ttl := range c.ServiceTTLs {
+		if ttl.Duration < min || ttl.Duration > max {
+			return fmt.Errorf("envoyds.host_ttl.services %s %s must be between %s and %s", name, ttl.Duration, min, max)
+		}
 	}
 	return nil
 }
 
-func (ds *service) read(serviceKey string, host *Host) error {
-	bs, err := ds.redis.HGet(serviceKey, REDIS_FIELD).Result()
-	if err != nil {
-		return err
+// ttl returns how long host stays registered: the ttl it carries bounded by
+// the configured limits, or else the ttl configured for its service.
+func (ds *service) ttl(host *Host) time.Duration {
+	if host.Ttl > 0 {
+		ttl := time.Duration(host.Ttl) * time.Second
+		if ttl < ds.minHostTTL {
+			return ds.minHostTTL
+		}
+		if ttl > ds.maxHostTTL {
+			return ds.maxHostTTL
+		}
+		return ttl
 	}
-	if err = proto.Unmarshal([]byte(bs), host); err != nil {
-		return err
+	if ttl, ok := ds.serviceTTLs[host.Service]; ok {
+		return ttl
 	}
-	return nil
-}
\ No newline at end of file
+	return ds.hostTTL
+}
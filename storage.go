@@ -0,0 +1,136 @@
+package envoyds
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+)
+
+const (
+	STORAGE_REDIS  = "redis"
+	STORAGE_MEMORY = "memory"
+	STORAGE_BOLT   = "bolt"
+)
+
+var ErrHostNotFound = errors.New("cannot find service")
+
+// Storage persists registered hosts of a single environment. Hosts are
+// identified by service name, ip address and port, and disappear once their
+// ttl has elapsed without being written again.
+type Storage interface {
+	Ping() error
+	// Probe writes a value apart from the hosts, reads it back and removes
+	// it, to check that the storage takes writes as well as reads.
+	Probe() error
+	Put(host *Host, ttl time.Duration) error
+	// PutAll stores each of hosts for the ttl at the same index in as few
+	// round trips as the storage allows, and returns the error of each.
+	PutAll(hosts []*Host, ttls []time.Duration) []error
+	// Update atomically applies update to a registered host and stores the
+	// result until the host expires, which it does not change. A concurrent
+	// write to the host is never lost: either it is seen by update or it is
+	// applied after. Update returns ErrHostNotFound when the host is not
+	// registered and any error returned by update.
+	Update(service, ip string, port int, update func(host *Host) error) error
+	// Get returns ErrHostNotFound when the host is not registered.
+	Get(service, ip string, port int) (*Host, error)
+	// List returns every host of service, or only those on ip if it is not empty.
+	List(service, ip string) ([]*Host, error)
+	ListByRepo(repoName string) ([]*Host, error)
+	// ListMatching returns the hosts of service that match filter, looked up
+	// through the indexes of the filtered attributes rather than by reading
+	// every host of the service.
+	ListMatching(service string, filter hostFilter) ([]*Host, error)
+	// Services returns the names of the services with registered hosts.
+	Services() ([]string, error)
+	// Delete returns ErrHostNotFound when the host is not registered.
+	Delete(service, ip string, port int) error
+	// DeleteAll deletes each of the hosts named by refs in as few round trips
+	// as the storage allows, and returns the error of each, ErrHostNotFound
+	// for those not registered.
+	DeleteAll(refs []hostRef) []error
+	// Events publishes every change to the stored hosts, including those made
+	// by other instances sharing the storage and hosts that expired.
+	Events() *eventHub
+	// Index returns the count of changes to service, which every change adds
+	// to in the same write and gives as the index of its event, or 0 if the
+	// service never changed. Instances sharing the storage agree on it.
+	Index(service string) (uint64, error)
+}
+
+func NewStorage(c *config) (Storage, error) {
+	switch c.Storage {
+	case STORAGE_REDIS:
+		return NewRedisStorage(c)
+	case STORAGE_MEMORY:
+		return NewMemoryStorage(), nil
+	case STORAGE_BOLT:
+		return NewBoltStorage(c.Environment, c.BoltPath)
+	default:
+		return nil, fmt.Errorf("unknown storage %q", c.Storage)
+	}
+}
+
+// MigrateStorage upgrades the data of the configured storage to the layout
+// written by this release.
+func MigrateStorage(c *config) error {
+	store, err := NewStorage(c)
+	if err != nil {
+		return err
+	}
+	migrator, ok := store.(Migrator)
+	if !ok {
+		log.Printf("Storage %s has nothing to migrate\n", c.Storage)
+		return nil
+	}
+	version, err := migrator.SchemaVersion()
+	if err != nil {
+		return err
+	}
+	log.Printf("Storage %s has schema version %d\n", c.Storage, version)
+	return migrator.Migrate()
+}
+
+// errProbeMismatch is returned by probes that read back another value than
+// the one they wrote.
+var errProbeMismatch = errors.New("probe read back another value than it wrote")
+
+// hostRef names a host of a service.
+type hostRef struct {
+	service string
+	ip      string
+	port    int
+}
+
+// allErrors returns err as the error of each of n items.
+func allErrors(n int, err error) []error {
+	errs := make([]error, n)
+	for i := range errs {
+		errs[i] = err
+	}
+	return errs
+}
+
+// hostsOn returns the hosts of hosts on ip, or all of them when ip is empty.
+// Storages find the hosts of an ip by the prefix ip: of their keys, which
+// the key of a host on another IPv6 address may start with too, such as
+// ::1:2:80 for ::1.
+func hostsOn(ip string, hosts []*Host) []*Host {
+	if ip == "" {
+		return hosts
+	}
+	matching := hosts[:0]
+	for _, host := range hosts {
+		if host.IpAddress == ip {
+			matching = append(matching, host)
+		}
+	}
+	return matching
+}
+
+// hostKey identifies a host within its service.
+func hostKey(ip string, port int) string {
+	return ip + REDIS_DELIMITER + strconv.Itoa(port)
+}
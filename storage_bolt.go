@@ -0,0 +1,603 @@
+package envoyds
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"github.com/golang/protobuf/proto"
+	bolt "go.etcd.io/bbolt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	BOLT_OPEN_TIMEOUT = time.Second
+	// The buckets of the file, named as by the first releases so that their
+	// files still open.
+	BOLT_ROOT_BUCKET     = "EYV1"
+	BOLT_SERVICES_BUCKET = "SERVICENAME"
+	BOLT_REPOS_BUCKET    = "REPONAME"
+	BOLT_TERMS_BUCKET    = "INDEX"
+	BOLT_PROBES_BUCKET   = "PROBE"
+	BOLT_DELIMITER       = ":"
+)
+
+// boltStorage keeps hosts in an embedded bolt database so that a single
+// instance survives restarts without a Redis. The bucket of its environment
+// holds a bucket per service holding ip:port entries, a bucket per repo
+// holding service:ip:port references into them, and a bucket per service and
+// index term holding the ip:port of the hosts indexed under it. Every entry is
+// prefixed with its expiry time; expired entries are invisible to readers and
+// removed by a periodic sweep. The sequence of the bucket of a service counts
+// its changes, so the bucket is kept once its hosts are gone.
+type boltStorage struct {
+	env    string
+	db     *bolt.DB
+	events *eventHub
+}
+
+func NewBoltStorage(env string, path string) (*boltStorage, error) {
+	if env == "" {
+		return nil, errors.New("bolt storage requires envoyds.environment")
+	}
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: BOLT_OPEN_TIMEOUT})
+	if err != nil {
+		return nil, err
+	}
+	s := &boltStorage{env: env, db: db, events: newEventHub()}
+	if err = db.Update(func(tx *bolt.Tx) error {
+		root, err := tx.CreateBucketIfNotExists([]byte(BOLT_ROOT_BUCKET))
+		if err != nil {
+			return err
+		}
+		envBucket, err := root.CreateBucketIfNotExists([]byte(env))
+		if err != nil {
+			return err
+		}
+		if _, err = envBucket.CreateBucketIfNotExists([]byte(BOLT_SERVICES_BUCKET)); err != nil {
+			return err
+		}
+		if _, err = envBucket.CreateBucketIfNotExists([]byte(BOLT_REPOS_BUCKET)); err != nil {
+			return err
+		}
+		if _, err = envBucket.CreateBucketIfNotExists([]byte(BOLT_TERMS_BUCKET)); err != nil {
+			return err
+		}
+		_, err = envBucket.CreateBucketIfNotExists([]byte(BOLT_PROBES_BUCKET))
+		return err
+	}); err != nil {
+		db.Close()
+		return nil, err
+	}
+	go s.sweepPeriodically()
+	return s, nil
+}
+
+func (s *boltStorage) Ping() error {
+	return s.db.View(func(tx *bolt.Tx) error {
+		return nil
+	})
+}
+
+// Probe writes, reads and deletes an entry of its own in one transaction,
+// which bolt syncs to disk on commit.
+func (s *boltStorage) Probe() error {
+	value := []byte(strconv.FormatInt(time.Now().UnixNano(), 10))
+	return s.db.Update(func(tx *bolt.Tx) error {
+		probes := s.probes(tx)
+		if err := probes.Put(value, value); err != nil {
+			return err
+		}
+		if !bytes.Equal(probes.Get(value), value) {
+			return errProbeMismatch
+		}
+		return probes.Delete(value)
+	})
+}
+
+func (s *boltStorage) Put(host *Host, ttl time.Duration) error {
+	return s.PutAll([]*Host{host}, []time.Duration{ttl})[0]
+}
+
+// PutAll stores hosts in one transaction, so either all of them are stored
+// or none is.
+func (s *boltStorage) PutAll(hosts []*Host, ttls []time.Duration) []error {
+	values := make([][]byte, len(hosts))
+	for i, host := range hosts {
+		bs, err := proto.Marshal(host)
+		if err != nil {
+			return allErrors(len(hosts), err)
+		}
+		values[i] = bs
+	}
+	var events []*Event
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		now := time.Now()
+		services, _ := s.buckets(tx)
+		for i, host := range hosts {
+			old, expires := s.entry(services, host.Service, hostKey(host.IpAddress, int(host.Port)))
+			if old != nil && expires.Before(now) {
+				event, err := s.change(services, EVENT_EXPIRED, old)
+				if err != nil {
+					return err
+				}
+				events = append(events, event)
+				old = nil
+			}
+			if eventType := writeEventType(old, host); eventType != "" {
+				event, err := s.change(services, eventType, proto.Clone(host).(*Host))
+				if err != nil {
+					return err
+				}
+				events = append(events, event)
+			}
+			if err := s.put(tx, host, values[i], now.Add(ttls[i])); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err == nil {
+		s.publish(events)
+	}
+	return allErrors(len(hosts), err)
+}
+
+func (s *boltStorage) Update(service, ip string, port int, update func(host *Host) error) error {
+	var events []*Event
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		services, _ := s.buckets(tx)
+		host, expires := s.entry(services, service, hostKey(ip, port))
+		if host == nil || expires.Before(time.Now()) {
+			return ErrHostNotFound
+		}
+		old := proto.Clone(host).(*Host)
+		if err := update(host); err != nil {
+			return err
+		}
+		bs, err := proto.Marshal(host)
+		if err != nil {
+			return err
+		}
+		if eventType := writeEventType(old, host); eventType != "" {
+			event, err := s.change(services, eventType, host)
+			if err != nil {
+				return err
+			}
+			events = append(events, event)
+		}
+		return s.put(tx, host, bs, expires)
+	})
+	if err == nil {
+		s.publish(events)
+	}
+	return err
+}
+
+func (s *boltStorage) Get(service, ip string, port int) (*Host, error) {
+	var host *Host
+	err := s.db.View(func(tx *bolt.Tx) error {
+		services, _ := s.buckets(tx)
+		host = s.get(services, service, hostKey(ip, port))
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if host == nil {
+		return nil, ErrHostNotFound
+	}
+	return host, nil
+}
+
+func (s *boltStorage) List(service, ip string) ([]*Host, error) {
+	hosts := make([]*Host, 0, REDIS_BATCH_SIZE)
+	err := s.db.View(func(tx *bolt.Tx) error {
+		services, _ := s.buckets(tx)
+		serviceBucket := services.Bucket([]byte(service))
+		if serviceBucket == nil {
+			return nil
+		}
+		var prefix []byte
+		if ip != "" {
+			prefix = []byte(ip + REDIS_DELIMITER)
+		}
+		c := serviceBucket.Cursor()
+		now := time.Now()
+		for k, v := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = c.Next() {
+			if host, ok := decodeBoltEntry(v, now); ok {
+				hosts = append(hosts, host)
+			}
+		}
+		return nil
+	})
+	return hostsOn(ip, hosts), err
+}
+
+func (s *boltStorage) ListByRepo(repoName string) ([]*Host, error) {
+	hosts := make([]*Host, 0, REDIS_BATCH_SIZE)
+	err := s.db.View(func(tx *bolt.Tx) error {
+		services, repos := s.buckets(tx)
+		if repoName == "" {
+			return nil
+		}
+		repoBucket := repos.Bucket([]byte(repoName))
+		if repoBucket == nil {
+			return nil
+		}
+		return repoBucket.ForEach(func(k, v []byte) error {
+			parts := strings.SplitN(string(k), BOLT_DELIMITER, 2)
+			if len(parts) != 2 {
+				return nil
+			}
+			if host := s.get(services, parts[0], parts[1]); host != nil && host.ServiceRepoName == repoName {
+				hosts = append(hosts, host)
+			}
+			return nil
+		})
+	})
+	return hosts, err
+}
+
+func (s *boltStorage) ListMatching(service string, filter hostFilter) ([]*Host, error) {
+	terms := filter.terms()
+	if len(terms) == 0 {
+		return s.List(service, "")
+	}
+	hosts := make([]*Host, 0, REDIS_BATCH_SIZE)
+	err := s.db.View(func(tx *bolt.Tx) error {
+		services, _ := s.buckets(tx)
+		serviceIndex := s.indexes(tx).Bucket([]byte(service))
+		if serviceIndex == nil {
+			return nil
+		}
+		// walk the index of the first term, which usually matches the fewest
+		// hosts, and look the others up
+		termBuckets := make([]*bolt.Bucket, len(terms))
+		for i, term := range terms {
+			if termBuckets[i] = serviceIndex.Bucket([]byte(term)); termBuckets[i] == nil {
+				return nil
+			}
+		}
+		return termBuckets[0].ForEach(func(k, _ []byte) error {
+			for _, termBucket := range termBuckets {
+				if termBucket.Get(k) == nil {
+					return nil
+				}
+			}
+			if host := s.get(services, service, string(k)); host != nil {
+				hosts = append(hosts, host)
+			}
+			return nil
+		})
+	})
+	return hosts, err
+}
+
+func (s *boltStorage) Services() ([]string, error) {
+	services := make([]string, 0, REDIS_BATCH_SIZE)
+	err := s.db.View(func(tx *bolt.Tx) error {
+		serviceBuckets, _ := s.buckets(tx)
+		now := time.Now()
+		return serviceBuckets.ForEach(func(service, _ []byte) error {
+			c := serviceBuckets.Bucket(service).Cursor()
+			for k, v := c.First(); k != nil; k, v = c.Next() {
+				if !boltEntryExpires(v).Before(now) {
+					services = append(services, string(service))
+					return nil
+				}
+			}
+			return nil
+		})
+	})
+	return services, err
+}
+
+func (s *boltStorage) Delete(service, ip string, port int) error {
+	return s.DeleteAll([]hostRef{{service: service, ip: ip, port: port}})[0]
+}
+
+// DeleteAll deletes hosts in one transaction. Hosts that are not registered
+// do not keep the others from being deleted.
+func (s *boltStorage) DeleteAll(refs []hostRef) []error {
+	var events []*Event
+	errs := make([]error, len(refs))
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		services, repos := s.buckets(tx)
+		for i, ref := range refs {
+			key := []byte(hostKey(ref.ip, ref.port))
+			serviceBucket := services.Bucket([]byte(ref.service))
+			if serviceBucket == nil {
+				errs[i] = ErrHostNotFound
+				continue
+			}
+			host, ok := decodeBoltEntry(serviceBucket.Get(key), time.Now())
+			if !ok {
+				errs[i] = ErrHostNotFound
+				continue
+			}
+			if err := serviceBucket.Delete(key); err != nil {
+				return err
+			}
+			event, err := s.change(services, EVENT_DELETED, host)
+			if err != nil {
+				return err
+			}
+			events = append(events, event)
+			if err := s.unindex(tx, host, indexTerms(host)); err != nil {
+				return err
+			}
+			if err := s.deleteRepoEntry(repos, host); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return allErrors(len(refs), err)
+	}
+	s.publish(events)
+	return errs
+}
+
+func (s *boltStorage) Events() *eventHub {
+	return s.events
+}
+
+func (s *boltStorage) sweepPeriodically() {
+	ticker := time.NewTicker(EXPIRY_SWEEP_PERIOD)
+	defer ticker.Stop()
+	for range ticker.C {
+		if err := s.sweep(); err != nil {
+			log.Println(err)
+		}
+	}
+}
+
+// sweep removes expired hosts along with their repo references, and
+// publishes their expiry.
+func (s *boltStorage) sweep() error {
+	var events []*Event
+	now := time.Now()
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		services, repos := s.buckets(tx)
+		var names [][]byte
+		if err := services.ForEach(func(service, _ []byte) error {
+			names = append(names, service)
+			return nil
+		}); err != nil {
+			return err
+		}
+		for _, service := range names {
+			serviceBucket := services.Bucket(service)
+			var expired [][]byte
+			c := serviceBucket.Cursor()
+			for k, v := c.First(); k != nil; k, v = c.Next() {
+				if boltEntryExpires(v).Before(now) {
+					expired = append(expired, k)
+				}
+			}
+			for _, k := range expired {
+				if host, ok := decodeBoltEntry(serviceBucket.Get(k), time.Time{}); ok {
+					if err := s.deleteRepoEntry(repos, host); err != nil {
+						return err
+					}
+					if err := s.unindex(tx, host, indexTerms(host)); err != nil {
+						return err
+					}
+					event, err := s.change(services, EVENT_EXPIRED, host)
+					if err != nil {
+						return err
+					}
+					events = append(events, event)
+				}
+				if err := serviceBucket.Delete(k); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+	if err == nil {
+		s.publish(events)
+	}
+	return err
+}
+
+func (s *boltStorage) Index(service string) (uint64, error) {
+	var index uint64
+	err := s.db.View(func(tx *bolt.Tx) error {
+		services, _ := s.buckets(tx)
+		if serviceBucket := services.Bucket([]byte(service)); serviceBucket != nil {
+			index = serviceBucket.Sequence()
+		}
+		return nil
+	})
+	return index, err
+}
+
+// change counts a change to the service of host in the sequence of its
+// bucket, and returns its event.
+func (s *boltStorage) change(services *bolt.Bucket, eventType string, host *Host) (*Event, error) {
+	serviceBucket, err := services.CreateBucketIfNotExists([]byte(host.Service))
+	if err != nil {
+		return nil, err
+	}
+	index, err := serviceBucket.NextSequence()
+	if err != nil {
+		return nil, err
+	}
+	event := newEvent(eventType, host)
+	event.Index = index
+	return event, nil
+}
+
+// publish hands events to subscribers once the transaction that made them
+// has been committed.
+func (s *boltStorage) publish(events []*Event) {
+	for _, event := range events {
+		s.events.Publish(event)
+	}
+}
+
+func (s *boltStorage) put(tx *bolt.Tx, host *Host, bs []byte, expires time.Time) error {
+	key := []byte(hostKey(host.IpAddress, int(host.Port)))
+	services, repos := s.buckets(tx)
+	serviceBucket, err := services.CreateBucketIfNotExists([]byte(host.Service))
+	if err != nil {
+		return err
+	}
+	if old, ok := decodeBoltEntry(serviceBucket.Get(key), time.Time{}); ok {
+		if err = s.deleteRepoEntry(repos, old); err != nil {
+			return err
+		}
+		if err = s.unindex(tx, old, changedTerms(old, host)); err != nil {
+			return err
+		}
+	}
+	if err = serviceBucket.Put(key, encodeBoltEntry(expires, bs)); err != nil {
+		return err
+	}
+	serviceIndex, err := s.indexes(tx).CreateBucketIfNotExists([]byte(host.Service))
+	if err != nil {
+		return err
+	}
+	for _, term := range indexTerms(host) {
+		termBucket, err := serviceIndex.CreateBucketIfNotExists([]byte(term))
+		if err != nil {
+			return err
+		}
+		if err = termBucket.Put(key, []byte{}); err != nil {
+			return err
+		}
+	}
+	if host.ServiceRepoName == "" {
+		return nil
+	}
+	repoBucket, err := repos.CreateBucketIfNotExists([]byte(host.ServiceRepoName))
+	if err != nil {
+		return err
+	}
+	return repoBucket.Put(boltRepoKey(host), encodeBoltEntry(expires, nil))
+}
+
+func (s *boltStorage) buckets(tx *bolt.Tx) (*bolt.Bucket, *bolt.Bucket) {
+	envBucket := tx.Bucket([]byte(BOLT_ROOT_BUCKET)).Bucket([]byte(s.env))
+	return envBucket.Bucket([]byte(BOLT_SERVICES_BUCKET)), envBucket.Bucket([]byte(BOLT_REPOS_BUCKET))
+}
+
+func (s *boltStorage) indexes(tx *bolt.Tx) *bolt.Bucket {
+	return tx.Bucket([]byte(BOLT_ROOT_BUCKET)).Bucket([]byte(s.env)).Bucket([]byte(BOLT_TERMS_BUCKET))
+}
+
+func (s *boltStorage) probes(tx *bolt.Tx) *bolt.Bucket {
+	return tx.Bucket([]byte(BOLT_ROOT_BUCKET)).Bucket([]byte(s.env)).Bucket([]byte(BOLT_PROBES_BUCKET))
+}
+
+// unindex removes host from the buckets of terms, and drops the buckets it
+// leaves empty.
+func (s *boltStorage) unindex(tx *bolt.Tx, host *Host, terms []string) error {
+	serviceIndex := s.indexes(tx).Bucket([]byte(host.Service))
+	if serviceIndex == nil {
+		return nil
+	}
+	key := []byte(hostKey(host.IpAddress, int(host.Port)))
+	for _, term := range terms {
+		termBucket := serviceIndex.Bucket([]byte(term))
+		if termBucket == nil {
+			continue
+		}
+		if err := termBucket.Delete(key); err != nil {
+			return err
+		}
+		if k, _ := termBucket.Cursor().First(); k == nil {
+			if err := serviceIndex.DeleteBucket([]byte(term)); err != nil {
+				return err
+			}
+		}
+	}
+	if k, _ := serviceIndex.Cursor().First(); k == nil {
+		return s.indexes(tx).DeleteBucket([]byte(host.Service))
+	}
+	return nil
+}
+
+func (s *boltStorage) get(services *bolt.Bucket, service, key string) *Host {
+	serviceBucket := services.Bucket([]byte(service))
+	if serviceBucket == nil {
+		return nil
+	}
+	host, ok := decodeBoltEntry(serviceBucket.Get([]byte(key)), time.Now())
+	if !ok {
+		return nil
+	}
+	return host
+}
+
+// entry returns the host stored under key along with its expiry, whether or
+// not it has expired.
+func (s *boltStorage) entry(services *bolt.Bucket, service, key string) (*Host, time.Time) {
+	serviceBucket := services.Bucket([]byte(service))
+	if serviceBucket == nil {
+		return nil, time.Time{}
+	}
+	v := serviceBucket.Get([]byte(key))
+	host, ok := decodeBoltEntry(v, time.Time{})
+	if !ok {
+		return nil, time.Time{}
+	}
+	return host, boltEntryExpires(v)
+}
+
+func (s *boltStorage) deleteRepoEntry(repos *bolt.Bucket, host *Host) error {
+	if host.ServiceRepoName == "" {
+		return nil
+	}
+	repoBucket := repos.Bucket([]byte(host.ServiceRepoName))
+	if repoBucket == nil {
+		return nil
+	}
+	if err := repoBucket.Delete(boltRepoKey(host)); err != nil {
+		return err
+	}
+	if k, _ := repoBucket.Cursor().First(); k == nil {
+		return repos.DeleteBucket([]byte(host.ServiceRepoName))
+	}
+	return nil
+}
+
+func boltRepoKey(host *Host) []byte {
+	return []byte(host.Service + BOLT_DELIMITER + hostKey(host.IpAddress, int(host.Port)))
+}
+
+func encodeBoltEntry(expires time.Time, bs []byte) []byte {
+	v := make([]byte, 8+len(bs))
+	binary.BigEndian.PutUint64(v, uint64(expires.UnixNano()))
+	copy(v[8:], bs)
+	return v
+}
+
+func boltEntryExpires(v []byte) time.Time {
+	if len(v) < 8 {
+		return time.Time{}
+	}
+	return time.Unix(0, int64(binary.BigEndian.Uint64(v)))
+}
+
+// decodeBoltEntry returns the host stored in v unless it expired before now.
+// A zero now accepts expired entries.
+func decodeBoltEntry(v []byte, now time.Time) (*Host, bool) {
+	if len(v) < 8 {
+		return nil, false
+	}
+	if !now.IsZero() && boltEntryExpires(v).Before(now) {
+		return nil, false
+	}
+	var host Host
+	if err := proto.Unmarshal(v[8:], &host); err != nil {
+		return nil, false
+	}
+	return &host, true
+}
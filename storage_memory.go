@@ -0,0 +1,316 @@
+package envoyds
+
+import (
+	"github.com/golang/protobuf/proto"
+	"sync"
+	"time"
+)
+
+// memoryStorage keeps hosts in process memory, which is enough for tests
+// and single instance deployments that can afford to lose registrations on
+// restart. Expired hosts are dropped when they are next looked at, or by a
+// periodic sweep. The keys of the hosts of each service are also indexed by
+// their filterable attributes, and its changes counted.
+type memoryStorage struct {
+	lock     *sync.Mutex
+	services map[string]map[string]*memoryEntry
+	index    map[string]map[string]map[string]bool
+	changes  map[string]uint64
+	events   *eventHub
+}
+
+type memoryEntry struct {
+	host    *Host
+	expires time.Time
+}
+
+func NewMemoryStorage() *memoryStorage {
+	s := &memoryStorage{
+		lock:     &sync.Mutex{},
+		services: make(map[string]map[string]*memoryEntry),
+		index:    make(map[string]map[string]map[string]bool),
+		changes:  make(map[string]uint64),
+		events:   newEventHub(),
+	}
+	go s.sweepPeriodically()
+	return s
+}
+
+func (s *memoryStorage) Ping() error {
+	return nil
+}
+
+// Probe has nothing to check: memory takes writes as long as the process
+// runs.
+func (s *memoryStorage) Probe() error {
+	return nil
+}
+
+func (s *memoryStorage) Put(host *Host, ttl time.Duration) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.put(host, ttl)
+	return nil
+}
+
+func (s *memoryStorage) PutAll(hosts []*Host, ttls []time.Duration) []error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for i, host := range hosts {
+		s.put(host, ttls[i])
+	}
+	return make([]error, len(hosts))
+}
+
+// put stores host for ttl. The caller must hold the lock.
+func (s *memoryStorage) put(host *Host, ttl time.Duration) {
+	key := hostKey(host.IpAddress, int(host.Port))
+	var old *Host
+	if entry := s.lookup(host.Service, key); entry != nil {
+		old = entry.host
+	}
+	hosts, ok := s.services[host.Service]
+	if !ok {
+		hosts = make(map[string]*memoryEntry)
+		s.services[host.Service] = hosts
+	}
+	hosts[key] = &memoryEntry{
+		host:    proto.Clone(host).(*Host),
+		expires: time.Now().Add(ttl),
+	}
+	s.reindex(old, host)
+	s.publish(writeEventType(old, host), host)
+}
+
+func (s *memoryStorage) Update(service, ip string, port int, update func(host *Host) error) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	entry := s.lookup(service, hostKey(ip, port))
+	if entry == nil {
+		return ErrHostNotFound
+	}
+	host := proto.Clone(entry.host).(*Host)
+	if err := update(host); err != nil {
+		return err
+	}
+	old := entry.host
+	entry.host = host
+	s.reindex(old, host)
+	s.publish(writeEventType(old, host), host)
+	return nil
+}
+
+func (s *memoryStorage) Get(service, ip string, port int) (*Host, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	entry := s.lookup(service, hostKey(ip, port))
+	if entry == nil {
+		return nil, ErrHostNotFound
+	}
+	return proto.Clone(entry.host).(*Host), nil
+}
+
+func (s *memoryStorage) List(service, ip string) ([]*Host, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	hosts := make([]*Host, 0, len(s.services[service]))
+	for key := range s.services[service] {
+		entry := s.lookup(service, key)
+		if entry == nil || (ip != "" && entry.host.IpAddress != ip) {
+			continue
+		}
+		hosts = append(hosts, proto.Clone(entry.host).(*Host))
+	}
+	return hosts, nil
+}
+
+func (s *memoryStorage) ListByRepo(repoName string) ([]*Host, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	hosts := make([]*Host, 0, REDIS_BATCH_SIZE)
+	for service, entries := range s.services {
+		for key := range entries {
+			entry := s.lookup(service, key)
+			if entry == nil || entry.host.ServiceRepoName != repoName {
+				continue
+			}
+			hosts = append(hosts, proto.Clone(entry.host).(*Host))
+		}
+	}
+	return hosts, nil
+}
+
+func (s *memoryStorage) ListMatching(service string, filter hostFilter) ([]*Host, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	// walk the smallest index and look the others up
+	var keys []string
+	terms := filter.terms()
+	for i, term := range terms {
+		if i == 0 || len(s.index[service][term]) < len(keys) {
+			keys = keys[:0]
+			for key := range s.index[service][term] {
+				keys = append(keys, key)
+			}
+		}
+	}
+	if len(terms) == 0 {
+		for key := range s.services[service] {
+			keys = append(keys, key)
+		}
+	}
+	hosts := make([]*Host, 0, len(keys))
+	for _, key := range keys {
+		matching := true
+		for _, term := range terms {
+			matching = matching && s.index[service][term][key]
+		}
+		if !matching {
+			continue
+		}
+		if entry := s.lookup(service, key); entry != nil {
+			hosts = append(hosts, proto.Clone(entry.host).(*Host))
+		}
+	}
+	return hosts, nil
+}
+
+func (s *memoryStorage) Services() ([]string, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	services := make([]string, 0, len(s.services))
+	for service, entries := range s.services {
+		for key := range entries {
+			s.lookup(service, key)
+		}
+		if len(s.services[service]) > 0 {
+			services = append(services, service)
+		}
+	}
+	return services, nil
+}
+
+func (s *memoryStorage) Delete(service, ip string, port int) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.delete(service, ip, port)
+}
+
+func (s *memoryStorage) DeleteAll(refs []hostRef) []error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	errs := make([]error, len(refs))
+	for i, ref := range refs {
+		errs[i] = s.delete(ref.service, ref.ip, ref.port)
+	}
+	return errs
+}
+
+// delete removes a host. The caller must hold the lock.
+func (s *memoryStorage) delete(service, ip string, port int) error {
+	key := hostKey(ip, port)
+	entry := s.lookup(service, key)
+	if entry == nil {
+		return ErrHostNotFound
+	}
+	s.remove(service, key)
+	s.publish(EVENT_DELETED, entry.host)
+	return nil
+}
+
+func (s *memoryStorage) Events() *eventHub {
+	return s.events
+}
+
+func (s *memoryStorage) Index(service string) (uint64, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.changes[service], nil
+}
+
+func (s *memoryStorage) sweepPeriodically() {
+	ticker := time.NewTicker(EXPIRY_SWEEP_PERIOD)
+	defer ticker.Stop()
+	for range ticker.C {
+		s.sweep()
+	}
+}
+
+// sweep removes expired hosts, so that their expiry is published even if
+// nobody looks them up.
+func (s *memoryStorage) sweep() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for service, entries := range s.services {
+		for key := range entries {
+			s.lookup(service, key)
+		}
+	}
+}
+
+// lookup returns the live entry for key, removing it if it has expired.
+// The caller must hold the lock.
+func (s *memoryStorage) lookup(service, key string) *memoryEntry {
+	entry, ok := s.services[service][key]
+	if !ok {
+		return nil
+	}
+	if time.Now().After(entry.expires) {
+		s.remove(service, key)
+		s.publish(EVENT_EXPIRED, entry.host)
+		return nil
+	}
+	return entry
+}
+
+func (s *memoryStorage) remove(service, key string) {
+	if entry, ok := s.services[service][key]; ok {
+		s.unindex(service, key, indexTerms(entry.host))
+	}
+	delete(s.services[service], key)
+	if len(s.services[service]) == 0 {
+		delete(s.services, service)
+	}
+}
+
+// reindex moves host from the index terms of old to its own. The caller must
+// hold the lock.
+func (s *memoryStorage) reindex(old, host *Host) {
+	key := hostKey(host.IpAddress, int(host.Port))
+	s.unindex(host.Service, key, changedTerms(old, host))
+	terms, ok := s.index[host.Service]
+	if !ok {
+		terms = make(map[string]map[string]bool)
+		s.index[host.Service] = terms
+	}
+	for _, term := range indexTerms(host) {
+		if terms[term] == nil {
+			terms[term] = make(map[string]bool)
+		}
+		terms[term][key] = true
+	}
+}
+
+func (s *memoryStorage) unindex(service, key string, terms []string) {
+	for _, term := range terms {
+		delete(s.index[service][term], key)
+		if len(s.index[service][term]) == 0 {
+			delete(s.index[service], term)
+		}
+	}
+	if len(s.index[service]) == 0 {
+		delete(s.index, service)
+	}
+}
+
+// publish counts a change to the service of host and hands a copy of it to
+// subscribers, unless eventType is empty. The caller must hold the lock.
+func (s *memoryStorage) publish(eventType string, host *Host) {
+	if eventType == "" {
+		return
+	}
+	s.changes[host.Service]++
+	event := newEvent(eventType, proto.Clone(host).(*Host))
+	event.Index = s.changes[host.Service]
+	s.events.Publish(event)
+}
@@ -0,0 +1,997 @@
+package envoyds
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"github.com/go-redis/redis"
+	"github.com/golang/protobuf/proto"
+	"io/ioutil"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	REDIS_V1_PREFIX    = "EYV1"
+	REDIS_V2_PREFIX    = "EYV2"
+	REDIS_SERVICE_NAME = "SERVICENAME"
+	REDIS_REPO_NAME    = "REPONAME"
+	REDIS_HOSTS        = "HOSTS"
+	REDIS_EXPIRES      = "EXPIRES"
+	REDIS_SERVICES     = "SERVICES"
+	REDIS_INDEX        = "INDEX"
+	REDIS_CHANGES      = "CHANGES"
+	REDIS_EVENTS       = "EVENTS"
+	REDIS_PROBE        = "PROBE"
+	REDIS_FIELD        = "META"
+	REDIS_DELIMITER    = ":"
+	REDIS_BATCH_SIZE   = 10
+	REDIS_TX_RETRIES   = 10
+
+	REDIS_MODE_STANDALONE = "standalone"
+	REDIS_MODE_SENTINEL   = "sentinel"
+	REDIS_MODE_CLUSTER    = "cluster"
+)
+
+// redisStorage keeps the hosts of a service in one hash, keyed by ip:port,
+// and their expiry times in a sorted set next to it, so a service is read in
+// time proportional to its own size rather than the keyspace:
+//
+//	EYV2:env:SERVICENAME:{service}:HOSTS    hash of ip:port -> Host
+//	EYV2:env:SERVICENAME:{service}:EXPIRES  zset of ip:port scored by expiry
+//	EYV2:env:SERVICENAME:{service}:INDEX:{term}  set of ip:port, e.g. for az=us-east-1a
+//	EYV2:env:SERVICENAME:{service}:CHANGES  count of changes to the service
+//	EYV2:env:REPONAME:{repo}                zset of service:ip:port scored by expiry
+//	EYV2:env:SERVICES                       zset of services scored by their last expiry
+//	EYV2:env:PROBE:{id}                     short lived key of a readiness probe
+//
+// The braces keep the keys of a service in the same cluster slot, so they can
+// be changed in one transaction. The repo and services indexes are written
+// after it, outside of any transaction, and readers check their entries
+// against the hosts they point at. Members whose expiry has passed are ignored
+// by readers, and removed on writes and by a periodic sweep of the services.
+// Index sets are intersected to filter the hosts of a service; a host leaves
+// the sets of its old terms when it is rewritten, deleted or expires.
+// Every change is counted and published on the EYV2:env:EVENTS channel, which
+// every instance subscribes to, by a script run in the transaction that makes
+// it. The count never expires, so it keeps growing once the service is gone.
+type redisStorage struct {
+	env           string
+	redis         redis.UniversalClient
+	forceV1Compat bool
+	// schemaVersion caches the layout version marked in Redis.
+	schemaVersion int32
+	events        *eventHub
+}
+
+// luaVarint defines varint(n), which encodes n like protobuf varints, for
+// scripts to add fields to the Event messages they publish.
+const luaVarint = `
+local function varint(n)
+	local bytes = ''
+	while n >= 128 do
+		bytes = bytes .. string.char(n % 128 + 128)
+		n = math.floor(n / 128)
+	end
+	return bytes .. string.char(n)
+end
+`
+
+// publishScript counts a change in KEYS[1] and publishes the Event ARGV[2] on
+// the channel ARGV[1] with the count as its index, field 4.
+var publishScript = redis.NewScript(luaVarint + `
+local index = redis.call('INCR', KEYS[1])
+redis.call('PUBLISH', ARGV[1], ARGV[2] .. '\32' .. varint(index))
+return index
+`)
+
+// expireScript removes the members of a service that expired before ARGV[1]
+// and returns the hosts they held. It counts the expiry of each host in
+// KEYS[3] and publishes it on the channel ARGV[2] as the Event ARGV[3] with
+// the host, field 2, and the count as its index, field 4.
+var expireScript = redis.NewScript(luaVarint + `
+local expired = redis.call('ZRANGEBYSCORE', KEYS[2], '-inf', ARGV[1])
+if #expired == 0 then
+	return {}
+end
+local hosts = redis.call('HMGET', KEYS[1], unpack(expired))
+redis.call('ZREMRANGEBYSCORE', KEYS[2], '-inf', ARGV[1])
+redis.call('HDEL', KEYS[1], unpack(expired))
+for _, host in ipairs(hosts) do
+	if host then
+		local index = redis.call('INCR', KEYS[3])
+		redis.call('PUBLISH', ARGV[2], ARGV[3] .. '\18' .. varint(#host) .. host .. '\32' .. varint(index))
+	end
+end
+return hosts
+`)
+
+// unindexScript removes ARGV[1] from the index sets KEYS[2..n] unless it is
+// registered again in the hosts hash KEYS[1].
+var unindexScript = redis.NewScript(`
+if redis.call('HEXISTS', KEYS[1], ARGV[1]) == 1 then
+	return 0
+end
+for i = 2, #KEYS do
+	redis.call('SREM', KEYS[i], ARGV[1])
+end
+return 0
+`)
+
+// raiseScoreScript scores ARGV[2] in KEYS[1] with ARGV[1] unless it already
+// has a higher score.
+var raiseScoreScript = redis.NewScript(`
+local score = redis.call('ZSCORE', KEYS[1], ARGV[2])
+if not score or tonumber(score) < tonumber(ARGV[1]) then
+	redis.call('ZADD', KEYS[1], ARGV[1], ARGV[2])
+end
+return 0
+`)
+
+// extendScript makes KEYS[1] live for at least ARGV[1] milliseconds without
+// ever shortening it, so that a host with a short ttl does not expire the keys
+// it shares with longer lived hosts.
+var extendScript = redis.NewScript(`
+if redis.call('PTTL', KEYS[1]) < tonumber(ARGV[1]) then
+	redis.call('PEXPIRE', KEYS[1], ARGV[1])
+end
+return 0
+`)
+
+func NewRedisStorage(c *config) (*redisStorage, error) {
+	s := &redisStorage{}
+	s.env = c.Environment
+	s.events = newEventHub()
+	s.forceV1Compat = c.RedisV1Compat
+	tlsConfig, err := newRedisTLSConfig(c)
+	if err != nil {
+		return nil, err
+	}
+	password, db, onConnect := redisAuth(c)
+	switch c.RedisMode {
+	case REDIS_MODE_STANDALONE:
+		s.redis = redis.NewClient(&redis.Options{
+			Addr:      fmt.Sprintf("%s:%d", c.RedisHost, c.RedisPort),
+			Password:  password,
+			DB:        db,
+			OnConnect: onConnect,
+			TLSConfig: tlsConfig,
+		})
+	case REDIS_MODE_SENTINEL:
+		s.redis = redis.NewFailoverClient(&redis.FailoverOptions{
+			MasterName:    c.RedisMasterName,
+			SentinelAddrs: c.RedisAddrs,
+			Password:      password,
+			DB:            db,
+			OnConnect:     onConnect,
+			TLSConfig:     tlsConfig,
+		})
+	case REDIS_MODE_CLUSTER:
+		if c.RedisDB != 0 {
+			return nil, errors.New("redis cluster only supports db 0")
+		}
+		s.redis = redis.NewClusterClient(&redis.ClusterOptions{
+			Addrs:     c.RedisAddrs,
+			Password:  password,
+			OnConnect: onConnect,
+			TLSConfig: tlsConfig,
+		})
+	default:
+		return nil, fmt.Errorf("unknown redis mode %q", c.RedisMode)
+	}
+	if err := s.Ping(); err != nil {
+		return nil, err
+	}
+	if err := s.initSchemaVersion(); err != nil {
+		return nil, err
+	}
+	go s.refreshSchemaVersionPeriodically()
+	go s.receiveEvents()
+	go s.sweepPeriodically()
+	return s, nil
+}
+
+// redisAuth returns the password, db and connection hook for the client
+// options. go-redis only sends AUTH with a password, so an ACL username is
+// authenticated from the hook instead, followed by the SELECT that go-redis
+// would otherwise send before it.
+func redisAuth(c *config) (string, int, func(*redis.Conn) error) {
+	if c.RedisUsername == "" {
+		return c.RedisPassword, c.RedisDB, nil
+	}
+	return "", 0, func(conn *redis.Conn) error {
+		if err := conn.Do("AUTH", c.RedisUsername, c.RedisPassword).Err(); err != nil {
+			return err
+		}
+		if c.RedisDB != 0 {
+			return conn.Select(c.RedisDB).Err()
+		}
+		return nil
+	}
+}
+
+func newRedisTLSConfig(c *config) (*tls.Config, error) {
+	if !c.RedisTLS {
+		return nil, nil
+	}
+	tlsConfig := &tls.Config{ServerName: c.RedisTLSServerName}
+	if c.RedisTLSCA != "" {
+		pem, err := ioutil.ReadFile(c.RedisTLSCA)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", c.RedisTLSCA)
+		}
+	}
+	if c.RedisTLSCert != "" || c.RedisTLSKey != "" {
+		cert, err := tls.LoadX509KeyPair(c.RedisTLSCert, c.RedisTLSKey)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	return tlsConfig, nil
+}
+
+func (s *redisStorage) Ping() error {
+	return s.redis.Ping().Err()
+}
+
+// Probe sets, reads and deletes a key of its own in one round trip. The key
+// expires on its own should the delete not reach Redis.
+func (s *redisStorage) Probe() error {
+	value := strconv.FormatInt(time.Now().UnixNano(), 10)
+	key := s.getProbeKey(value)
+	pipe := s.redis.Pipeline()
+	pipe.Set(key, value, time.Minute)
+	get := pipe.Get(key)
+	pipe.Del(key)
+	if _, err := pipe.Exec(); err != nil {
+		return err
+	}
+	if get.Val() != value {
+		return errProbeMismatch
+	}
+	return nil
+}
+
+func (s *redisStorage) Put(host *Host, ttl time.Duration) error {
+	bs, err := proto.Marshal(host)
+	if err != nil {
+		return err
+	}
+	if err = s.expire(host.Service, time.Now()); err != nil {
+		return err
+	}
+	member := hostKey(host.IpAddress, int(host.Port))
+	expires := time.Now().Add(ttl)
+	err = s.watchService(host.Service, func(tx *redis.Tx) error {
+		old, err := s.readHost(tx, host.Service, member)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Pipelined(func(pipe redis.Pipeliner) error {
+			for _, term := range changedTerms(old, host) {
+				pipe.SRem(s.getIndexKey(host.Service, term), member)
+			}
+			s.writeHost(pipe, host, bs, expires, ttl)
+			s.publish(pipe, writeEventType(old, host), host)
+			return nil
+		})
+		return err
+	})
+	if err == nil {
+		err = s.indexHosts([]*Host{host}, []time.Time{expires}, []time.Duration{ttl})
+	}
+	if err != nil || !s.v1Compat() {
+		return err
+	}
+	return s.putV1(host, ttl)
+}
+
+// PutAll reads what every host replaces in one pipeline and writes them all
+// in one transaction, which a cluster client splits by slot. Unlike Put it
+// does not watch the services, so a host written concurrently may keep an
+// entry in an index it no longer belongs to, which readers check for anyway.
+// The older layout has no bulk writes, so hosts are put one by one in compat
+// mode.
+func (s *redisStorage) PutAll(hosts []*Host, ttls []time.Duration) []error {
+	if s.v1Compat() {
+		errs := make([]error, len(hosts))
+		for i, host := range hosts {
+			errs[i] = s.Put(host, ttls[i])
+		}
+		return errs
+	}
+	values := make([][]byte, len(hosts))
+	refs := make([]hostRef, len(hosts))
+	var services []string
+	seen := make(map[string]bool)
+	for i, host := range hosts {
+		bs, err := proto.Marshal(host)
+		if err != nil {
+			return allErrors(len(hosts), err)
+		}
+		values[i] = bs
+		refs[i] = hostRef{service: host.Service, ip: host.IpAddress, port: int(host.Port)}
+		if !seen[host.Service] {
+			seen[host.Service] = true
+			services = append(services, host.Service)
+		}
+	}
+	now := time.Now()
+	expires := make([]time.Time, len(hosts))
+	for i := range hosts {
+		expires[i] = now.Add(ttls[i])
+	}
+	if err := s.expireAll(services, now); err != nil {
+		return allErrors(len(hosts), err)
+	}
+	olds, err := s.readHosts(refs)
+	if err != nil {
+		return allErrors(len(hosts), err)
+	}
+	_, err = s.redis.TxPipelined(func(pipe redis.Pipeliner) error {
+		for i, host := range hosts {
+			member := hostKey(host.IpAddress, int(host.Port))
+			for _, term := range changedTerms(olds[i], host) {
+				pipe.SRem(s.getIndexKey(host.Service, term), member)
+			}
+			s.writeHost(pipe, host, values[i], expires[i], ttls[i])
+			s.publish(pipe, writeEventType(olds[i], host), host)
+		}
+		return nil
+	})
+	if err == nil {
+		err = s.indexHosts(hosts, expires, ttls)
+	}
+	return allErrors(len(hosts), err)
+}
+
+// putV2 writes host without looking at what it replaces or publishing an
+// event, to copy hosts between layouts.
+func (s *redisStorage) putV2(host *Host, ttl time.Duration) error {
+	bs, err := proto.Marshal(host)
+	if err != nil {
+		return err
+	}
+	expires := time.Now().Add(ttl)
+	_, err = s.redis.TxPipelined(func(pipe redis.Pipeliner) error {
+		s.writeHost(pipe, host, bs, expires, ttl)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return s.indexHosts([]*Host{host}, []time.Time{expires}, []time.Duration{ttl})
+}
+
+// Update reads the expiry of the host along with it, and writes it back.
+func (s *redisStorage) Update(service, ip string, port int, update func(host *Host) error) error {
+	var (
+		updated *Host
+		expires time.Time
+	)
+	member := hostKey(ip, port)
+	err := s.watchService(service, func(tx *redis.Tx) error {
+		host, hostExpires, err := s.readEntry(tx, service, member)
+		if err != nil {
+			return err
+		}
+		if host == nil && s.v1Compat() {
+			if host, err = s.getV1(service, ip, port); err != nil {
+				return err
+			}
+			ttl, err := s.redis.PTTL(s.getServiceKey(service, ip, port)).Result()
+			if err != nil {
+				return err
+			}
+			if ttl <= 0 {
+				return ErrHostNotFound
+			}
+			hostExpires = time.Now().Add(ttl)
+		}
+		if host == nil {
+			return ErrHostNotFound
+		}
+		expires = hostExpires
+		old := proto.Clone(host).(*Host)
+		if err = update(host); err != nil {
+			return err
+		}
+		bs, err := proto.Marshal(host)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Pipelined(func(pipe redis.Pipeliner) error {
+			for _, term := range changedTerms(old, host) {
+				pipe.SRem(s.getIndexKey(service, term), member)
+			}
+			s.writeHost(pipe, host, bs, expires, time.Until(expires))
+			s.publish(pipe, writeEventType(old, host), host)
+			return nil
+		})
+		updated = host
+		return err
+	})
+	if err == nil {
+		err = s.indexHosts([]*Host{updated}, []time.Time{expires}, []time.Duration{time.Until(expires)})
+	}
+	if err != nil || !s.v1Compat() {
+		return err
+	}
+	return s.putV1(updated, time.Until(expires))
+}
+
+func (s *redisStorage) Get(service, ip string, port int) (*Host, error) {
+	hosts, err := s.getHosts(service, []string{hostKey(ip, port)})
+	if err != nil {
+		return nil, err
+	}
+	if len(hosts) == 0 {
+		if s.v1Compat() {
+			return s.getV1(service, ip, port)
+		}
+		return nil, ErrHostNotFound
+	}
+	return hosts[0], nil
+}
+
+func (s *redisStorage) List(service, ip string) ([]*Host, error) {
+	members, err := s.redis.ZRangeByScore(s.getExpiresKey(service), redis.ZRangeBy{
+		Min: strconv.FormatFloat(redisScore(time.Now()), 'f', -1, 64),
+		Max: "+inf",
+	}).Result()
+	if err != nil {
+		return nil, err
+	}
+	if ip != "" {
+		matching := members[:0]
+		for _, member := range members {
+			if strings.HasPrefix(member, ip+REDIS_DELIMITER) {
+				matching = append(matching, member)
+			}
+		}
+		members = matching
+	}
+	hosts, err := s.getHosts(service, members)
+	if err == nil && s.v1Compat() {
+		var hostsV1 []*Host
+		hostsV1, err = s.listV1(service, ip)
+		hosts = mergeHosts(hosts, hostsV1)
+	}
+	return hostsOn(ip, hosts), err
+}
+
+func (s *redisStorage) ListByRepo(repoName string) ([]*Host, error) {
+	members, err := s.redis.ZRangeByScore(s.getRepoIndexKey(repoName), redis.ZRangeBy{
+		Min: strconv.FormatFloat(redisScore(time.Now()), 'f', -1, 64),
+		Max: "+inf",
+	}).Result()
+	if err != nil {
+		return nil, err
+	}
+	byService := make(map[string][]string)
+	for _, member := range members {
+		parts := strings.SplitN(member, REDIS_DELIMITER, 2)
+		if len(parts) == 2 {
+			byService[parts[0]] = append(byService[parts[0]], parts[1])
+		}
+	}
+	hosts := make([]*Host, 0, len(members))
+	for service, serviceMembers := range byService {
+		serviceHosts, err := s.getHosts(service, serviceMembers)
+		if err != nil {
+			return hosts, err
+		}
+		for _, host := range serviceHosts {
+			if host.ServiceRepoName == repoName {
+				hosts = append(hosts, host)
+			}
+		}
+	}
+	if !s.v1Compat() {
+		return hosts, nil
+	}
+	hostsV1, err := s.listByRepoV1(repoName)
+	return mergeHosts(hosts, hostsV1), err
+}
+
+// ListMatching intersects the index sets of the terms of filter, and checks
+// the hosts they point at against it, since a set may keep a host that
+// expired until its removal completes.
+func (s *redisStorage) ListMatching(service string, filter hostFilter) ([]*Host, error) {
+	terms := filter.terms()
+	if len(terms) == 0 {
+		return s.List(service, "")
+	}
+	keys := make([]string, len(terms))
+	for i, term := range terms {
+		keys[i] = s.getIndexKey(service, term)
+	}
+	members, err := s.redis.SInter(keys...).Result()
+	if err != nil {
+		return nil, err
+	}
+	candidates, err := s.getHosts(service, members)
+	if err != nil {
+		return nil, err
+	}
+	if s.v1Compat() {
+		// the older layout has no indexes
+		hostsV1, err := s.listV1(service, "")
+		if err != nil {
+			return nil, err
+		}
+		candidates = mergeHosts(candidates, hostsV1)
+	}
+	hosts := candidates[:0]
+	for _, host := range candidates {
+		if filter.matches(host) {
+			hosts = append(hosts, host)
+		}
+	}
+	return hosts, nil
+}
+
+// Services reads the services whose last expiry has not passed, and keeps
+// those that still have hosts, since the index is not updated on deletes.
+func (s *redisStorage) Services() ([]string, error) {
+	now := strconv.FormatFloat(redisScore(time.Now()), 'f', -1, 64)
+	candidates, err := s.redis.ZRangeByScore(s.getServicesKey(), redis.ZRangeBy{Min: now, Max: "+inf"}).Result()
+	if err != nil {
+		return nil, err
+	}
+	services := make([]string, 0, len(candidates))
+	if len(candidates) > 0 {
+		pipe := s.redis.Pipeline()
+		counts := make([]*redis.IntCmd, len(candidates))
+		for i, service := range candidates {
+			counts[i] = pipe.ZCount(s.getExpiresKey(service), now, "+inf")
+		}
+		if _, err = pipe.Exec(); err != nil {
+			return nil, err
+		}
+		for i, service := range candidates {
+			if counts[i].Val() > 0 {
+				services = append(services, service)
+			}
+		}
+	}
+	if !s.v1Compat() {
+		return services, nil
+	}
+	servicesV1, err := s.servicesV1()
+	if err != nil {
+		return services, err
+	}
+	seen := make(map[string]bool, len(services))
+	for _, service := range services {
+		seen[service] = true
+	}
+	for _, service := range servicesV1 {
+		if !seen[service] {
+			seen[service] = true
+			services = append(services, service)
+		}
+	}
+	return services, nil
+}
+
+func (s *redisStorage) Delete(service, ip string, port int) error {
+	var (
+		errV1 error
+	)
+	if s.v1Compat() {
+		errV1 = s.deleteV1(service, ip, port)
+		if errV1 != nil && errV1 != ErrHostNotFound {
+			return errV1
+		}
+	}
+	member := hostKey(ip, port)
+	err := s.watchService(service, func(tx *redis.Tx) error {
+		host, err := s.readHost(tx, service, member)
+		if err != nil {
+			return err
+		}
+		if host == nil {
+			return ErrHostNotFound
+		}
+		_, err = tx.Pipelined(func(pipe redis.Pipeliner) error {
+			s.deleteHost(pipe, host)
+			return nil
+		})
+		return err
+	})
+	if err == ErrHostNotFound && s.v1Compat() {
+		if errV1 == nil {
+			// only an instance of an older release knew the host
+			s.publish(s.redis, EVENT_DELETED, &Host{Service: service, IpAddress: ip, Port: int32(port)})
+		}
+		return errV1
+	}
+	return err
+}
+
+// DeleteAll reads the hosts in one pipeline and deletes those registered in
+// one transaction, without watching them like Delete. Hosts are deleted one
+// by one in compat mode.
+func (s *redisStorage) DeleteAll(refs []hostRef) []error {
+	if s.v1Compat() {
+		errs := make([]error, len(refs))
+		for i, ref := range refs {
+			errs[i] = s.Delete(ref.service, ref.ip, ref.port)
+		}
+		return errs
+	}
+	hosts, err := s.readHosts(refs)
+	if err != nil {
+		return allErrors(len(refs), err)
+	}
+	errs := make([]error, len(refs))
+	deleted := make(map[string]bool)
+	for i, host := range hosts {
+		if host == nil || deleted[host.Service+REDIS_DELIMITER+hostKey(host.IpAddress, int(host.Port))] {
+			errs[i] = ErrHostNotFound
+			continue
+		}
+		deleted[host.Service+REDIS_DELIMITER+hostKey(host.IpAddress, int(host.Port))] = true
+	}
+	if len(deleted) == 0 {
+		return errs
+	}
+	_, err = s.redis.TxPipelined(func(pipe redis.Pipeliner) error {
+		for i, host := range hosts {
+			if errs[i] == nil {
+				s.deleteHost(pipe, host)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return allErrors(len(refs), err)
+	}
+	return errs
+}
+
+// deleteHost queues the removal of host from the keys of its service, and
+// the publication of its deletion. Its entry in the repo index, which lives
+// in another slot, is left to expire.
+func (s *redisStorage) deleteHost(pipe redis.Pipeliner, host *Host) {
+	member := hostKey(host.IpAddress, int(host.Port))
+	pipe.HDel(s.getHostsKey(host.Service), member)
+	pipe.ZRem(s.getExpiresKey(host.Service), member)
+	for _, term := range indexTerms(host) {
+		pipe.SRem(s.getIndexKey(host.Service, term), member)
+	}
+	s.publish(pipe, EVENT_DELETED, host)
+}
+
+func (s *redisStorage) Events() *eventHub {
+	return s.events
+}
+
+// receiveEvents hands the events published by every instance to the
+// subscribers of this one.
+func (s *redisStorage) receiveEvents() {
+	pubsub := s.redis.Subscribe(s.getEventsKey())
+	defer pubsub.Close()
+	for message := range pubsub.Channel() {
+		var event Event
+		if err := proto.Unmarshal([]byte(message.Payload), &event); err != nil {
+			log.Println(err)
+			continue
+		}
+		s.events.Publish(&event)
+	}
+}
+
+// publish queues the count and publication of an event on host unless
+// eventType is empty.
+func (s *redisStorage) publish(c redis.Cmdable, eventType string, host *Host) {
+	if eventType == "" {
+		return
+	}
+	bs, err := proto.Marshal(newEvent(eventType, host))
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	publishScript.Eval(c, []string{s.getChangesKey(host.Service)}, s.getEventsKey(), bs)
+}
+
+func (s *redisStorage) Index(service string) (uint64, error) {
+	index, err := s.redis.Get(s.getChangesKey(service)).Uint64()
+	if err == redis.Nil {
+		return 0, nil
+	}
+	return index, err
+}
+
+func (s *redisStorage) sweepPeriodically() {
+	ticker := time.NewTicker(EXPIRY_SWEEP_PERIOD)
+	defer ticker.Stop()
+	for range ticker.C {
+		if err := s.sweep(); err != nil {
+			log.Println(err)
+		}
+	}
+}
+
+// sweep removes the expired hosts of every service, and then forgets the
+// services whose hosts had all expired before it started.
+func (s *redisStorage) sweep() error {
+	now := time.Now()
+	services, err := s.redis.ZRange(s.getServicesKey(), 0, -1).Result()
+	if err != nil {
+		return err
+	}
+	for _, service := range services {
+		if err = s.expire(service, now); err != nil {
+			return err
+		}
+	}
+	return s.redis.ZRemRangeByScore(s.getServicesKey(), "-inf", strconv.FormatFloat(redisScore(now), 'f', -1, 64)).Err()
+}
+
+// expire removes the hosts of service that expired before now and publishes
+// their expiry. The removal is atomic, so each expiry is counted and
+// published once however many instances sweep at the same time. The hosts leave the index
+// sets afterwards, unless they registered again in the meantime.
+func (s *redisStorage) expire(service string, now time.Time) error {
+	return s.expireAll([]string{service}, now)
+}
+
+// expireAll expires the hosts of each of services like expire, in one
+// pipeline for all of them.
+func (s *redisStorage) expireAll(services []string, now time.Time) error {
+	// the scripts add the host and index of each expiry to the event
+	event, err := proto.Marshal(newEvent(EVENT_EXPIRED, nil))
+	if err != nil {
+		return err
+	}
+	pipe := s.redis.Pipeline()
+	results := make([]*redis.Cmd, len(services))
+	for i, service := range services {
+		keys := []string{s.getHostsKey(service), s.getExpiresKey(service), s.getChangesKey(service)}
+		results[i] = expireScript.Eval(pipe, keys, redisScore(now), s.getEventsKey(), event)
+	}
+	if _, err := pipe.Exec(); err != nil {
+		return err
+	}
+	pipe = s.redis.Pipeline()
+	queued := false
+	for i, service := range services {
+		expired, _ := results[i].Val().([]interface{})
+		for _, value := range expired {
+			bs, ok := value.(string)
+			if !ok {
+				continue
+			}
+			var host Host
+			if err := proto.Unmarshal([]byte(bs), &host); err != nil {
+				log.Println(err)
+				continue
+			}
+			keys := []string{s.getHostsKey(service)}
+			for _, term := range indexTerms(&host) {
+				keys = append(keys, s.getIndexKey(service, term))
+			}
+			unindexScript.Eval(pipe, keys, hostKey(host.IpAddress, int(host.Port)))
+			queued = true
+		}
+	}
+	if !queued {
+		return nil
+	}
+	_, err = pipe.Exec()
+	return err
+}
+
+// watchService runs fn with the keys of service watched, so that the
+// transaction it ends with fails if another client wrote the service in the
+// meantime. fn is retried until it runs without interference.
+func (s *redisStorage) watchService(service string, fn func(tx *redis.Tx) error) error {
+	for i := 0; i < REDIS_TX_RETRIES; i++ {
+		err := s.redis.Watch(fn, s.getHostsKey(service), s.getExpiresKey(service))
+		if err != redis.TxFailedErr {
+			return err
+		}
+	}
+	return fmt.Errorf("service %s is being updated concurrently, try again", service)
+}
+
+// writeHost queues the writes registering host until expires to the keys of
+// its service, which share a cluster slot and so can be written in one
+// transaction. The indexes across services are written by indexHosts.
+func (s *redisStorage) writeHost(pipe redis.Pipeliner, host *Host, bs []byte, expires time.Time, ttl time.Duration) {
+	member := hostKey(host.IpAddress, int(host.Port))
+	hostsKey, expiresKey := s.getHostsKey(host.Service), s.getExpiresKey(host.Service)
+	pipe.HSet(hostsKey, member, bs)
+	pipe.ZAdd(expiresKey, redis.Z{Score: redisScore(expires), Member: member})
+	keys := []string{hostsKey, expiresKey}
+	for _, term := range indexTerms(host) {
+		indexKey := s.getIndexKey(host.Service, term)
+		pipe.SAdd(indexKey, member)
+		keys = append(keys, indexKey)
+	}
+	for _, key := range keys {
+		extendScript.Eval(pipe, []string{key}, int64(ttl/time.Millisecond))
+	}
+}
+
+// indexHosts adds hosts, each written until its expiry, to the repo and
+// services indexes. These live in other slots than the services, so they are
+// written in a plain pipeline once the transaction writing the hosts has
+// succeeded. Should it fail, a host is missing from them until it registers
+// again.
+//
+// Entries are never removed from the repo index when a host moves to another
+// repo or is deleted, since that could race with the host being added back;
+// readers skip them, and they are dropped once expired.
+func (s *redisStorage) indexHosts(hosts []*Host, expires []time.Time, ttls []time.Duration) error {
+	now := strconv.FormatFloat(redisScore(time.Now()), 'f', -1, 64)
+	pipe := s.redis.Pipeline()
+	for i, host := range hosts {
+		score := redisScore(expires[i])
+		if host.ServiceRepoName != "" {
+			repoKey := s.getRepoIndexKey(host.ServiceRepoName)
+			pipe.ZRemRangeByScore(repoKey, "-inf", "("+now)
+			pipe.ZAdd(repoKey, redis.Z{Score: score, Member: host.Service + REDIS_DELIMITER + hostKey(host.IpAddress, int(host.Port))})
+			extendScript.Eval(pipe, []string{repoKey}, int64(ttls[i]/time.Millisecond))
+		}
+		raiseScoreScript.Eval(pipe, []string{s.getServicesKey()}, int64(score), host.Service)
+	}
+	_, err := pipe.Exec()
+	return err
+}
+
+// readHost returns the host stored as member of service, or nil if it is
+// missing or expired. It issues plain commands rather than a pipeline so it
+// can run inside a WATCH.
+func (s *redisStorage) readHost(c redis.Cmdable, service, member string) (*Host, error) {
+	host, _, err := s.readEntry(c, service, member)
+	return host, err
+}
+
+// readEntry reads a host like readHost, along with its expiry.
+func (s *redisStorage) readEntry(c redis.Cmdable, service, member string) (*Host, time.Time, error) {
+	bs, err := c.HGet(s.getHostsKey(service), member).Result()
+	if err == redis.Nil {
+		return nil, time.Time{}, nil
+	}
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	score, err := c.ZScore(s.getExpiresKey(service), member).Result()
+	if err == redis.Nil || (err == nil && score < redisScore(time.Now())) {
+		return nil, time.Time{}, nil
+	}
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	var host Host
+	if err = proto.Unmarshal([]byte(bs), &host); err != nil {
+		return nil, time.Time{}, err
+	}
+	return &host, time.Unix(0, int64(score)*int64(time.Millisecond)), nil
+}
+
+// readHosts returns the host named by each of refs, or nil where it is
+// missing or expired, in one pipeline.
+func (s *redisStorage) readHosts(refs []hostRef) ([]*Host, error) {
+	hosts := make([]*Host, len(refs))
+	if len(refs) == 0 {
+		return hosts, nil
+	}
+	pipe := s.redis.Pipeline()
+	values := make([]*redis.StringCmd, len(refs))
+	scores := make([]*redis.FloatCmd, len(refs))
+	for i, ref := range refs {
+		member := hostKey(ref.ip, ref.port)
+		values[i] = pipe.HGet(s.getHostsKey(ref.service), member)
+		scores[i] = pipe.ZScore(s.getExpiresKey(ref.service), member)
+	}
+	if _, err := pipe.Exec(); err != nil && err != redis.Nil {
+		return nil, err
+	}
+	now := redisScore(time.Now())
+	for i := range refs {
+		bs, err := values[i].Result()
+		if err != nil || scores[i].Err() != nil || scores[i].Val() < now {
+			continue
+		}
+		var host Host
+		if err = proto.Unmarshal([]byte(bs), &host); err != nil {
+			return nil, err
+		}
+		hosts[i] = &host
+	}
+	return hosts, nil
+}
+
+// getHosts returns the hosts among members of service that have not expired.
+func (s *redisStorage) getHosts(service string, members []string) ([]*Host, error) {
+	hosts := make([]*Host, 0, len(members))
+	if len(members) == 0 {
+		return hosts, nil
+	}
+	pipe := s.redis.Pipeline()
+	values := pipe.HMGet(s.getHostsKey(service), members...)
+	scores := make([]*redis.FloatCmd, len(members))
+	for i, member := range members {
+		scores[i] = pipe.ZScore(s.getExpiresKey(service), member)
+	}
+	if _, err := pipe.Exec(); err != nil && err != redis.Nil {
+		return hosts, err
+	}
+	now := redisScore(time.Now())
+	for i, value := range values.Val() {
+		bs, ok := value.(string)
+		if !ok || scores[i].Val() < now {
+			continue
+		}
+		var host Host
+		if err := proto.Unmarshal([]byte(bs), &host); err != nil {
+			return hosts, err
+		}
+		hosts = append(hosts, &host)
+	}
+	return hosts, nil
+}
+
+func (s *redisStorage) getHostsKey(serviceName string) string {
+	return strings.Join([]string{REDIS_V2_PREFIX, s.env, REDIS_SERVICE_NAME, "{" + serviceName + "}", REDIS_HOSTS}, REDIS_DELIMITER)
+}
+
+func (s *redisStorage) getExpiresKey(serviceName string) string {
+	return strings.Join([]string{REDIS_V2_PREFIX, s.env, REDIS_SERVICE_NAME, "{" + serviceName + "}", REDIS_EXPIRES}, REDIS_DELIMITER)
+}
+
+func (s *redisStorage) getIndexKey(serviceName, term string) string {
+	return strings.Join([]string{REDIS_V2_PREFIX, s.env, REDIS_SERVICE_NAME, "{" + serviceName + "}", REDIS_INDEX, term}, REDIS_DELIMITER)
+}
+
+func (s *redisStorage) getChangesKey(serviceName string) string {
+	return strings.Join([]string{REDIS_V2_PREFIX, s.env, REDIS_SERVICE_NAME, "{" + serviceName + "}", REDIS_CHANGES}, REDIS_DELIMITER)
+}
+
+func (s *redisStorage) getServicesKey() string {
+	return strings.Join([]string{REDIS_V2_PREFIX, s.env, REDIS_SERVICES}, REDIS_DELIMITER)
+}
+
+func (s *redisStorage) getEventsKey() string {
+	return strings.Join([]string{REDIS_V2_PREFIX, s.env, REDIS_EVENTS}, REDIS_DELIMITER)
+}
+
+func (s *redisStorage) getProbeKey(id string) string {
+	return strings.Join([]string{REDIS_V2_PREFIX, s.env, REDIS_PROBE, id}, REDIS_DELIMITER)
+}
+
+func (s *redisStorage) getRepoIndexKey(repoName string) string {
+	return strings.Join([]string{REDIS_V2_PREFIX, s.env, REDIS_REPO_NAME, "{" + repoName + "}"}, REDIS_DELIMITER)
+}
+
+// redisScore converts an expiry time into a sorted set score in milliseconds.
+func redisScore(t time.Time) float64 {
+	return float64(t.UnixNano() / int64(time.Millisecond))
+}
+
+// mergeHosts appends the hosts of others that are not already in hosts.
+func mergeHosts(hosts, others []*Host) []*Host {
+	seen := make(map[string]bool, len(hosts))
+	for _, host := range hosts {
+		seen[host.Service+REDIS_DELIMITER+hostKey(host.IpAddress, int(host.Port))] = true
+	}
+	for _, host := range others {
+		if !seen[host.Service+REDIS_DELIMITER+hostKey(host.IpAddress, int(host.Port))] {
+			hosts = append(hosts, host)
+		}
+	}
+	return hosts
+}
@@ -0,0 +1,157 @@
+package envoyds
+
+import (
+	"fmt"
+	"github.com/go-redis/redis"
+	"log"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	REDIS_SCHEMA_PREFIX = "EYSCHEMA"
+	// REDIS_SCHEMA_VERSION is the layout written by this release.
+	REDIS_SCHEMA_VERSION        = 2
+	REDIS_SCHEMA_REFRESH_PERIOD = time.Second * 30
+)
+
+// Migrator is implemented by storages whose layout changes between releases.
+type Migrator interface {
+	// SchemaVersion returns the layout version the stored data is marked with.
+	SchemaVersion() (int, error)
+	// Migrate rewrites the stored data into the current layout while
+	// instances keep serving, and marks it with the current version.
+	Migrate() error
+}
+
+// redisMigrations upgrade the data marked with a version to the next one.
+var redisMigrations = map[int]func(s *redisStorage) error{
+	1: (*redisStorage).migrateV1ToV2,
+}
+
+// v1Compat reports whether the EYV1 layout is read and written next to the
+// current one: either until the data has been migrated, or while instances
+// of releases that only know EYV1 are still running.
+func (s *redisStorage) v1Compat() bool {
+	return s.forceV1Compat || atomic.LoadInt32(&s.schemaVersion) < 2
+}
+
+func (s *redisStorage) SchemaVersion() (int, error) {
+	version, err := s.redis.Get(s.getSchemaKey()).Int64()
+	if err == redis.Nil {
+		return 0, nil
+	}
+	return int(version), err
+}
+
+func (s *redisStorage) Migrate() error {
+	version, err := s.SchemaVersion()
+	if err != nil {
+		return err
+	}
+	for ; version < REDIS_SCHEMA_VERSION; version++ {
+		migrate, ok := redisMigrations[version]
+		if !ok {
+			return fmt.Errorf("cannot migrate redis schema version %d", version)
+		}
+		log.Printf("Migrate redis schema from version %d to %d\n", version, version+1)
+		if err = migrate(s); err != nil {
+			return err
+		}
+		if err = s.redis.Set(s.getSchemaKey(), version+1, 0).Err(); err != nil {
+			return err
+		}
+	}
+	atomic.StoreInt32(&s.schemaVersion, int32(version))
+	return nil
+}
+
+// initSchemaVersion marks unmarked data: with version 1 if EYV1 keys exist,
+// since they predate the marker, and with the current version otherwise.
+func (s *redisStorage) initSchemaVersion() error {
+	version, err := s.SchemaVersion()
+	if err != nil {
+		return err
+	}
+	if version == 0 {
+		keys, err := s.scanKeys(strings.Join([]string{REDIS_V1_PREFIX, s.env, "*"}, REDIS_DELIMITER))
+		if err != nil {
+			return err
+		}
+		version = REDIS_SCHEMA_VERSION
+		if len(keys) > 0 {
+			version = 1
+		}
+		if err = s.redis.SetNX(s.getSchemaKey(), version, 0).Err(); err != nil {
+			return err
+		}
+		if version, err = s.SchemaVersion(); err != nil {
+			return err
+		}
+	}
+	if version > REDIS_SCHEMA_VERSION {
+		return fmt.Errorf("redis schema version %d is newer than %d supported by this release", version, REDIS_SCHEMA_VERSION)
+	}
+	atomic.StoreInt32(&s.schemaVersion, int32(version))
+	return nil
+}
+
+// refreshSchemaVersionPeriodically picks up migrations run by another process.
+func (s *redisStorage) refreshSchemaVersionPeriodically() {
+	ticker := time.NewTicker(REDIS_SCHEMA_REFRESH_PERIOD)
+	defer ticker.Stop()
+	for range ticker.C {
+		version, err := s.SchemaVersion()
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+		atomic.StoreInt32(&s.schemaVersion, int32(version))
+	}
+}
+
+// migrateV1ToV2 copies every EYV1 host that is not yet in the EYV2 layout,
+// keeping its remaining ttl. Instances keep reading and writing both layouts
+// until the marker is moved to version 2, so nothing registered meanwhile
+// is missed.
+func (s *redisStorage) migrateV1ToV2() error {
+	serviceKeys, err := s.scanKeys(strings.Join([]string{REDIS_V1_PREFIX, s.env, REDIS_SERVICE_NAME, "*"}, REDIS_DELIMITER))
+	if err != nil {
+		return err
+	}
+	c := 0
+	for _, serviceKey := range serviceKeys {
+		var host Host
+		if err = s.read(serviceKey, &host); err == redis.Nil {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		ttl, err := s.redis.PTTL(serviceKey).Result()
+		if err != nil {
+			return err
+		}
+		if ttl <= 0 {
+			continue
+		}
+		existing, err := s.readHost(s.redis, host.Service, hostKey(host.IpAddress, int(host.Port)))
+		if err != nil {
+			return err
+		}
+		if existing != nil {
+			continue
+		}
+		if err = s.putV2(&host, ttl); err != nil {
+			return err
+		}
+		c++
+	}
+	log.Printf("Migrated %d of %d EYV1 hosts\n", c, len(serviceKeys))
+	return nil
+}
+
+func (s *redisStorage) getSchemaKey() string {
+	return strings.Join([]string{REDIS_SCHEMA_PREFIX, s.env}, REDIS_DELIMITER)
+}
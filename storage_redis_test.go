@@ -0,0 +1,507 @@
+package envoyds
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/alicebob/miniredis/v2/server"
+	"io/ioutil"
+	"math/big"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+const TEST_REDIS_ENV = "test"
+
+// newTestRedisConfig returns the config of a standalone storage on r.
+func newTestRedisConfig(r *miniredis.Miniredis) *config {
+	c := &config{
+		Environment: TEST_REDIS_ENV,
+		Storage:     STORAGE_REDIS,
+		RedisMode:   REDIS_MODE_STANDALONE,
+		RedisHost:   r.Host(),
+	}
+	c.RedisPort, _ = strconv.Atoi(r.Port())
+	return c
+}
+
+func newTestRedisStorage(t *testing.T, c *config) *redisStorage {
+	s, err := NewRedisStorage(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestRedisInitSchemaVersion(t *testing.T) {
+	r := miniredis.RunT(t)
+	schemaKey := REDIS_SCHEMA_PREFIX + REDIS_DELIMITER + TEST_REDIS_ENV
+
+	// new data is marked with the current version
+	s := newTestRedisStorage(t, newTestRedisConfig(r))
+	if version, _ := r.Get(schemaKey); version != strconv.Itoa(REDIS_SCHEMA_VERSION) || s.v1Compat() {
+		t.Fatalf("got version %q and v1 compat %t, want version %d without v1 compat", version, s.v1Compat(), REDIS_SCHEMA_VERSION)
+	}
+
+	// data of an older release predates the marker
+	r.FlushAll()
+	r.HSet((&redisStorage{env: TEST_REDIS_ENV}).getServiceKey("svc", "10.0.0.1", 80), REDIS_FIELD, "")
+	s = newTestRedisStorage(t, newTestRedisConfig(r))
+	if version, _ := r.Get(schemaKey); version != "1" || !s.v1Compat() {
+		t.Fatalf("got version %q and v1 compat %t, want version 1 with v1 compat", version, s.v1Compat())
+	}
+
+	// a marker is never changed but by a migration
+	r.FlushAll()
+	r.Set(schemaKey, "1")
+	if s = newTestRedisStorage(t, newTestRedisConfig(r)); !s.v1Compat() {
+		t.Fatal("got no v1 compat for data marked with version 1")
+	}
+	if version, _ := r.Get(schemaKey); version != "1" {
+		t.Fatalf("got version %q, want version 1", version)
+	}
+
+	// the environments of a redis are marked apart
+	c := newTestRedisConfig(r)
+	c.Environment = "other"
+	if s = newTestRedisStorage(t, c); s.v1Compat() {
+		t.Fatal("got v1 compat for an environment without data")
+	}
+
+	r.Set(schemaKey, strconv.Itoa(REDIS_SCHEMA_VERSION+1))
+	if _, err := NewRedisStorage(newTestRedisConfig(r)); err == nil {
+		t.Fatalf("got no error for version %d, want an error", REDIS_SCHEMA_VERSION+1)
+	}
+}
+
+func TestRedisMigrateV1ToV2(t *testing.T) {
+	r := miniredis.RunT(t)
+	r.Set(REDIS_SCHEMA_PREFIX+REDIS_DELIMITER+TEST_REDIS_ENV, "1")
+	s := newTestRedisStorage(t, newTestRedisConfig(r))
+
+	// hosts of an older release are only in the EYV1 layout
+	hosts := []*Host{
+		{Service: "svc", IpAddress: "10.0.0.1", Port: 80, ServiceRepoName: "repo", Revision: "a", Tags: &Tags{Az: "r1a"}},
+		{Service: "svc", IpAddress: "10.0.0.2", Port: 80, ServiceRepoName: "repo", Revision: "a"},
+		{Service: "other", IpAddress: "10.0.0.3", Port: 80, Revision: "b"},
+	}
+	for _, host := range hosts {
+		if err := s.putV1(host, time.Minute); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// a host already in the EYV2 layout is kept as it is
+	registered := &Host{Service: "svc", IpAddress: "10.0.0.2", Port: 80, ServiceRepoName: "repo", Revision: "c"}
+	if err := s.putV2(registered, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	// a host without a ttl is not copied
+	if err := s.putV1(&Host{Service: "svc", IpAddress: "10.0.0.4", Port: 80}, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	s.redis.Persist(s.getServiceKey("svc", "10.0.0.4", 80))
+
+	if err := s.Migrate(); err != nil {
+		t.Fatal(err)
+	}
+	if version, err := s.SchemaVersion(); err != nil || version != 2 || s.v1Compat() {
+		t.Fatalf("got version %d and v1 compat %t, want version 2 without v1 compat", version, s.v1Compat())
+	}
+
+	svc, err := s.List("svc", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	revisions := make(map[string]string)
+	for _, host := range svc {
+		revisions[host.IpAddress] = host.Revision
+	}
+	if len(svc) != 2 || revisions["10.0.0.1"] != "a" || revisions["10.0.0.2"] != "c" {
+		t.Fatalf("got %v, want 10.0.0.1 migrated and 10.0.0.2 kept", svc)
+	}
+	if ttl := r.TTL(s.getHostsKey("svc")); ttl <= 0 || ttl > time.Minute {
+		t.Fatalf("got ttl %s, want the remaining ttl of the hosts", ttl)
+	}
+	// migrated hosts are indexed like registered ones
+	matching, err := s.ListMatching("svc", hostFilter{az: "r1a"})
+	if err != nil || len(matching) != 1 || matching[0].IpAddress != "10.0.0.1" {
+		t.Fatalf("got %v, %v in az r1a, want 10.0.0.1", matching, err)
+	}
+	repo, err := s.ListByRepo("repo")
+	if err != nil || len(repo) != 2 {
+		t.Fatalf("got %v, %v in repo, want %d hosts", repo, err, 2)
+	}
+	services, err := s.Services()
+	if err != nil || len(services) != 2 {
+		t.Fatalf("got services %v, %v, want %d services", services, err, 2)
+	}
+
+	// migrating again has nothing to do
+	if err = s.Migrate(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestRedisV1ScanExpiry expires a host of the EYV1 layout between the scan
+// of its key and its read, which leaves it out rather than failing.
+func TestRedisV1ScanExpiry(t *testing.T) {
+	r := miniredis.RunT(t)
+	c := newTestRedisConfig(r)
+	c.RedisV1Compat = true
+	s := newTestRedisStorage(t, c)
+	if err := s.putV1(&Host{Service: "svc", IpAddress: "10.0.0.1", Port: 80}, time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.putV1(&Host{Service: "svc", IpAddress: "10.0.0.2", Port: 80}, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	serviceKeys, err := s.scanKeys(s.getServicePrefix("svc"))
+	if err != nil || len(serviceKeys) != 2 {
+		t.Fatalf("got keys %v, %v, want %d keys", serviceKeys, err, 2)
+	}
+	r.FastForward(2 * time.Second)
+	hosts, err := s.readServiceKeys(serviceKeys)
+	if err != nil || len(hosts) != 1 || hosts[0].IpAddress != "10.0.0.2" {
+		t.Fatalf("got %v, %v, want 10.0.0.2", hosts, err)
+	}
+	if hosts, err = s.List("svc", ""); err != nil || len(hosts) != 1 {
+		t.Fatalf("got %v, %v, want %d host", hosts, err, 1)
+	}
+}
+
+// TestRedisExpiry sweeps expired hosts from two instances at the same time,
+// and checks that each expiry is published once.
+func TestRedisExpiry(t *testing.T) {
+	r := miniredis.RunT(t)
+	s1 := newTestRedisStorage(t, newTestRedisConfig(r))
+	s2 := newTestRedisStorage(t, newTestRedisConfig(r))
+	// both instances receive every event once they subscribed
+	for deadline := time.Now().Add(time.Second); r.PubSubNumSub(s1.getEventsKey())[s1.getEventsKey()] < 2; {
+		if time.Now().After(deadline) {
+			t.Fatal("instances did not subscribe to events")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	events := s1.Events().Subscribe()
+	defer s1.Events().Unsubscribe(events)
+
+	hosts := []*Host{
+		{Service: "svc", IpAddress: "10.0.0.1", Port: 80, Tags: &Tags{Az: "r1a"}},
+		{Service: "svc", IpAddress: "10.0.0.2", Port: 80, Tags: &Tags{Az: "r1a"}},
+	}
+	if errs := s1.PutAll(hosts, []time.Duration{time.Millisecond * 50, time.Minute}); errs[0] != nil || errs[1] != nil {
+		t.Fatal(errs)
+	}
+	time.Sleep(time.Millisecond * 100)
+	done := make(chan error, 2)
+	for _, s := range []*redisStorage{s1, s2} {
+		go func(s *redisStorage) {
+			done <- s.sweep()
+		}(s)
+	}
+	for i := 0; i < 2; i++ {
+		if err := <-done; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	expired := 0
+	timeout := time.After(time.Millisecond * 500)
+	for received := false; !received; {
+		select {
+		case event := <-events:
+			if event.Type == EVENT_EXPIRED {
+				// the expiry follows the two registrations
+				if event.GetHost().GetIpAddress() != "10.0.0.1" || event.Index != 3 {
+					t.Fatalf("got %v, want the expiry of 10.0.0.1 at index %d", event, 3)
+				}
+				expired++
+			}
+		case <-timeout:
+			received = true
+		}
+	}
+	if expired != 1 {
+		t.Fatalf("got %d expiries, want %d", expired, 1)
+	}
+	for _, s := range []*redisStorage{s1, s2} {
+		if index, err := s.Index("svc"); err != nil || index != 3 {
+			t.Fatalf("got index %d, %v, want %d", index, err, 3)
+		}
+	}
+
+	// the expired host leaves the indexes, the other stays
+	for _, s := range []*redisStorage{s1, s2} {
+		matching, err := s.ListMatching("svc", hostFilter{az: "r1a"})
+		if err != nil || len(matching) != 1 || matching[0].IpAddress != "10.0.0.2" {
+			t.Fatalf("got %v, %v in az r1a, want 10.0.0.2", matching, err)
+		}
+	}
+	if members, _ := r.SMembers(s1.getIndexKey("svc", FILTER_AZ+FILTER_EQUALS+"r1a")); len(members) != 1 {
+		t.Fatalf("got index members %v, want %d member", members, 1)
+	}
+}
+
+func TestRedisUpdateKeepsExpiry(t *testing.T) {
+	r := miniredis.RunT(t)
+	c := newTestRedisConfig(r)
+	c.RedisV1Compat = true
+	s := newTestRedisStorage(t, c)
+	host := &Host{Service: "svc", IpAddress: "10.0.0.1", Port: 80, Tags: &Tags{Az: "r1a"}}
+	if err := s.Put(host, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	expires, err := r.ZScore(s.getExpiresKey("svc"), hostKey(host.IpAddress, int(host.Port)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// an update later on keeps the expiry of the registration
+	time.Sleep(time.Millisecond * 10)
+	err = s.Update("svc", host.IpAddress, int(host.Port), func(host *Host) error {
+		host.Tags.Az = "r1b"
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if score, err := r.ZScore(s.getExpiresKey("svc"), hostKey(host.IpAddress, int(host.Port))); err != nil || score != expires {
+		t.Fatalf("got expiry %v, %v, want %v", score, err, expires)
+	}
+	if ttl := r.TTL(s.getServiceKey("svc", host.IpAddress, int(host.Port))); ttl <= 0 || ttl >= time.Minute {
+		t.Fatalf("got v1 ttl %v, want less than %v", ttl, time.Minute)
+	}
+}
+
+func TestRedisCluster(t *testing.T) {
+	r := miniredis.RunT(t)
+	c := newTestRedisConfig(r)
+	c.RedisMode = REDIS_MODE_CLUSTER
+	c.RedisAddrs = []string{r.Addr()}
+	testRedisStorage(t, newTestRedisStorage(t, c))
+
+	c.RedisDB = 1
+	if _, err := NewRedisStorage(c); err == nil {
+		t.Fatal("got no error for a cluster db, want an error")
+	}
+}
+
+func TestRedisSentinel(t *testing.T) {
+	r := miniredis.RunT(t)
+	c := newTestRedisConfig(r)
+	c.RedisMode = REDIS_MODE_SENTINEL
+	c.RedisMasterName = "envoyds"
+	c.RedisAddrs = []string{newTestSentinel(t, r, c.RedisMasterName).Addr().String()}
+	testRedisStorage(t, newTestRedisStorage(t, c))
+}
+
+// newTestSentinel answers the sentinel commands of go-redis with r as the
+// master named name.
+func newTestSentinel(t *testing.T, r *miniredis.Miniredis, name string) *server.Server {
+	sentinel, err := server.NewServer("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(sentinel.Close)
+	sentinel.Register("SENTINEL", func(c *server.Peer, cmd string, args []string) {
+		switch {
+		case len(args) == 2 && strings.EqualFold(args[0], "get-master-addr-by-name") && args[1] == name:
+			c.WriteStrings([]string{r.Host(), r.Port()})
+		case len(args) == 2 && strings.EqualFold(args[0], "sentinels"):
+			c.WriteLen(0)
+		default:
+			c.WriteNull()
+		}
+	})
+	sentinel.Register("SUBSCRIBE", func(c *server.Peer, cmd string, args []string) {
+		for i, channel := range args {
+			c.WriteLen(3)
+			c.WriteBulk("subscribe")
+			c.WriteBulk(channel)
+			c.WriteInt(i + 1)
+		}
+	})
+	sentinel.Register("PING", func(c *server.Peer, cmd string, args []string) {
+		c.WriteLen(2)
+		c.WriteBulk("pong")
+		c.WriteBulk("")
+	})
+	return sentinel
+}
+
+// testRedisStorage registers, finds, updates and deletes a host through s.
+func testRedisStorage(t *testing.T, s *redisStorage) {
+	if err := s.Probe(); err != nil {
+		t.Fatal(err)
+	}
+	host := &Host{Service: "svc", IpAddress: "10.0.0.1", Port: 80, ServiceRepoName: "repo", Tags: &Tags{Az: "r1a"}}
+	if err := s.Put(host, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if matching, err := s.ListMatching("svc", hostFilter{az: "r1a"}); err != nil || len(matching) != 1 {
+		t.Fatalf("got %v, %v in az r1a, want %d host", matching, err, 1)
+	}
+	if repo, err := s.ListByRepo("repo"); err != nil || len(repo) != 1 {
+		t.Fatalf("got %v, %v in repo, want %d host", repo, err, 1)
+	}
+	if services, err := s.Services(); err != nil || len(services) != 1 || services[0] != "svc" {
+		t.Fatalf("got services %v, %v, want svc", services, err)
+	}
+	err := s.Update("svc", host.IpAddress, int(host.Port), func(host *Host) error {
+		host.Tags.Az = "r1b"
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if matching, err := s.ListMatching("svc", hostFilter{az: "r1a"}); err != nil || len(matching) != 0 {
+		t.Fatalf("got %v, %v in az r1a, want no host", matching, err)
+	}
+	if err = s.Delete("svc", host.IpAddress, int(host.Port)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = s.Get("svc", host.IpAddress, int(host.Port)); err != ErrHostNotFound {
+		t.Fatalf("got %v, want %v", err, ErrHostNotFound)
+	}
+}
+
+func TestRedisAuth(t *testing.T) {
+	// a password authenticates the default user
+	r := miniredis.RunT(t)
+	r.RequireAuth("secret")
+	c := newTestRedisConfig(r)
+	c.RedisPassword = "secret"
+	c.RedisDB = 2
+	testRedisStorage(t, newTestRedisStorage(t, c))
+	if keys := r.DB(2).Keys(); len(keys) == 0 {
+		t.Fatalf("got no keys in db %d, want the keys of the storage", 2)
+	}
+	c.RedisPassword = "wrong"
+	if _, err := NewRedisStorage(c); err == nil {
+		t.Fatal("got no error for a wrong password, want an error")
+	}
+
+	// an ACL user is authenticated before the db is selected
+	r = miniredis.RunT(t)
+	r.RequireUserAuth("envoyds", "secret")
+	c = newTestRedisConfig(r)
+	c.RedisUsername = "envoyds"
+	c.RedisPassword = "secret"
+	c.RedisDB = 3
+	testRedisStorage(t, newTestRedisStorage(t, c))
+	if keys := r.DB(3).Keys(); len(keys) == 0 {
+		t.Fatalf("got no keys in db %d, want the keys of the storage", 3)
+	}
+	c.RedisPassword = "wrong"
+	if _, err := NewRedisStorage(c); err == nil {
+		t.Fatal("got no error for a wrong password, want an error")
+	}
+}
+
+func TestRedisTLS(t *testing.T) {
+	dir := t.TempDir()
+	ca, caKey := newTestCertificate(t, nil, nil, filepath.Join(dir, "ca.pem"), "")
+	serverCert, _ := newTestCertificate(t, ca, caKey, filepath.Join(dir, "server.pem"), filepath.Join(dir, "server-key.pem"))
+	newTestCertificate(t, ca, caKey, filepath.Join(dir, "client.pem"), filepath.Join(dir, "client-key.pem"))
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(ca)
+	r := miniredis.NewMiniRedis()
+	err := r.StartTLS(&tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{serverCert.Raw}, PrivateKey: readTestKey(t, filepath.Join(dir, "server-key.pem"))}},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    clientCAs,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	c := newTestRedisConfig(r)
+	c.RedisTLS = true
+	c.RedisTLSCA = filepath.Join(dir, "ca.pem")
+	c.RedisTLSCert = filepath.Join(dir, "client.pem")
+	c.RedisTLSKey = filepath.Join(dir, "client-key.pem")
+	c.RedisTLSServerName = "localhost"
+	testRedisStorage(t, newTestRedisStorage(t, c))
+
+	// the server is verified against the ca, and the client presents its
+	// certificate
+	c.RedisTLSServerName = "other"
+	if _, err = NewRedisStorage(c); err == nil {
+		t.Fatal("got no error for another server name, want an error")
+	}
+	c.RedisTLSServerName = "localhost"
+	c.RedisTLSCert, c.RedisTLSKey = "", ""
+	if _, err = NewRedisStorage(c); err == nil {
+		t.Fatal("got no error without a client certificate, want an error")
+	}
+}
+
+// newTestCertificate writes a certificate for localhost signed by parent, or
+// a self-signed ca without parent, and its key when keyPath is set.
+func newTestCertificate(t *testing.T, parent *x509.Certificate, parentKey *ecdsa.PrivateKey, certPath, keyPath string) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		DNSNames:     []string{"localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	if parent == nil {
+		template.Subject.CommonName = "envoyds test ca"
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		template.KeyUsage |= x509.KeyUsageCertSign
+		parent, parentKey = template, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeTestPEM(t, certPath, "CERTIFICATE", der)
+	if keyPath != "" {
+		keyDER, err := x509.MarshalECPrivateKey(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		writeTestPEM(t, keyPath, "EC PRIVATE KEY", keyDER)
+	}
+	return cert, key
+}
+
+func writeTestPEM(t *testing.T, path, blockType string, der []byte) {
+	if err := ioutil.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func readTestKey(t *testing.T, path string) *ecdsa.PrivateKey {
+	bs, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, _ := pem.Decode(bs)
+	key, err := x509.ParseECPrivateKey(block.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
@@ -0,0 +1,245 @@
+package envoyds
+
+import (
+	"errors"
+	"github.com/go-redis/redis"
+	"github.com/golang/protobuf/proto"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The EYV1 layout keeps every host in its own hash under
+// EYV1:env:SERVICENAME:service:ip:port, next to a EYV1:env:REPONAME:repo:ip:port
+// hash pointing back at it, and finds the hosts of a service by scanning the
+// keyspace. It is only read and written when envoyds.redis.v1_compat is set,
+// while instances still running on it are replaced.
+
+func (s *redisStorage) putV1(host *Host, ttl time.Duration) error {
+	serviceKey := s.getServiceKey(host.Service, host.IpAddress, int(host.Port))
+	repoKey := s.getRepoKey(host.ServiceRepoName, host.IpAddress, int(host.Port))
+	return s.write(serviceKey, repoKey, host, ttl)
+}
+
+func (s *redisStorage) getV1(service, ip string, port int) (*Host, error) {
+	var host Host
+	if err := s.read(s.getServiceKey(service, ip, port), &host); err != nil {
+		if err == redis.Nil {
+			return nil, ErrHostNotFound
+		}
+		return nil, err
+	}
+	return &host, nil
+}
+
+func (s *redisStorage) listV1(service, ip string) ([]*Host, error) {
+	prefix := s.getServicePrefix(service)
+	if ip != "" {
+		prefix = s.getServiceIpPrefix(service, ip)
+	}
+	return s.scanHosts(prefix)
+}
+
+// listByRepoV1 follows every repo key of repoName to the service key it
+// points at. Repo keys left behind by a host that moved to another repo are
+// skipped.
+func (s *redisStorage) listByRepoV1(repoName string) ([]*Host, error) {
+	var (
+		hosts = make([]*Host, 0, REDIS_BATCH_SIZE)
+	)
+	repoKeys, err := s.scanKeys(s.getRepoPrefix(repoName))
+	if err != nil {
+		return hosts, err
+	}
+	for _, repoKey := range repoKeys {
+		serviceKey, err := s.redis.HGet(repoKey, REDIS_FIELD).Result()
+		if err == redis.Nil {
+			continue
+		}
+		if err != nil {
+			return hosts, err
+		}
+		var host Host
+		if err = s.read(serviceKey, &host); err == redis.Nil {
+			continue
+		}
+		if err != nil {
+			return hosts, err
+		}
+		if host.ServiceRepoName == repoName {
+			hosts = append(hosts, &host)
+		}
+	}
+	return hosts, nil
+}
+
+func (s *redisStorage) servicesV1() ([]string, error) {
+	prefix := strings.Join([]string{REDIS_V1_PREFIX, s.env, REDIS_SERVICE_NAME, ""}, REDIS_DELIMITER)
+	serviceKeys, err := s.scanKeys(prefix + "*")
+	if err != nil {
+		return nil, err
+	}
+	unique := make(map[string]bool, len(serviceKeys))
+	services := make([]string, 0, len(serviceKeys))
+	for _, serviceKey := range serviceKeys {
+		service := strings.SplitN(strings.TrimPrefix(serviceKey, prefix), REDIS_DELIMITER, 2)[0]
+		if !unique[service] {
+			unique[service] = true
+			services = append(services, service)
+		}
+	}
+	return services, nil
+}
+
+func (s *redisStorage) deleteV1(service, ip string, port int) error {
+	err := s.deleteServiceByServiceKey(s.getServiceKey(service, ip, port))
+	if err == redis.Nil {
+		return ErrHostNotFound
+	}
+	return err
+}
+
+func (s *redisStorage) scanHosts(prefix string) ([]*Host, error) {
+	serviceKeys, err := s.scanKeys(prefix)
+	if err != nil {
+		return nil, err
+	}
+	return s.readServiceKeys(serviceKeys)
+}
+
+// readServiceKeys returns the hosts stored under serviceKeys, skipping the
+// keys that expired since they were scanned.
+func (s *redisStorage) readServiceKeys(serviceKeys []string) ([]*Host, error) {
+	hosts := make([]*Host, 0, len(serviceKeys))
+	for _, serviceKey := range serviceKeys {
+		var host Host
+		err := s.read(serviceKey, &host)
+		if err == redis.Nil {
+			continue
+		}
+		if err != nil {
+			return hosts, err
+		}
+		hosts = append(hosts, &host)
+	}
+	return hosts, nil
+}
+
+// deleteServiceByServiceKey deletes the service key and then the repo key
+// pointing at it. The keys are in different cluster slots, so they are not
+// deleted in one transaction: a repo key left behind points at a missing
+// service key, which readers skip, and expires with it.
+func (s *redisStorage) deleteServiceByServiceKey(serviceKey string) error {
+	var host Host
+	if err := s.read(serviceKey, &host); err != nil {
+		return err
+	}
+	deleted, err := s.redis.Del(serviceKey).Result()
+	if err != nil {
+		return err
+	}
+	if deleted == 0 {
+		return errors.New("cannot find service when deleting")
+	}
+	return s.redis.Del(s.getRepoKey(host.ServiceRepoName, host.IpAddress, int(host.Port))).Err()
+}
+
+// scanKeys returns the distinct keys matching prefix. A cluster is scanned
+// master by master since SCAN only walks the keyspace of the node it runs on.
+func (s *redisStorage) scanKeys(prefix string) ([]string, error) {
+	var (
+		lock   = &sync.Mutex{}
+		unique = make(map[string]bool, REDIS_BATCH_SIZE)
+	)
+	err := s.forEachMaster(func(client redis.Cmdable) error {
+		var cursor uint64
+		for {
+			keys, next, err := client.Scan(cursor, prefix, REDIS_BATCH_SIZE).Result()
+			if err != nil {
+				return err
+			}
+			lock.Lock()
+			for _, key := range keys {
+				unique[key] = true
+			}
+			lock.Unlock()
+			if next == 0 {
+				return nil
+			}
+			cursor = next
+		}
+	})
+	keys := make([]string, 0, len(unique))
+	for key := range unique {
+		keys = append(keys, key)
+	}
+	return keys, err
+}
+
+// forEachMaster calls fn, possibly concurrently, with every node that owns a
+// share of the keyspace.
+func (s *redisStorage) forEachMaster(fn func(client redis.Cmdable) error) error {
+	if cluster, ok := s.redis.(*redis.ClusterClient); ok {
+		return cluster.ForEachMaster(func(client *redis.Client) error {
+			return fn(client)
+		})
+	}
+	return fn(s.redis)
+}
+
+func (s *redisStorage) getServiceKey(serviceName, ip string, port int) string {
+	return strings.Join([]string{REDIS_V1_PREFIX, s.env, REDIS_SERVICE_NAME, serviceName, ip, strconv.Itoa(port)}, REDIS_DELIMITER)
+}
+
+func (s *redisStorage) getServicePrefix(serviceName string) string {
+	return strings.Join([]string{REDIS_V1_PREFIX, s.env, REDIS_SERVICE_NAME, serviceName, "*"}, REDIS_DELIMITER)
+}
+
+func (s *redisStorage) getServiceIpPrefix(serviceName, ip string) string {
+	return strings.Join([]string{REDIS_V1_PREFIX, s.env, REDIS_SERVICE_NAME, serviceName, ip, "*"}, REDIS_DELIMITER)
+}
+
+func (s *redisStorage) getRepoKey(repoName, ip string, port int) string {
+	return strings.Join([]string{REDIS_V1_PREFIX, s.env, REDIS_REPO_NAME, repoName, ip, strconv.Itoa(port)}, REDIS_DELIMITER)
+}
+
+func (s *redisStorage) getRepoPrefix(repoName string) string {
+	return strings.Join([]string{REDIS_V1_PREFIX, s.env, REDIS_REPO_NAME, repoName, "*"}, REDIS_DELIMITER)
+}
+
+// write stores host under serviceKey and then points repoKey at it, each key
+// set along with its expiry in a transaction of its own. The keys are in
+// different cluster slots, so they are not written in one transaction: a
+// failure in between leaves the host out of its repo until it registers
+// again.
+func (s *redisStorage) write(serviceKey, repoKey string, host *Host, ttl time.Duration) error {
+	bs, err := proto.Marshal(host)
+	if err != nil {
+		return err
+	}
+	if err = s.writeExpiring(serviceKey, bs, ttl); err != nil {
+		return err
+	}
+	return s.writeExpiring(repoKey, []byte(serviceKey), ttl)
+}
+
+func (s *redisStorage) writeExpiring(key string, value []byte, ttl time.Duration) error {
+	_, err := s.redis.TxPipelined(func(pipe redis.Pipeliner) error {
+		pipe.HSet(key, REDIS_FIELD, value)
+		pipe.Expire(key, ttl)
+		return nil
+	})
+	return err
+}
+
+func (s *redisStorage) read(serviceKey string, host *Host) error {
+	bs, err := s.redis.HGet(serviceKey, REDIS_FIELD).Result()
+	if err != nil {
+		return err
+	}
+	if err = proto.Unmarshal([]byte(bs), host); err != nil {
+		return err
+	}
+	return nil
+}
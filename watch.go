@@ -0,0 +1,201 @@
+package envoyds
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/url"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	HEADER_INDEX = "X-Envoyds-Index"
+	QUERY_INDEX  = "index"
+	QUERY_WAIT   = "wait"
+	// WATCH_WAIT is how long a watch blocks when it sets no wait.
+	WATCH_WAIT = time.Minute * 5
+	// MAX_WATCH_WAIT bounds the wait a watch may set.
+	MAX_WATCH_WAIT = time.Minute * 10
+	// EVENT_HISTORY_SIZE is how many of the latest events are kept for feeds
+	// to catch up or resume from.
+	EVENT_HISTORY_SIZE = 4096
+)
+
+// parseWatch reads the index a request watches a service from, and how long
+// it may wait for a change, 0 when it does not watch.
+func parseWatch(query url.Values) (uint64, time.Duration, error) {
+	value := query.Get(QUERY_INDEX)
+	if value == "" {
+		return 0, 0, nil
+	}
+	index, err := strconv.ParseUint(value, 10, 64)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid index %q", value)
+	}
+	wait := WATCH_WAIT
+	if value := query.Get(QUERY_WAIT); value != "" {
+		if wait, err = time.ParseDuration(value); err != nil || wait <= 0 {
+			return 0, 0, fmt.Errorf("invalid wait %q, use a duration such as 30s", value)
+		}
+		if wait > MAX_WATCH_WAIT {
+			wait = MAX_WATCH_WAIT
+		}
+	}
+	return index, wait, nil
+}
+
+// serviceIndexes wakes up the watches of a service on the events of a
+// storage, which include those made by other instances and expiries. The
+// index of a service is read from the storage, which counts its changes, so
+// every instance sharing the storage gives the same one.
+//
+// The latest events are kept along with the number this instance saw them
+// at, for feeds to catch up or resume from. Events are identified across
+// instances by their service and index.
+type serviceIndexes struct {
+	lock    *sync.Mutex
+	store   Storage
+	index   uint64
+	waiters map[string]chan struct{}
+	history []indexedEvent
+	// since is the index after which history holds every event.
+	since uint64
+	// next is closed on the next change to any service.
+	next chan struct{}
+}
+
+type indexedEvent struct {
+	index uint64
+	event *Event
+}
+
+func newServiceIndexes(store Storage) *serviceIndexes {
+	return &serviceIndexes{
+		lock:    &sync.Mutex{},
+		store:   store,
+		index:   1,
+		waiters: make(map[string]chan struct{}),
+		since:   1,
+		next:    make(chan struct{}),
+	}
+}
+
+// follow reads the events of hub until the process exits. Falling behind
+// wakes up the watches of every service, since which ones the missed events
+// changed is not known.
+func (x *serviceIndexes) follow(hub *eventHub) {
+	for {
+		for event := range hub.Subscribe() {
+			x.changed(event)
+		}
+		log.Println("service indexes fell behind, events were missed")
+		x.changedAll()
+	}
+}
+
+func (x *serviceIndexes) changed(event *Event) {
+	x.lock.Lock()
+	defer x.lock.Unlock()
+	x.index++
+	service := event.GetHost().GetService()
+	if waiter, ok := x.waiters[service]; ok {
+		close(waiter)
+		delete(x.waiters, service)
+	}
+	if len(x.history) == EVENT_HISTORY_SIZE {
+		x.since = x.history[0].index
+		x.history = append(x.history[:0], x.history[1:]...)
+	}
+	x.history = append(x.history, indexedEvent{x.index, event})
+	x.notify()
+}
+
+func (x *serviceIndexes) changedAll() {
+	x.lock.Lock()
+	defer x.lock.Unlock()
+	x.index++
+	for service, waiter := range x.waiters {
+		close(waiter)
+		delete(x.waiters, service)
+	}
+	x.history = nil
+	x.since = x.index
+	x.notify()
+}
+
+// notify wakes up the feeds. The caller must hold the lock.
+func (x *serviceIndexes) notify() {
+	close(x.next)
+	x.next = make(chan struct{})
+}
+
+// Current returns the number of the last event seen.
+func (x *serviceIndexes) Current() uint64 {
+	x.lock.Lock()
+	defer x.lock.Unlock()
+	return x.index
+}
+
+// Seen returns the number this instance saw the event index of service at,
+// or false when it does not have it: it is too old to be kept, or was not
+// seen since the instance started.
+func (x *serviceIndexes) Seen(service string, index uint64) (uint64, bool) {
+	x.lock.Lock()
+	defer x.lock.Unlock()
+	for i := len(x.history) - 1; i >= 0; i-- {
+		if event := x.history[i].event; event.GetIndex() == index && event.GetHost().GetService() == service {
+			return x.history[i].index, true
+		}
+	}
+	return 0, false
+}
+
+// EventsAfter returns the events seen after number index, the number they
+// reach and a channel closed on the next event. It returns false, and no
+// events, when it does not have all of them because they are too old to be
+// kept.
+func (x *serviceIndexes) EventsAfter(index uint64) ([]indexedEvent, uint64, <-chan struct{}, bool) {
+	x.lock.Lock()
+	defer x.lock.Unlock()
+	if index < x.since || index > x.index {
+		return nil, x.index, x.next, false
+	}
+	i := sort.Search(len(x.history), func(i int) bool {
+		return x.history[i].index > index
+	})
+	return append([]indexedEvent(nil), x.history[i:]...), x.index, x.next, true
+}
+
+// Wait blocks while the index of service is index, until it changes or ctx is
+// done, and returns the index then. It returns at once for any other index.
+// The watch is set before the index is read, so a change in between is not
+// missed.
+func (x *serviceIndexes) Wait(ctx context.Context, service string, index uint64) (uint64, error) {
+	for {
+		waiter := x.waiter(service)
+		current, err := x.store.Index(service)
+		if err != nil || current != index {
+			return current, err
+		}
+		select {
+		case <-waiter:
+		case <-ctx.Done():
+			return x.store.Index(service)
+		}
+	}
+}
+
+// waiter returns a channel closed on the next event of service.
+func (x *serviceIndexes) waiter(service string) <-chan struct{} {
+	x.lock.Lock()
+	defer x.lock.Unlock()
+	waiter, ok := x.waiters[service]
+	if !ok {
+		waiter = make(chan struct{})
+		x.waiters[service] = waiter
+	}
+	return waiter
+}
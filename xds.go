@@ -0,0 +1,193 @@
+package envoyds
+
+import (
+	"context"
+	core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	clusterservice "github.com/envoyproxy/go-control-plane/envoy/service/cluster/v3"
+	discovery "github.com/envoyproxy/go-control-plane/envoy/service/discovery/v3"
+	endpointservice "github.com/envoyproxy/go-control-plane/envoy/service/endpoint/v3"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/anypb"
+	"hash/fnv"
+	"io"
+	"log"
+	"sort"
+	"strconv"
+	"time"
+)
+
+const (
+	// XDS_REFRESH_PERIOD bounds how long a stream misses a change whose
+	// event was lost, e.g. while the storage was unreachable.
+	XDS_REFRESH_PERIOD = time.Second * 30
+)
+
+// xdsStream is the state of the world stream of any resource type.
+type xdsStream interface {
+	Context() context.Context
+	Send(*discovery.DiscoveryResponse) error
+	Recv() (*discovery.DiscoveryRequest, error)
+}
+
+// xdsType describes how the resources of a type are built from the registry.
+type xdsType struct {
+	typeURL string
+	// resources returns the resources named by names for node, keyed by name.
+	// A type that supports wildcard subscriptions returns all of them when
+	// names is empty.
+	resources func(node *core.Node, names []string) (map[string]proto.Message, error)
+	// affects reports whether event may change the resources of a response
+	// holding sent.
+	affects func(event *Event, sent map[string]bool) bool
+}
+
+func NewXDSServer(ds *service) *grpc.Server {
+	server := grpc.NewServer()
+	endpointservice.RegisterEndpointDiscoveryServiceServer(server, &edsServer{ds: ds})
+	clusterservice.RegisterClusterDiscoveryServiceServer(server, &cdsServer{ds: ds})
+	return server
+}
+
+// streamResources serves the state of the world variant of the protocol:
+// every response carries all the resources the stream subscribes to. One is
+// sent whenever the subscription or the resources change. Requests answering
+// an older response than the last one are stale and ignored; a rejected
+// response is logged and not sent again.
+//
+// The version of a response is a hash of its content, so every instance gives
+// the same version to the same resources and Envoy can move between instances
+// without being sent what it already has.
+func streamResources(stream xdsStream, t *xdsType, hub *eventHub) error {
+	var (
+		node    *core.Node
+		names   []string
+		sent    = make(map[string]bool)
+		version string
+		nonce   int
+	)
+	requests, errs := receiveRequests(stream.Context(), stream.Recv)
+	events := hub.Subscribe()
+	defer func() {
+		hub.Unsubscribe(events)
+	}()
+	ticker := time.NewTicker(XDS_REFRESH_PERIOD)
+	defer ticker.Stop()
+	send := func() error {
+		res, resourceNames, err := xdsResponse(t, node, names)
+		if err != nil {
+			return status.Error(codes.Unavailable, err.Error())
+		}
+		sent = make(map[string]bool, len(resourceNames))
+		for _, name := range resourceNames {
+			sent[name] = true
+		}
+		if nonce > 0 && res.VersionInfo == version {
+			return nil
+		}
+		nonce++
+		res.Nonce = strconv.Itoa(nonce)
+		version = res.VersionInfo
+		return stream.Send(res)
+	}
+	for {
+		var err error
+		select {
+		case <-stream.Context().Done():
+			return nil
+		case err = <-errs:
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		case req := <-requests:
+			if req.TypeUrl != "" && req.TypeUrl != t.typeURL {
+				return status.Errorf(codes.InvalidArgument, "unexpected type %s", req.TypeUrl)
+			}
+			if nonce > 0 && req.ResponseNonce != strconv.Itoa(nonce) {
+				continue
+			}
+			if req.ErrorDetail != nil {
+				log.Printf("streamResources rejected type=%s node=%s version=%s error=%s\n", t.typeURL, req.Node.GetId(), version, req.ErrorDetail.GetMessage())
+			}
+			if req.Node != nil {
+				// Envoy may only send its node on the first request
+				node = req.Node
+			}
+			names = req.ResourceNames
+			log.Printf("streamResources type=%s node=%s names=%d\n", t.typeURL, req.Node.GetId(), len(names))
+			err = send()
+		case event, ok := <-events:
+			if !ok {
+				// fell behind: resubscribe and send whatever changed meanwhile
+				events = hub.Subscribe()
+				err = send()
+			} else if t.affects(event, sent) {
+				err = send()
+			}
+		case <-ticker.C:
+			err = send()
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func fetchResources(t *xdsType, req *discovery.DiscoveryRequest) (*discovery.DiscoveryResponse, error) {
+	res, _, err := xdsResponse(t, req.Node, req.ResourceNames)
+	if err != nil {
+		return nil, status.Error(codes.Unavailable, err.Error())
+	}
+	return res, nil
+}
+
+// xdsResponse builds the response to node holding the resources named by
+// names, in the order of their names, and returns those names.
+func xdsResponse(t *xdsType, node *core.Node, names []string) (*discovery.DiscoveryResponse, []string, error) {
+	resources, err := t.resources(node, names)
+	if err != nil {
+		return nil, nil, err
+	}
+	resourceNames := make([]string, 0, len(resources))
+	for name := range resources {
+		resourceNames = append(resourceNames, name)
+	}
+	sort.Strings(resourceNames)
+	res := &discovery.DiscoveryResponse{TypeUrl: t.typeURL}
+	hash := fnv.New64a()
+	for _, name := range resourceNames {
+		bs, err := proto.MarshalOptions{Deterministic: true}.Marshal(resources[name])
+		if err != nil {
+			return nil, nil, err
+		}
+		hash.Write(bs)
+		res.Resources = append(res.Resources, &anypb.Any{TypeUrl: t.typeURL, Value: bs})
+	}
+	res.VersionInfo = strconv.FormatUint(hash.Sum64(), 16)
+	return res, resourceNames, nil
+}
+
+// receiveRequests reads requests off a stream until it fails, so that they
+// can be waited for along with other changes.
+func receiveRequests(ctx context.Context, recv func() (*discovery.DiscoveryRequest, error)) (<-chan *discovery.DiscoveryRequest, <-chan error) {
+	requests := make(chan *discovery.DiscoveryRequest)
+	errs := make(chan error, 1)
+	go func() {
+		for {
+			req, err := recv()
+			if err != nil {
+				errs <- err
+				return
+			}
+			select {
+			case requests <- req:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return requests, errs
+}
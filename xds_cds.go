@@ -0,0 +1,128 @@
+package envoyds
+
+import (
+	"context"
+	cluster "github.com/envoyproxy/go-control-plane/envoy/config/cluster/v3"
+	core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	clusterservice "github.com/envoyproxy/go-control-plane/envoy/service/cluster/v3"
+	discovery "github.com/envoyproxy/go-control-plane/envoy/service/discovery/v3"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/durationpb"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+	"strings"
+)
+
+const XDS_CLUSTER_TYPE_URL = "type.googleapis.com/envoy.config.cluster.v3.Cluster"
+
+// cdsServer serves an EDS cluster for every service with registered hosts.
+// Envoy reads the endpoints of the clusters from the server that sent them.
+type cdsServer struct {
+	clusterservice.UnimplementedClusterDiscoveryServiceServer
+	ds *service
+}
+
+func (s *cdsServer) StreamClusters(stream clusterservice.ClusterDiscoveryService_StreamClustersServer) error {
+	return streamResources(stream, s.xdsType(), s.ds.store.Events())
+}
+
+func (s *cdsServer) FetchClusters(ctx context.Context, req *discovery.DiscoveryRequest) (*discovery.DiscoveryResponse, error) {
+	return fetchResources(s.xdsType(), req)
+}
+
+func (s *cdsServer) xdsType() *xdsType {
+	return &xdsType{
+		typeURL: XDS_CLUSTER_TYPE_URL,
+		resources: func(node *core.Node, names []string) (map[string]proto.Message, error) {
+			services, err := s.ds.GetServiceNames()
+			if err != nil {
+				return nil, err
+			}
+			var requested map[string]bool
+			if len(names) > 0 {
+				requested = make(map[string]bool, len(names))
+				for _, name := range names {
+					requested[name] = true
+				}
+			}
+			resources := make(map[string]proto.Message, len(services))
+			for _, service := range services {
+				if requested == nil || requested[service] {
+					resources[service] = envoyCluster(service, s.ds.ClusterConfig(service), s.ds.LbSubsetKeys())
+				}
+			}
+			return resources, nil
+		},
+		affects: func(event *Event, sent map[string]bool) bool {
+			switch event.Type {
+			case EVENT_REGISTERED:
+				return !sent[event.GetHost().GetService()]
+			case EVENT_DELETED, EVENT_EXPIRED:
+				return sent[event.GetHost().GetService()]
+			}
+			return false
+		},
+	}
+}
+
+// envoyCluster builds the cluster of service. Load is split between the
+// localities of a priority by the weights EDS gives them. A cluster whose
+// hosts have subset keys balances within the subset a route selects by any
+// one of the keys or by all of them, and across every host when the route
+// selects none; the localities of a subset are weighted by their share of
+// its hosts.
+func envoyCluster(service string, c clusterConfig, subsetKeys []string) *cluster.Cluster {
+	res := &cluster.Cluster{
+		Name:                 service,
+		ClusterDiscoveryType: &cluster.Cluster_Type{Type: cluster.Cluster_EDS},
+		EdsClusterConfig: &cluster.Cluster_EdsClusterConfig{
+			EdsConfig: &core.ConfigSource{
+				ResourceApiVersion: core.ApiVersion_V3,
+				ConfigSourceSpecifier: &core.ConfigSource_Self{
+					Self: &core.SelfConfigSource{TransportApiVersion: core.ApiVersion_V3},
+				},
+			},
+			ServiceName: service,
+		},
+		ConnectTimeout: durationpb.New(c.ConnectTimeout.Duration),
+		LbPolicy:       cluster.Cluster_LbPolicy(cluster.Cluster_LbPolicy_value[strings.ToUpper(c.LbPolicy)]),
+		CommonLbConfig: &cluster.Cluster_CommonLbConfig{
+			LocalityConfigSpecifier: &cluster.Cluster_CommonLbConfig_LocalityWeightedLbConfig_{
+				LocalityWeightedLbConfig: &cluster.Cluster_CommonLbConfig_LocalityWeightedLbConfig{},
+			},
+		},
+	}
+	if c.hasCircuitBreakers() {
+		thresholds := &cluster.CircuitBreakers_Thresholds{}
+		if c.MaxConnections != 0 {
+			thresholds.MaxConnections = wrapperspb.UInt32(c.MaxConnections)
+		}
+		if c.MaxPendingRequests != 0 {
+			thresholds.MaxPendingRequests = wrapperspb.UInt32(c.MaxPendingRequests)
+		}
+		if c.MaxRequests != 0 {
+			thresholds.MaxRequests = wrapperspb.UInt32(c.MaxRequests)
+		}
+		if c.MaxRetries != 0 {
+			thresholds.MaxRetries = wrapperspb.UInt32(c.MaxRetries)
+		}
+		res.CircuitBreakers = &cluster.CircuitBreakers{Thresholds: []*cluster.CircuitBreakers_Thresholds{thresholds}}
+	}
+	if len(subsetKeys) > 0 {
+		res.LbSubsetConfig = &cluster.Cluster_LbSubsetConfig{
+			FallbackPolicy:      cluster.Cluster_LbSubsetConfig_ANY_ENDPOINT,
+			LocalityWeightAware: true,
+			ScaleLocalityWeight: true,
+		}
+		for _, key := range subsetKeys {
+			res.LbSubsetConfig.SubsetSelectors = append(res.LbSubsetConfig.SubsetSelectors, &cluster.Cluster_LbSubsetConfig_LbSubsetSelector{
+				Keys: []string{key},
+			})
+		}
+		if len(subsetKeys) > 1 {
+			res.LbSubsetConfig.SubsetSelectors = append(res.LbSubsetConfig.SubsetSelectors, &cluster.Cluster_LbSubsetConfig_LbSubsetSelector{
+				Keys: subsetKeys,
+			})
+		}
+	}
+	return res
+}
@@ -0,0 +1,144 @@
+package envoyds
+
+import (
+	"context"
+	core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	endpoint "github.com/envoyproxy/go-control-plane/envoy/config/endpoint/v3"
+	discovery "github.com/envoyproxy/go-control-plane/envoy/service/discovery/v3"
+	endpointservice "github.com/envoyproxy/go-control-plane/envoy/service/endpoint/v3"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/structpb"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+	"sort"
+)
+
+const XDS_ENDPOINT_TYPE_URL = "type.googleapis.com/envoy.config.endpoint.v3.ClusterLoadAssignment"
+
+// edsServer serves the hosts of each service as the endpoints of the Envoy
+// cluster named after it.
+type edsServer struct {
+	endpointservice.UnimplementedEndpointDiscoveryServiceServer
+	ds *service
+}
+
+func (s *edsServer) StreamEndpoints(stream endpointservice.EndpointDiscoveryService_StreamEndpointsServer) error {
+	return streamResources(stream, s.xdsType(), s.ds.store.Events())
+}
+
+func (s *edsServer) FetchEndpoints(ctx context.Context, req *discovery.DiscoveryRequest) (*discovery.DiscoveryResponse, error) {
+	return fetchResources(s.xdsType(), req)
+}
+
+func (s *edsServer) xdsType() *xdsType {
+	return &xdsType{
+		typeURL: XDS_ENDPOINT_TYPE_URL,
+		resources: func(node *core.Node, clusters []string) (map[string]proto.Message, error) {
+			region := nodeRegion(node)
+			resources := make(map[string]proto.Message, len(clusters))
+			for _, cluster := range clusters {
+				hosts, err := s.ds.GetServicesByName(cluster)
+				if err != nil {
+					return nil, err
+				}
+				s.ds.AssignPriorities(region, hosts)
+				resources[cluster] = clusterLoadAssignment(cluster, hosts)
+			}
+			return resources, nil
+		},
+		affects: func(event *Event, sent map[string]bool) bool {
+			return sent[event.GetHost().GetService()]
+		},
+	}
+}
+
+// nodeRegion is the region of the Envoy of node: that of its locality, or
+// else the region field of its metadata.
+func nodeRegion(node *core.Node) string {
+	if region := node.GetLocality().GetRegion(); region != "" {
+		return region
+	}
+	return node.GetMetadata().GetFields()["region"].GetStringValue()
+}
+
+// clusterLoadAssignment groups hosts into localities by priority, region and
+// az, each weighted by the sum of the weights of its hosts. Localities and
+// hosts are listed in a stable order, so that the same hosts always make the
+// same assignment.
+func clusterLoadAssignment(cluster string, hosts []*Host) *endpoint.ClusterLoadAssignment {
+	hosts = append([]*Host(nil), hosts...)
+	sort.Slice(hosts, func(i, j int) bool {
+		if hosts[i].Priority != hosts[j].Priority {
+			return hosts[i].Priority < hosts[j].Priority
+		}
+		if hosts[i].GetTags().GetRegion() != hosts[j].GetTags().GetRegion() {
+			return hosts[i].GetTags().GetRegion() < hosts[j].GetTags().GetRegion()
+		}
+		if hosts[i].GetTags().GetAz() != hosts[j].GetTags().GetAz() {
+			return hosts[i].GetTags().GetAz() < hosts[j].GetTags().GetAz()
+		}
+		if hosts[i].IpAddress != hosts[j].IpAddress {
+			return hosts[i].IpAddress < hosts[j].IpAddress
+		}
+		return hosts[i].Port < hosts[j].Port
+	})
+	assignment := &endpoint.ClusterLoadAssignment{ClusterName: cluster}
+	var locality *endpoint.LocalityLbEndpoints
+	for _, host := range hosts {
+		region, zone := host.GetTags().GetRegion(), host.GetTags().GetAz()
+		if locality == nil || locality.Priority != uint32(host.Priority) || locality.Locality.Region != region || locality.Locality.Zone != zone {
+			locality = &endpoint.LocalityLbEndpoints{
+				Locality:            &core.Locality{Region: region, Zone: zone},
+				LoadBalancingWeight: wrapperspb.UInt32(0),
+				Priority:            uint32(host.Priority),
+			}
+			assignment.Endpoints = append(assignment.Endpoints, locality)
+		}
+		locality.LbEndpoints = append(locality.LbEndpoints, lbEndpoint(host))
+		locality.LoadBalancingWeight.Value += hostWeight(host)
+	}
+	return assignment
+}
+
+func lbEndpoint(host *Host) *endpoint.LbEndpoint {
+	return &endpoint.LbEndpoint{
+		HostIdentifier: &endpoint.LbEndpoint_Endpoint{
+			Endpoint: &endpoint.Endpoint{
+				Address: &core.Address{
+					Address: &core.Address_SocketAddress{
+						SocketAddress: &core.SocketAddress{
+							Address:       host.IpAddress,
+							PortSpecifier: &core.SocketAddress_PortValue{PortValue: uint32(host.Port)},
+						},
+					},
+				},
+			},
+		},
+		HealthStatus:        core.HealthStatus_HEALTHY,
+		LoadBalancingWeight: wrapperspb.UInt32(hostWeight(host)),
+		Metadata:            endpointMetadata(host),
+	}
+}
+
+// endpointMetadata returns the metadata of host as the filter metadata of an
+// endpoint, or nil when it has none.
+func endpointMetadata(host *Host) *core.Metadata {
+	if len(host.GetMetadata().GetFields()) == 0 {
+		return nil
+	}
+	metadata := &core.Metadata{FilterMetadata: make(map[string]*structpb.Struct, len(host.Metadata.Fields))}
+	for filter, value := range host.Metadata.Fields {
+		if fields := value.GetStructValue(); fields != nil {
+			metadata.FilterMetadata[filter] = fields
+		}
+	}
+	return metadata
+}
+
+// hostWeight is the load balancing weight of host, which Envoy takes as 1
+// when it is not set.
+func hostWeight(host *Host) uint32 {
+	if weight := host.GetTags().GetLoadBalancingWeight(); weight > 0 {
+		return uint32(weight)
+	}
+	return 1
+}